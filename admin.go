@@ -0,0 +1,114 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2025 Tencent.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package naming
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"trpc.group/trpc-go/trpc-naming-etcd/client"
+	"trpc.group/trpc-go/trpc-naming-etcd/discovery"
+	"trpc.group/trpc-go/trpc-naming-etcd/internal/admin"
+)
+
+func init() {
+	admin.HandleFunc("discovery", handleDiscoveryState)
+	admin.HandleFunc("discovery/resync", handleDiscoveryResync)
+	admin.HandleFunc("discovery/invalidate", handleDiscoveryInvalidate)
+}
+
+var (
+	discoveriesMu sync.RWMutex
+	// discoveries 插件创建的服务发现，插件名 -> 服务发现
+	discoveries = make(map[string]*discovery.Discovery)
+)
+
+// addDiscovery 记录插件创建的服务发现，用于管理命令查询
+func addDiscovery(name string, d *discovery.Discovery) {
+	discoveriesMu.Lock()
+	discoveries[name] = d
+	discoveriesMu.Unlock()
+}
+
+// handleDiscoveryState 查询服务发现的缓存状态，参数 plugin 指定插件名，service 指定服务名，
+// 为空时返回全部
+func handleDiscoveryState(r *http.Request) (interface{}, error) {
+	filter, serviceName := r.Form.Get("plugin"), r.Form.Get("service")
+	discoveriesMu.RLock()
+	defer discoveriesMu.RUnlock()
+	states := make(map[string]*discovery.State, len(discoveries))
+	for name, d := range discoveries {
+		if filter != "" && filter != name {
+			continue
+		}
+		state := d.State()
+		if serviceName != "" {
+			service, ok := state.Services[serviceName]
+			state.Services = make(map[string]*discovery.ServiceState)
+			if ok {
+				state.Services[serviceName] = service
+			}
+		}
+		states[name] = state
+	}
+	return states, nil
+}
+
+// handleDiscoveryResync 立即从 etcd 获取服务节点并覆盖缓存，返回获取到的节点个数
+func handleDiscoveryResync(r *http.Request) (interface{}, error) {
+	d, serviceName, err := discoveryTarget(r)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), client.DefaultTimeout)
+	defer cancel()
+	nodes, err := d.Resync(ctx, serviceName)
+	if err != nil {
+		return nil, fmt.Errorf("resync %s fail: %w", serviceName, err)
+	}
+	return map[string]int{"nodes": len(nodes)}, nil
+}
+
+// handleDiscoveryInvalidate 删除服务缓存，下次寻址时从 etcd 重新获取
+func handleDiscoveryInvalidate(r *http.Request) (interface{}, error) {
+	d, serviceName, err := discoveryTarget(r)
+	if err != nil {
+		return nil, err
+	}
+	d.Invalidate(serviceName)
+	return nil, nil
+}
+
+// discoveryTarget 解析修改缓存的命令参数，插件名默认为 etcd，服务名不能为空
+func discoveryTarget(r *http.Request) (*discovery.Discovery, string, error) {
+	if err := admin.RequirePost(r); err != nil {
+		return nil, "", err
+	}
+	name, serviceName := r.Form.Get("plugin"), r.Form.Get("service")
+	if name == "" {
+		name = pluginName
+	}
+	if serviceName == "" {
+		return nil, "", fmt.Errorf("%w: service is required", admin.ErrBadRequest)
+	}
+	discoveriesMu.RLock()
+	d, ok := discoveries[name]
+	discoveriesMu.RUnlock()
+	if !ok {
+		return nil, "", fmt.Errorf("%w: selector plugin %s not found", admin.ErrBadRequest, name)
+	}
+	return d, serviceName, nil
+}
@@ -0,0 +1,110 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2023 Tencent.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package naming
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"trpc.group/trpc-go/trpc-naming-etcd/client/fake"
+	"trpc.group/trpc-go/trpc-naming-etcd/discovery"
+	"trpc.group/trpc-go/trpc-naming-etcd/internal/admin"
+	"trpc.group/trpc-go/trpc-naming-etcd/model"
+
+	. "github.com/glycerine/goconvey/convey"
+)
+
+// adminResult 管理命令的输出
+type adminResult struct {
+	ErrorCode int             `json:"errorcode"`
+	Message   string          `json:"message"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// serveAdmin 执行管理命令
+func serveAdmin(handler admin.Handler, method, target string) *adminResult {
+	w := httptest.NewRecorder()
+	admin.Wrap(handler).ServeHTTP(w, httptest.NewRequest(method, target, nil))
+	ret := &adminResult{}
+	So(json.Unmarshal(w.Body.Bytes(), ret), ShouldBeNil)
+	return ret
+}
+
+func TestAdmin_Discovery(t *testing.T) {
+	Convey("测试服务发现的管理命令", t, func() {
+		e := fake.New()
+		defer e.Close()
+		value, _ := model.Marshal(&model.Node{Name: "test", ID: "1", Address: "127.0.0.1:8000"})
+		_, err := e.Put(context.Background(), model.NodePath("/fake/", "test", "1"), value)
+		So(err, ShouldBeNil)
+		td, err := discovery.NewDiscovery(e, &discovery.Config{Prefix: "/fake/"})
+		So(err, ShouldBeNil)
+		d := td.(*discovery.Discovery)
+		addDiscovery("etcd-admin", d)
+		defer func() {
+			discoveriesMu.Lock()
+			delete(discoveries, "etcd-admin")
+			discoveriesMu.Unlock()
+		}()
+		_, err = d.List("test")
+		So(err, ShouldBeNil)
+
+		ret := serveAdmin(handleDiscoveryState, http.MethodGet, "/cmds/etcd/discovery?plugin=etcd-admin&service=test")
+		So(ret.ErrorCode, ShouldEqual, 0)
+		states := make(map[string]*discovery.State)
+		So(json.Unmarshal(ret.Data, &states), ShouldBeNil)
+		So(states["etcd-admin"].Revision, ShouldEqual, e.Revision())
+		So(states["etcd-admin"].Services["test"].Nodes[0].Address, ShouldEqual, "127.0.0.1:8000")
+
+		// 修改缓存只允许 POST 且需要指定服务名
+		ret = serveAdmin(handleDiscoveryInvalidate, http.MethodGet,
+			"/cmds/etcd/discovery/invalidate?plugin=etcd-admin&service=test")
+		So(ret.ErrorCode, ShouldNotEqual, 0)
+		ret = serveAdmin(handleDiscoveryInvalidate, http.MethodPost,
+			"/cmds/etcd/discovery/invalidate?plugin=etcd-admin")
+		So(ret.Message, ShouldContainSubstring, "service is required")
+		ret = serveAdmin(handleDiscoveryInvalidate, http.MethodPost,
+			"/cmds/etcd/discovery/invalidate?plugin=none&service=test")
+		So(ret.Message, ShouldContainSubstring, "not found")
+
+		// 有订阅者时保留节点并重新获取，订阅者继续收到变更
+		events, cancel, err := d.Watch("test")
+		So(err, ShouldBeNil)
+		So(len((<-events).Nodes), ShouldEqual, 1)
+		ret = serveAdmin(handleDiscoveryInvalidate, http.MethodPost,
+			"/cmds/etcd/discovery/invalidate?plugin=etcd-admin&service=test")
+		So(ret.ErrorCode, ShouldEqual, 0)
+		So(len(d.State().Services["test"].Nodes), ShouldEqual, 1)
+		for i := 0; i < 100 && d.State().Services["test"].Expired; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		So(d.State().Services["test"].Expired, ShouldBeFalse)
+		cancel()
+
+		ret = serveAdmin(handleDiscoveryInvalidate, http.MethodPost,
+			"/cmds/etcd/discovery/invalidate?plugin=etcd-admin&service=test")
+		So(ret.ErrorCode, ShouldEqual, 0)
+		So(len(d.State().Services), ShouldEqual, 0)
+
+		ret = serveAdmin(handleDiscoveryResync, http.MethodPost,
+			"/cmds/etcd/discovery/resync?plugin=etcd-admin&service=test")
+		So(ret.ErrorCode, ShouldEqual, 0)
+		So(string(ret.Data), ShouldEqual, `{"nodes":1}`)
+		So(len(d.State().Services["test"].Nodes), ShouldEqual, 1)
+	})
+}
@@ -0,0 +1,319 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2025 Tencent.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+// Package fake 提供内存实现的 etcd，支持版本号、租约、watch 和压缩，用于不依赖真实 etcd 和 gomonkey 的测试
+package fake
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// ErrClosed 内存 etcd 已关闭
+var ErrClosed = errors.New("fake etcd is closed")
+
+// Etcd 内存 etcd，实现 client.Etcd 接口。
+// 读取只支持当前版本，删除和租约过期产生的多个变更使用同一个版本，watch 可以从未压缩的历史版本开始
+type Etcd struct {
+	mu        sync.Mutex
+	revision  int64
+	compacted int64
+	kvs       map[string]*mvccpb.KeyValue
+	// history 按版本顺序保存的变更，用于从历史版本开始 watch
+	history  []*clientv3.Event
+	leases   map[clientv3.LeaseID]*lease
+	lastID   clientv3.LeaseID
+	watchers map[*watcher]struct{}
+	closed   bool
+}
+
+// lease 内存租约
+type lease struct {
+	id    clientv3.LeaseID
+	ttl   int64
+	keys  map[string]struct{}
+	timer *time.Timer
+	// done 租约撤销或过期时关闭
+	done chan struct{}
+}
+
+// New 新建内存 etcd，初始版本为 1
+func New() *Etcd {
+	return &Etcd{
+		revision: 1,
+		kvs:      make(map[string]*mvccpb.KeyValue),
+		leases:   make(map[clientv3.LeaseID]*lease),
+		watchers: make(map[*watcher]struct{}),
+	}
+}
+
+// Revision 当前数据版本
+func (e *Etcd) Revision() int64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.revision
+}
+
+// Get 获取 key，支持 WithPrefix、WithRange、WithFromKey、WithLimit、WithKeysOnly、WithCountOnly
+func (e *Etcd) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return nil, ErrClosed
+	}
+	return e.getLocked(clientv3.OpGet(key, opts...))
+}
+
+// getLocked 执行读取操作
+func (e *Etcd) getLocked(op clientv3.Op) (*clientv3.GetResponse, error) {
+	if rev := op.Rev(); rev > 0 && rev != e.revision {
+		if rev <= e.compacted {
+			return nil, rpctypes.ErrCompacted
+		}
+		return nil, errors.New("fake etcd only supports reading the current revision")
+	}
+	kvs := e.rangeLocked(string(op.KeyBytes()), string(op.RangeBytes()))
+	rsp := &clientv3.GetResponse{Header: e.headerLocked(), Count: int64(len(kvs))}
+	if op.IsCountOnly() {
+		return rsp, nil
+	}
+	if limit := opField(op, "limit").Int(); limit > 0 && int64(len(kvs)) > limit {
+		kvs = kvs[:limit]
+		rsp.More = true
+	}
+	for _, kv := range kvs {
+		kv = copyKV(kv)
+		if op.IsKeysOnly() {
+			kv.Value = nil
+		}
+		rsp.Kvs = append(rsp.Kvs, kv)
+	}
+	return rsp, nil
+}
+
+// Put 写入 key，支持 WithLease、WithIgnoreLease、WithPrevKV
+func (e *Etcd) Put(ctx context.Context, key, val string, opts ...clientv3.OpOption) (*clientv3.PutResponse, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return nil, ErrClosed
+	}
+	return e.putLocked(clientv3.OpPut(key, val, opts...))
+}
+
+// putLocked 执行写入操作
+func (e *Etcd) putLocked(op clientv3.Op) (*clientv3.PutResponse, error) {
+	key, val := string(op.KeyBytes()), string(op.ValueBytes())
+	leaseID := clientv3.LeaseID(opField(op, "leaseID").Int())
+	if opField(op, "ignoreLease").Bool() {
+		prev, ok := e.kvs[key]
+		if !ok {
+			return nil, rpctypes.ErrKeyNotFound
+		}
+		leaseID = clientv3.LeaseID(prev.Lease)
+	} else if leaseID != clientv3.NoLease {
+		if _, ok := e.leases[leaseID]; !ok {
+			return nil, rpctypes.ErrLeaseNotFound
+		}
+	}
+	e.revision++
+	kv := &mvccpb.KeyValue{
+		Key:            []byte(key),
+		Value:          []byte(val),
+		CreateRevision: e.revision,
+		ModRevision:    e.revision,
+		Version:        1,
+		Lease:          int64(leaseID),
+	}
+	prev, ok := e.kvs[key]
+	if ok {
+		kv.CreateRevision = prev.CreateRevision
+		kv.Version = prev.Version + 1
+		if l, ok := e.leases[clientv3.LeaseID(prev.Lease)]; ok {
+			delete(l.keys, key)
+		}
+	}
+	if l, ok := e.leases[leaseID]; ok {
+		l.keys[key] = struct{}{}
+	}
+	e.kvs[key] = kv
+	event := &clientv3.Event{Type: mvccpb.PUT, Kv: copyKV(kv)}
+	if prev != nil {
+		event.PrevKv = copyKV(prev)
+	}
+	e.notifyLocked([]*clientv3.Event{event})
+	rsp := &clientv3.PutResponse{Header: e.headerLocked()}
+	if prev != nil && opField(op, "prevKV").Bool() {
+		rsp.PrevKv = copyKV(prev)
+	}
+	return rsp, nil
+}
+
+// Delete 删除 key，支持 WithPrefix、WithRange、WithFromKey、WithPrevKV
+func (e *Etcd) Delete(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.DeleteResponse, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return nil, ErrClosed
+	}
+	return e.deleteRangeLocked(clientv3.OpDelete(key, opts...)), nil
+}
+
+// deleteRangeLocked 执行删除操作
+func (e *Etcd) deleteRangeLocked(op clientv3.Op) *clientv3.DeleteResponse {
+	kvs := e.rangeLocked(string(op.KeyBytes()), string(op.RangeBytes()))
+	keys := make([]string, 0, len(kvs))
+	for _, kv := range kvs {
+		keys = append(keys, string(kv.Key))
+	}
+	e.deleteLocked(keys)
+	rsp := &clientv3.DeleteResponse{Header: e.headerLocked(), Deleted: int64(len(kvs))}
+	if opField(op, "prevKV").Bool() {
+		rsp.PrevKvs = kvs
+	}
+	return rsp
+}
+
+// Compact 压缩 rev 之前的历史变更，之后从这些版本开始 watch 会收到压缩错误
+func (e *Etcd) Compact(ctx context.Context, rev int64, opts ...clientv3.CompactOption) (*clientv3.CompactResponse,
+	error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return nil, ErrClosed
+	}
+	if rev <= e.compacted {
+		return nil, rpctypes.ErrCompacted
+	}
+	if rev > e.revision {
+		return nil, rpctypes.ErrFutureRev
+	}
+	e.compacted = rev
+	i := sort.Search(len(e.history), func(i int) bool {
+		return e.history[i].Kv.ModRevision >= rev
+	})
+	e.history = append([]*clientv3.Event(nil), e.history[i:]...)
+	return &clientv3.CompactResponse{Header: e.headerLocked()}, nil
+}
+
+// Close 关闭内存 etcd，停止所有租约计时和 watch
+func (e *Etcd) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	for id, l := range e.leases {
+		l.timer.Stop()
+		close(l.done)
+		delete(e.leases, id)
+	}
+	for w := range e.watchers {
+		w.close()
+		delete(e.watchers, w)
+	}
+	return nil
+}
+
+// rangeLocked 按 key 排序返回范围内的数据，end 为空时只匹配 key，end 为 "\x00" 时匹配大于等于 key 的所有 key
+func (e *Etcd) rangeLocked(key, end string) []*mvccpb.KeyValue {
+	var kvs []*mvccpb.KeyValue
+	for k, kv := range e.kvs {
+		if inRange(k, key, end) {
+			kvs = append(kvs, copyKV(kv))
+		}
+	}
+	sort.Slice(kvs, func(i, j int) bool {
+		return string(kvs[i].Key) < string(kvs[j].Key)
+	})
+	return kvs
+}
+
+// deleteLocked 在同一个版本中删除 keys，没有需要删除的 key 时版本不变
+func (e *Etcd) deleteLocked(keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+	sort.Strings(keys)
+	e.revision++
+	events := make([]*clientv3.Event, 0, len(keys))
+	for _, key := range keys {
+		prev, ok := e.kvs[key]
+		if !ok {
+			continue
+		}
+		delete(e.kvs, key)
+		if l, ok := e.leases[clientv3.LeaseID(prev.Lease)]; ok {
+			delete(l.keys, key)
+		}
+		events = append(events, &clientv3.Event{
+			Type:   mvccpb.DELETE,
+			Kv:     &mvccpb.KeyValue{Key: []byte(key), ModRevision: e.revision},
+			PrevKv: copyKV(prev),
+		})
+	}
+	e.notifyLocked(events)
+}
+
+// notifyLocked 记录当前版本的变更并通知 watcher
+func (e *Etcd) notifyLocked(events []*clientv3.Event) {
+	e.history = append(e.history, events...)
+	for w := range e.watchers {
+		w.send(e.headerLocked(), events)
+	}
+}
+
+// headerLocked 返回当前版本的响应头
+func (e *Etcd) headerLocked() *etcdserverpb.ResponseHeader {
+	return &etcdserverpb.ResponseHeader{Revision: e.revision}
+}
+
+// inRange 判断 k 是否在 etcd 的 [key, end) 范围内
+func inRange(k, key, end string) bool {
+	switch end {
+	case "":
+		return k == key
+	case "\x00":
+		return k >= key
+	default:
+		return k >= key && k < end
+	}
+}
+
+// copyKV 复制 kv，避免调用方修改内部数据
+func copyKV(kv *mvccpb.KeyValue) *mvccpb.KeyValue {
+	c := *kv
+	c.Key = append([]byte(nil), kv.Key...)
+	c.Value = append([]byte(nil), kv.Value...)
+	return &c
+}
+
+// opField 读取 clientv3.Op 中没有导出访问方法的选项，etcd 版本升级后字段不存在时直接 panic，
+// 避免选项被静默忽略
+func opField(op clientv3.Op, name string) reflect.Value {
+	v := reflect.ValueOf(op).FieldByName(name)
+	if !v.IsValid() {
+		panic("fake etcd: clientv3.Op has no field " + name)
+	}
+	return v
+}
@@ -0,0 +1,274 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2023 Tencent.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package fake
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"trpc.group/trpc-go/trpc-naming-etcd/client"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	. "github.com/glycerine/goconvey/convey"
+)
+
+var _ client.Etcd = (*Etcd)(nil)
+
+// nextResponse 获取下一个 watch 响应，超时返回 false
+func nextResponse(ch clientv3.WatchChan) (clientv3.WatchResponse, bool) {
+	select {
+	case rsp, ok := <-ch:
+		return rsp, ok
+	case <-time.After(time.Second):
+		return clientv3.WatchResponse{}, false
+	}
+}
+
+func TestEtcd_KV(t *testing.T) {
+	Convey("测试读写和版本号", t, func() {
+		ctx := context.Background()
+		e := New()
+		defer e.Close()
+		_, err := e.Put(ctx, "/a/1", "v1")
+		So(err, ShouldBeNil)
+		_, err = e.Put(ctx, "/a/2", "v2")
+		So(err, ShouldBeNil)
+		rsp, err := e.Put(ctx, "/a/1", "v3", clientv3.WithPrevKV())
+		So(err, ShouldBeNil)
+		So(string(rsp.PrevKv.Value), ShouldEqual, "v1")
+		_, err = e.Put(ctx, "/b", "v4")
+		So(err, ShouldBeNil)
+		So(e.Revision(), ShouldEqual, 5)
+
+		get, err := e.Get(ctx, "/a/", clientv3.WithPrefix())
+		So(err, ShouldBeNil)
+		So(get.Header.Revision, ShouldEqual, 5)
+		So(get.Count, ShouldEqual, 2)
+		So(string(get.Kvs[0].Key), ShouldEqual, "/a/1")
+		So(string(get.Kvs[0].Value), ShouldEqual, "v3")
+		So(get.Kvs[0].CreateRevision, ShouldEqual, 2)
+		So(get.Kvs[0].ModRevision, ShouldEqual, 4)
+		So(get.Kvs[0].Version, ShouldEqual, 2)
+		get, err = e.Get(ctx, "/a/", clientv3.WithPrefix(), clientv3.WithLimit(1), clientv3.WithKeysOnly())
+		So(err, ShouldBeNil)
+		So(len(get.Kvs), ShouldEqual, 1)
+		So(get.More, ShouldBeTrue)
+		So(get.Kvs[0].Value, ShouldBeEmpty)
+		get, err = e.Get(ctx, "/b")
+		So(err, ShouldBeNil)
+		So(len(get.Kvs), ShouldEqual, 1)
+
+		// 范围删除使用同一个版本，没有删除的 key 时版本不变
+		del, err := e.Delete(ctx, "/a/", clientv3.WithPrefix(), clientv3.WithPrevKV())
+		So(err, ShouldBeNil)
+		So(del.Deleted, ShouldEqual, 2)
+		So(len(del.PrevKvs), ShouldEqual, 2)
+		So(e.Revision(), ShouldEqual, 6)
+		del, err = e.Delete(ctx, "/a/1")
+		So(err, ShouldBeNil)
+		So(del.Deleted, ShouldEqual, 0)
+		So(e.Revision(), ShouldEqual, 6)
+
+		// 压缩后不能读取和 watch 历史版本
+		_, err = e.Compact(ctx, 5)
+		So(err, ShouldBeNil)
+		_, err = e.Get(ctx, "/b", clientv3.WithRev(3))
+		So(err, ShouldResemble, rpctypes.ErrCompacted)
+		_, err = e.Compact(ctx, 100)
+		So(err, ShouldResemble, rpctypes.ErrFutureRev)
+
+		So(e.Close(), ShouldBeNil)
+		_, err = e.Get(ctx, "/b")
+		So(err, ShouldEqual, ErrClosed)
+	})
+}
+
+func TestEtcd_Txn(t *testing.T) {
+	Convey("测试事务比较版本号后写入", t, func() {
+		ctx := context.Background()
+		e := New()
+		defer e.Close()
+		put, err := e.Put(ctx, "/a", "v1")
+		So(err, ShouldBeNil)
+		rev := put.Header.Revision
+
+		// 版本号一致时执行 Then
+		rsp, err := e.Txn(ctx).If(clientv3.Compare(clientv3.ModRevision("/a"), "=", rev)).
+			Then(clientv3.OpPut("/a", "v2")).Else(clientv3.OpGet("/a")).Commit()
+		So(err, ShouldBeNil)
+		So(rsp.Succeeded, ShouldBeTrue)
+		So(rsp.Header.Revision, ShouldEqual, rev+1)
+		So(rsp.Responses[0].GetResponsePut(), ShouldNotBeNil)
+
+		// 版本号变化后执行 Else
+		rsp, err = e.Txn(ctx).If(clientv3.Compare(clientv3.ModRevision("/a"), "=", rev)).
+			Then(clientv3.OpPut("/a", "v3")).Else(clientv3.OpGet("/a")).Commit()
+		So(err, ShouldBeNil)
+		So(rsp.Succeeded, ShouldBeFalse)
+		So(string(rsp.Responses[0].GetResponseRange().Kvs[0].Value), ShouldEqual, "v2")
+
+		// key 不存在时版本号按 0 比较，值比较不满足
+		rsp, err = e.Txn(ctx).If(clientv3.Compare(clientv3.CreateRevision("/b"), "=", 0)).
+			Then(clientv3.OpPut("/b", "v1")).Commit()
+		So(err, ShouldBeNil)
+		So(rsp.Succeeded, ShouldBeTrue)
+		rsp, err = e.Txn(ctx).If(clientv3.Compare(clientv3.Value("/c"), "!=", "v1")).
+			Then(clientv3.OpDelete("/b")).Commit()
+		So(err, ShouldBeNil)
+		So(rsp.Succeeded, ShouldBeFalse)
+		rsp, err = e.Txn(ctx).If(clientv3.Compare(clientv3.Value("/b"), "=", "v1")).
+			Then(clientv3.OpDelete("/b")).Commit()
+		So(err, ShouldBeNil)
+		So(rsp.Succeeded, ShouldBeTrue)
+		So(rsp.Responses[0].GetResponseDeleteRange().Deleted, ShouldEqual, 1)
+
+		// 不支持的比较返回错误
+		_, err = e.Txn(ctx).If(clientv3.Compare(clientv3.Version("/"), ">", 0).WithPrefix()).Commit()
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestEtcd_Lease(t *testing.T) {
+	Convey("测试租约续约、撤销和过期", t, func() {
+		ctx := context.Background()
+		e := New()
+		defer e.Close()
+		_, err := e.Put(ctx, "/a", "v", clientv3.WithLease(100))
+		So(err, ShouldResemble, rpctypes.ErrLeaseNotFound)
+
+		grant, err := e.Grant(ctx, 10)
+		So(err, ShouldBeNil)
+		_, err = e.Put(ctx, "/a/1", "v", clientv3.WithLease(grant.ID))
+		So(err, ShouldBeNil)
+		_, err = e.Put(ctx, "/a/2", "v", clientv3.WithLease(grant.ID))
+		So(err, ShouldBeNil)
+		// 修改时保留原来的租约
+		_, err = e.Put(ctx, "/a/2", "v2", clientv3.WithIgnoreLease())
+		So(err, ShouldBeNil)
+		get, err := e.Get(ctx, "/a/2")
+		So(err, ShouldBeNil)
+		So(get.Kvs[0].Lease, ShouldEqual, int64(grant.ID))
+		_, err = e.Put(ctx, "/a/4", "v", clientv3.WithIgnoreLease())
+		So(err, ShouldResemble, rpctypes.ErrKeyNotFound)
+		alive, err := e.KeepAlive(ctx, grant.ID)
+		So(err, ShouldBeNil)
+		rsp := <-alive
+		So(rsp.ID, ShouldEqual, grant.ID)
+
+		// 撤销租约时删除绑定的 key，自动续约的通道被关闭
+		rev := e.Revision()
+		_, err = e.Revoke(ctx, grant.ID)
+		So(err, ShouldBeNil)
+		So(e.Revision(), ShouldEqual, rev+1)
+		get, err = e.Get(ctx, "/a/", clientv3.WithPrefix())
+		So(err, ShouldBeNil)
+		So(len(get.Kvs), ShouldEqual, 0)
+		for range alive {
+		}
+		_, err = e.KeepAliveOnce(ctx, grant.ID)
+		So(err, ShouldResemble, rpctypes.ErrLeaseNotFound)
+		_, err = e.Revoke(ctx, grant.ID)
+		So(err, ShouldResemble, rpctypes.ErrLeaseNotFound)
+
+		// 没有续约的租约过期
+		grant, err = e.Grant(ctx, 1)
+		So(err, ShouldBeNil)
+		_, err = e.Put(ctx, "/a/3", "v", clientv3.WithLease(grant.ID))
+		So(err, ShouldBeNil)
+		time.Sleep(1500 * time.Millisecond)
+		get, err = e.Get(ctx, "/a/3")
+		So(err, ShouldBeNil)
+		So(len(get.Kvs), ShouldEqual, 0)
+	})
+}
+
+func TestEtcd_Watch(t *testing.T) {
+	Convey("测试 watch 当前和历史版本", t, func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		e := New()
+		defer e.Close()
+		ch := e.Watch(ctx, "/a/", clientv3.WithPrefix(), clientv3.WithPrevKV(), clientv3.WithCreatedNotify())
+		rsp, ok := nextResponse(ch)
+		So(ok, ShouldBeTrue)
+		So(rsp.Created, ShouldBeTrue)
+
+		_, err := e.Put(ctx, "/a/1", "v1")
+		So(err, ShouldBeNil)
+		_, err = e.Put(ctx, "/b", "v")
+		So(err, ShouldBeNil)
+		_, err = e.Put(ctx, "/a/1", "v2")
+		So(err, ShouldBeNil)
+		rsp, ok = nextResponse(ch)
+		So(ok, ShouldBeTrue)
+		So(rsp.Header.Revision, ShouldEqual, 2)
+		So(rsp.Events[0].IsCreate(), ShouldBeTrue)
+		rsp, ok = nextResponse(ch)
+		So(ok, ShouldBeTrue)
+		So(rsp.Header.Revision, ShouldEqual, 4)
+		So(string(rsp.Events[0].PrevKv.Value), ShouldEqual, "v1")
+
+		_, err = e.Put(ctx, "/a/2", "v")
+		So(err, ShouldBeNil)
+		_, err = e.Delete(ctx, "/a/", clientv3.WithPrefix())
+		So(err, ShouldBeNil)
+		_, ok = nextResponse(ch)
+		So(ok, ShouldBeTrue)
+		rsp, ok = nextResponse(ch)
+		So(ok, ShouldBeTrue)
+		So(len(rsp.Events), ShouldEqual, 2)
+		So(rsp.Events[0].Type, ShouldEqual, mvccpb.DELETE)
+
+		// 从历史版本开始 watch 时按版本重放变更
+		history := e.Watch(ctx, "/a/1", clientv3.WithRev(3), clientv3.WithFilterDelete())
+		rsp, ok = nextResponse(history)
+		So(ok, ShouldBeTrue)
+		So(rsp.Header.Revision, ShouldEqual, 4)
+		So(rsp.Events[0].PrevKv, ShouldBeNil)
+
+		// 连接断开时关闭通道
+		e.DropWatches()
+		_, ok = nextResponse(ch)
+		So(ok, ShouldBeFalse)
+
+		// 起始版本被压缩时返回压缩错误
+		_, err = e.Compact(ctx, 4)
+		So(err, ShouldBeNil)
+		compacted := e.Watch(ctx, "/a/", clientv3.WithPrefix(), clientv3.WithRev(2))
+		rsp, ok = nextResponse(compacted)
+		So(ok, ShouldBeTrue)
+		So(rsp.Err(), ShouldResemble, rpctypes.ErrCompacted)
+		So(rsp.CompactRevision, ShouldEqual, 4)
+		_, ok = nextResponse(compacted)
+		So(ok, ShouldBeFalse)
+
+		// ctx 取消时关闭通道
+		ch = e.Watch(ctx, "/a/", clientv3.WithPrefix())
+		cancel()
+		_, ok = nextResponse(ch)
+		So(ok, ShouldBeFalse)
+	})
+}
+
+func Test_opField(t *testing.T) {
+	Convey("读取不存在的选项字段时 panic", t, func() {
+		op := clientv3.OpPut("/a", "v", clientv3.WithIgnoreLease())
+		So(opField(op, "ignoreLease").Bool(), ShouldBeTrue)
+		So(func() { opField(op, "notExist") }, ShouldPanic)
+	})
+}
@@ -0,0 +1,131 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2025 Tencent.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package fake
+
+import (
+	"context"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// keepAliveChanSize 自动续约响应通道的缓冲大小
+const keepAliveChanSize = 16
+
+// Grant 分配租约，租约在 ttl 秒内没有续约时过期，绑定的 key 在同一个版本中被删除
+func (e *Etcd) Grant(ctx context.Context, ttl int64) (*clientv3.LeaseGrantResponse, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return nil, ErrClosed
+	}
+	if ttl <= 0 {
+		ttl = 1
+	}
+	e.lastID++
+	l := &lease{
+		id:   e.lastID,
+		ttl:  ttl,
+		keys: make(map[string]struct{}),
+		done: make(chan struct{}),
+	}
+	id := l.id
+	l.timer = time.AfterFunc(time.Duration(ttl)*time.Second, func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		e.removeLeaseLocked(id)
+	})
+	e.leases[id] = l
+	return &clientv3.LeaseGrantResponse{ResponseHeader: e.headerLocked(), ID: id, TTL: ttl}, nil
+}
+
+// Revoke 撤销租约并删除绑定的 key
+func (e *Etcd) Revoke(ctx context.Context, id clientv3.LeaseID) (*clientv3.LeaseRevokeResponse, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return nil, ErrClosed
+	}
+	if !e.removeLeaseLocked(id) {
+		return nil, rpctypes.ErrLeaseNotFound
+	}
+	return &clientv3.LeaseRevokeResponse{Header: e.headerLocked()}, nil
+}
+
+// KeepAliveOnce 续约一次
+func (e *Etcd) KeepAliveOnce(ctx context.Context, id clientv3.LeaseID) (*clientv3.LeaseKeepAliveResponse, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return nil, ErrClosed
+	}
+	l, ok := e.leases[id]
+	if !ok {
+		return nil, rpctypes.ErrLeaseNotFound
+	}
+	l.timer.Reset(time.Duration(l.ttl) * time.Second)
+	return &clientv3.LeaseKeepAliveResponse{ResponseHeader: e.headerLocked(), ID: id, TTL: l.ttl}, nil
+}
+
+// KeepAlive 每隔 ttl/3 自动续约，ctx 取消、租约撤销或过期时关闭返回的通道
+func (e *Etcd) KeepAlive(ctx context.Context, id clientv3.LeaseID) (<-chan *clientv3.LeaseKeepAliveResponse, error) {
+	e.mu.Lock()
+	l, ok := e.leases[id]
+	e.mu.Unlock()
+	if !ok {
+		return nil, rpctypes.ErrLeaseNotFound
+	}
+	ch := make(chan *clientv3.LeaseKeepAliveResponse, keepAliveChanSize)
+	go func() {
+		defer close(ch)
+		ticker := time.NewTicker(time.Duration(l.ttl) * time.Second / 3)
+		defer ticker.Stop()
+		for {
+			rsp, err := e.KeepAliveOnce(ctx, id)
+			if err != nil {
+				return
+			}
+			select {
+			case ch <- rsp:
+			default:
+			}
+			select {
+			case <-ticker.C:
+			case <-l.done:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// removeLeaseLocked 删除租约和绑定的 key，租约不存在时返回 false
+func (e *Etcd) removeLeaseLocked(id clientv3.LeaseID) bool {
+	l, ok := e.leases[id]
+	if !ok {
+		return false
+	}
+	delete(e.leases, id)
+	l.timer.Stop()
+	close(l.done)
+	keys := make([]string, 0, len(l.keys))
+	for key := range l.keys {
+		keys = append(keys, key)
+	}
+	e.deleteLocked(keys)
+	return true
+}
@@ -0,0 +1,170 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2025 Tencent.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package fake
+
+import (
+	"bytes"
+	"context"
+	"errors"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// txn 内存事务，比较只支持单个 key，操作支持 Get、Put、Delete。
+// 操作依次执行，每个写操作使用单独的版本，某个操作失败时之前的操作不会回滚
+type txn struct {
+	e       *Etcd
+	cmps    []clientv3.Cmp
+	thenOps []clientv3.Op
+	elseOps []clientv3.Op
+}
+
+// Txn 新建事务
+func (e *Etcd) Txn(ctx context.Context) clientv3.Txn {
+	return &txn{e: e}
+}
+
+// If 添加比较条件，所有条件都满足时执行 Then 的操作
+func (t *txn) If(cs ...clientv3.Cmp) clientv3.Txn {
+	t.cmps = append(t.cmps, cs...)
+	return t
+}
+
+// Then 添加条件满足时执行的操作
+func (t *txn) Then(ops ...clientv3.Op) clientv3.Txn {
+	t.thenOps = append(t.thenOps, ops...)
+	return t
+}
+
+// Else 添加条件不满足时执行的操作
+func (t *txn) Else(ops ...clientv3.Op) clientv3.Txn {
+	t.elseOps = append(t.elseOps, ops...)
+	return t
+}
+
+// Commit 提交事务
+func (t *txn) Commit() (*clientv3.TxnResponse, error) {
+	e := t.e
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return nil, ErrClosed
+	}
+	succeeded := true
+	for _, cmp := range t.cmps {
+		ok, err := e.compareLocked(cmp)
+		if err != nil {
+			return nil, err
+		}
+		succeeded = succeeded && ok
+	}
+	ops := t.thenOps
+	if !succeeded {
+		ops = t.elseOps
+	}
+	rsp := &clientv3.TxnResponse{Succeeded: succeeded}
+	for _, op := range ops {
+		r, err := e.opLocked(op)
+		if err != nil {
+			return nil, err
+		}
+		rsp.Responses = append(rsp.Responses, r)
+	}
+	rsp.Header = e.headerLocked()
+	return rsp, nil
+}
+
+// opLocked 执行事务中的一个操作
+func (e *Etcd) opLocked(op clientv3.Op) (*etcdserverpb.ResponseOp, error) {
+	switch {
+	case op.IsGet():
+		rsp, err := e.getLocked(op)
+		if err != nil {
+			return nil, err
+		}
+		return &etcdserverpb.ResponseOp{Response: &etcdserverpb.ResponseOp_ResponseRange{
+			ResponseRange: (*etcdserverpb.RangeResponse)(rsp)}}, nil
+	case op.IsPut():
+		rsp, err := e.putLocked(op)
+		if err != nil {
+			return nil, err
+		}
+		return &etcdserverpb.ResponseOp{Response: &etcdserverpb.ResponseOp_ResponsePut{
+			ResponsePut: (*etcdserverpb.PutResponse)(rsp)}}, nil
+	case op.IsDelete():
+		rsp := e.deleteRangeLocked(op)
+		return &etcdserverpb.ResponseOp{Response: &etcdserverpb.ResponseOp_ResponseDeleteRange{
+			ResponseDeleteRange: (*etcdserverpb.DeleteRangeResponse)(rsp)}}, nil
+	default:
+		return nil, errors.New("fake etcd does not support nested txn")
+	}
+}
+
+// compareLocked 判断比较条件是否满足，与 etcd 一致，key 不存在时比较值不满足，其他字段按 0 比较
+func (e *Etcd) compareLocked(cmp clientv3.Cmp) (bool, error) {
+	c := etcdserverpb.Compare(cmp)
+	if len(c.RangeEnd) > 0 {
+		return false, errors.New("fake etcd does not support comparing a range of keys")
+	}
+	kv, ok := e.kvs[string(c.Key)]
+	if !ok && c.Target == etcdserverpb.Compare_VALUE {
+		return false, nil
+	}
+	var version, createRevision, modRevision, lease int64
+	var value []byte
+	if ok {
+		version, createRevision, modRevision = kv.Version, kv.CreateRevision, kv.ModRevision
+		lease, value = kv.Lease, kv.Value
+	}
+	var result int
+	switch c.Target {
+	case etcdserverpb.Compare_VERSION:
+		result = compareInt64(version, c.GetVersion())
+	case etcdserverpb.Compare_CREATE:
+		result = compareInt64(createRevision, c.GetCreateRevision())
+	case etcdserverpb.Compare_MOD:
+		result = compareInt64(modRevision, c.GetModRevision())
+	case etcdserverpb.Compare_VALUE:
+		result = bytes.Compare(value, c.GetValue())
+	case etcdserverpb.Compare_LEASE:
+		result = compareInt64(lease, c.GetLease())
+	default:
+		return false, errors.New("fake etcd does not support compare target " + c.Target.String())
+	}
+	switch c.Result {
+	case etcdserverpb.Compare_EQUAL:
+		return result == 0, nil
+	case etcdserverpb.Compare_GREATER:
+		return result > 0, nil
+	case etcdserverpb.Compare_LESS:
+		return result < 0, nil
+	case etcdserverpb.Compare_NOT_EQUAL:
+		return result != 0, nil
+	default:
+		return false, errors.New("fake etcd does not support compare result " + c.Result.String())
+	}
+}
+
+// compareInt64 比较 a 和 b，返回 -1、0、1
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
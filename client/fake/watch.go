@@ -0,0 +1,193 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2025 Tencent.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package fake
+
+import (
+	"context"
+	"sync"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// watcher 一个 watch 请求，变更先放入无界队列，由独立协程发送，避免消费慢时阻塞写入
+type watcher struct {
+	key          string
+	end          string
+	prevKV       bool
+	filterPut    bool
+	filterDelete bool
+	out          chan clientv3.WatchResponse
+
+	mu     sync.Mutex
+	queue  []clientv3.WatchResponse
+	signal chan struct{}
+	// final 队列发送完后关闭 watch
+	final bool
+	// stop 立即关闭 watch，未发送的变更被丢弃
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// Watch 监听 key 的变更，支持 WithPrefix、WithRange、WithFromKey、WithRev、WithPrevKV、WithCreatedNotify、
+// WithFilterPut、WithFilterDelete。起始版本已被压缩时返回带 CompactRevision 的响应后关闭通道
+func (e *Etcd) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
+	op := clientv3.OpGet(key, opts...)
+	w := &watcher{
+		key:          string(op.KeyBytes()),
+		end:          string(op.RangeBytes()),
+		prevKV:       opField(op, "prevKV").Bool(),
+		filterPut:    opField(op, "filterPut").Bool(),
+		filterDelete: opField(op, "filterDelete").Bool(),
+		out:          make(chan clientv3.WatchResponse),
+		signal:       make(chan struct{}, 1),
+		stop:         make(chan struct{}),
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		close(w.out)
+		return w.out
+	}
+	header := e.headerLocked()
+	if rev := op.Rev(); rev > 0 && rev <= e.compacted {
+		w.push(clientv3.WatchResponse{Header: *header, CompactRevision: e.compacted, Canceled: true}, true)
+		go w.run(ctx, nil)
+		return w.out
+	}
+	if opField(op, "createdNotify").Bool() {
+		w.push(clientv3.WatchResponse{Header: *header, Created: true}, false)
+	}
+	if rev := op.Rev(); rev > 0 {
+		e.replayLocked(w, rev)
+	}
+	e.watchers[w] = struct{}{}
+	go w.run(ctx, e)
+	return w.out
+}
+
+// DropWatches 关闭当前所有 watch 的通道，模拟 watch 连接断开
+func (e *Etcd) DropWatches() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for w := range e.watchers {
+		w.close()
+		delete(e.watchers, w)
+	}
+}
+
+// replayLocked 将 rev 之后的历史变更按版本发送给 watcher
+func (e *Etcd) replayLocked(w *watcher, rev int64) {
+	var events []*clientv3.Event
+	for i, event := range e.history {
+		if event.Kv.ModRevision < rev {
+			continue
+		}
+		events = append(events, event)
+		if i+1 == len(e.history) || e.history[i+1].Kv.ModRevision != event.Kv.ModRevision {
+			w.send(&etcdserverpb.ResponseHeader{Revision: event.Kv.ModRevision}, events)
+			events = nil
+		}
+	}
+}
+
+// send 过滤出 watcher 关注的变更放入队列
+func (w *watcher) send(header *etcdserverpb.ResponseHeader, events []*clientv3.Event) {
+	var matched []*clientv3.Event
+	for _, event := range events {
+		if !inRange(string(event.Kv.Key), w.key, w.end) {
+			continue
+		}
+		if (event.Type == mvccpb.PUT && w.filterPut) || (event.Type == mvccpb.DELETE && w.filterDelete) {
+			continue
+		}
+		event := &clientv3.Event{Type: event.Type, Kv: copyKV(event.Kv), PrevKv: event.PrevKv}
+		if w.prevKV && event.PrevKv != nil {
+			event.PrevKv = copyKV(event.PrevKv)
+		} else {
+			event.PrevKv = nil
+		}
+		matched = append(matched, event)
+	}
+	if len(matched) > 0 {
+		w.push(clientv3.WatchResponse{Header: *header, Events: matched}, false)
+	}
+}
+
+// push 放入队列并唤醒发送协程
+func (w *watcher) push(rsp clientv3.WatchResponse, final bool) {
+	w.mu.Lock()
+	w.queue = append(w.queue, rsp)
+	w.final = w.final || final
+	w.mu.Unlock()
+	select {
+	case w.signal <- struct{}{}:
+	default:
+	}
+}
+
+// next 取出队列中的下一个响应，done 为 true 时队列已发送完且需要关闭 watch
+func (w *watcher) next() (rsp clientv3.WatchResponse, ok bool, done bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.queue) == 0 {
+		return rsp, false, w.final
+	}
+	rsp = w.queue[0]
+	w.queue = w.queue[1:]
+	return rsp, true, false
+}
+
+// close 立即关闭 watch
+func (w *watcher) close() {
+	w.stopOnce.Do(func() {
+		close(w.stop)
+	})
+}
+
+// run 依次发送队列中的响应，退出时关闭通道并从 e 中移除
+func (w *watcher) run(ctx context.Context, e *Etcd) {
+	defer func() {
+		if e != nil {
+			e.mu.Lock()
+			delete(e.watchers, w)
+			e.mu.Unlock()
+		}
+		close(w.out)
+	}()
+	for {
+		rsp, ok, done := w.next()
+		if done {
+			return
+		}
+		if !ok {
+			select {
+			case <-w.signal:
+				continue
+			case <-w.stop:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+		select {
+		case w.out <- rsp:
+		case <-w.stop:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
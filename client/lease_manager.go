@@ -15,14 +15,19 @@ package client
 
 import (
 	"context"
+	"errors"
 	"sync"
 	"time"
 
+	"trpc.group/trpc-go/trpc-naming-etcd/internal/metrics"
+
 	clientv3 "go.etcd.io/etcd/client/v3"
 )
 
 var (
 	defaultForceKeepAliveTime = time.Second
+	// ErrLeaseManagerClosed 租约管理已关闭
+	ErrLeaseManagerClosed = errors.New("lease manager is closed")
 )
 
 // LeaseManager 租约管理
@@ -30,23 +35,34 @@ type LeaseManager interface {
 	GetLease(ctx context.Context, ttl time.Duration) (clientv3.LeaseID, chan bool, error)
 }
 
+// LeaseRevoker 支持撤销租约的租约管理，LeaseManager 可选实现，NewLeaseManager 返回的租约管理已实现
+type LeaseRevoker interface {
+	// Revoke 停止所有租约的续约并撤销租约，绑定在租约上的 key 会被 etcd 立即删除，之后仍然可以重新获取租约
+	Revoke(ctx context.Context) error
+	// Close 撤销所有租约并关闭租约管理，之后获取租约会返回 ErrLeaseManagerClosed
+	Close(ctx context.Context) error
+}
+
 // leaseHolder 租约包装
 type leaseHolder struct {
 	leaseID            clientv3.LeaseID
 	forceKeepAliveTime time.Time
 	exit               chan bool
 	ttl                time.Duration
+	// cancel 停止自动续约
+	cancel context.CancelFunc
 }
 
 // leaseManagerImpl 实现租约管理接口，由于租约是个代价较大的行为，因此同一个 ttl 只保留一个租约
 type leaseManagerImpl struct {
-	client   *clientv3.Client
+	client   Lease
 	leaseMu  sync.Mutex
 	leaseMap map[time.Duration]*leaseHolder
+	closed   bool
 }
 
 // NewLeaseManager 新建租约管理
-func NewLeaseManager(client *clientv3.Client) LeaseManager {
+func NewLeaseManager(client Lease) LeaseManager {
 	return &leaseManagerImpl{
 		client:   client,
 		leaseMap: make(map[time.Duration]*leaseHolder),
@@ -58,48 +74,102 @@ func (l *leaseManagerImpl) GetLease(ctx context.Context, ttl time.Duration) (cli
 	now := time.Now()
 	l.leaseMu.Lock()
 	defer l.leaseMu.Unlock()
+	if l.closed {
+		return clientv3.LeaseID(0), nil, ErrLeaseManagerClosed
+	}
 	if lease, ok := l.leaseMap[ttl]; ok {
 		if now.Before(lease.forceKeepAliveTime) {
 			return lease.leaseID, lease.exit, nil
 		}
+		start := time.Now()
 		_, err := l.client.KeepAliveOnce(ctx, lease.leaseID)
+		metrics.ObserveEtcd(metrics.EtcdKeepAliveOnce, start, err)
 		if err == nil {
 			lease.forceKeepAliveTime = now.Add(defaultForceKeepAliveTime)
 			return lease.leaseID, lease.exit, nil
 		}
+		metrics.Incr(metrics.LeaseReuseFail)
 		l.removeLeaseLocked(lease)
 	}
+	start := time.Now()
 	leaseRsp, err := l.client.Grant(ctx, int64(ttl.Seconds()))
+	metrics.ObserveEtcd(metrics.EtcdGrant, start, err)
 	if err != nil {
 		return clientv3.LeaseID(0), nil, err
 	}
+	metrics.Incr(metrics.LeaseGrant)
+	keepAliveCtx, cancel := context.WithCancel(context.Background())
 	lease := &leaseHolder{
 		leaseID:            leaseRsp.ID,
 		forceKeepAliveTime: now.Add(defaultForceKeepAliveTime),
 		exit:               make(chan bool),
 		ttl:                ttl,
+		cancel:             cancel,
 	}
 	l.leaseMap[ttl] = lease
-	go l.leaseKeepAlive(lease)
+	metrics.AddLeases(1)
+	go l.leaseKeepAlive(keepAliveCtx, lease)
 	return lease.leaseID, lease.exit, nil
 }
 
-// leaseKeepAlive 自动续约
-func (l *leaseManagerImpl) leaseKeepAlive(lease *leaseHolder) {
-	// 自动续租
-	alive, err := l.client.KeepAlive(context.Background(), lease.leaseID)
-	if err != nil {
+// Revoke 停止所有租约的续约并撤销租约
+func (l *leaseManagerImpl) Revoke(ctx context.Context) error {
+	l.leaseMu.Lock()
+	leases := make([]*leaseHolder, 0, len(l.leaseMap))
+	for _, lease := range l.leaseMap {
+		leases = append(leases, lease)
+		l.removeLeaseLocked(lease)
+	}
+	l.leaseMu.Unlock()
+
+	var firstErr error
+	for _, lease := range leases {
+		start := time.Now()
+		_, err := l.client.Revoke(ctx, lease.leaseID)
+		metrics.ObserveEtcd(metrics.EtcdRevoke, start, err)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Close 撤销所有租约并关闭租约管理
+func (l *leaseManagerImpl) Close(ctx context.Context) error {
+	l.leaseMu.Lock()
+	l.closed = true
+	l.leaseMu.Unlock()
+	return l.Revoke(ctx)
+}
+
+// leaseKeepAlive 自动续约，ctx 取消时停止
+func (l *leaseManagerImpl) leaseKeepAlive(ctx context.Context, lease *leaseHolder) {
+	defer func() {
 		l.leaseMu.Lock()
 		defer l.leaseMu.Unlock()
 		l.removeLeaseLocked(lease)
+	}()
+	// 自动续租
+	alive, err := l.client.KeepAlive(ctx, lease.leaseID)
+	if err != nil {
+		metrics.Incr(metrics.LeaseLost)
 		return
 	}
 
-	for range alive {
+	for {
+		select {
+		case _, ok := <-alive:
+			if !ok {
+				// 主动停止续约时 ctx 已取消，不是租约失效
+				if ctx.Err() == nil {
+					metrics.Incr(metrics.LeaseLost)
+				}
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
 	}
-	l.leaseMu.Lock()
-	defer l.leaseMu.Unlock()
-	l.removeLeaseLocked(lease)
 }
 
 // removeLeaseLocked 移除租约
@@ -107,7 +177,11 @@ func (l *leaseManagerImpl) removeLeaseLocked(lease *leaseHolder) {
 	if existLease, ok := l.leaseMap[lease.ttl]; ok {
 		if existLease.leaseID == lease.leaseID {
 			delete(l.leaseMap, lease.ttl)
+			metrics.AddLeases(-1)
 			close(existLease.exit)
+			if existLease.cancel != nil {
+				existLease.cancel()
+			}
 		}
 	}
 }
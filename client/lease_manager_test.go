@@ -16,85 +16,93 @@ package client
 import (
 	"context"
 	"errors"
-	"math/rand"
-	"reflect"
+	"sync"
 	"testing"
 	"time"
 
+	"trpc.group/trpc-go/trpc-naming-etcd/client/fake"
+
 	clientv3 "go.etcd.io/etcd/client/v3"
 
-	. "github.com/agiledragon/gomonkey"
 	. "github.com/glycerine/goconvey/convey"
 )
 
-// etcdLease 实现etcd Lease接口
-type etcdLease struct {
-}
-
-// Grant 分配租约
-func (e *etcdLease) Grant(ctx context.Context, ttl int64) (*clientv3.LeaseGrantResponse, error) {
-	return &clientv3.LeaseGrantResponse{
-		ID:  clientv3.LeaseID(rand.Int()),
-		TTL: ttl,
-	}, nil
+// leaseEtcd 在内存 etcd 上模拟租约接口失败，记录撤销的租约
+type leaseEtcd struct {
+	*fake.Etcd
+	mu               sync.Mutex
+	grantErr         error
+	keepAliveErr     error
+	keepAliveOnceErr error
+	revokeErr        error
+	revoked          []clientv3.LeaseID
 }
 
-// Revoke 移除租约
-func (e *etcdLease) Revoke(ctx context.Context, id clientv3.LeaseID) (*clientv3.LeaseRevokeResponse, error) {
-	return &clientv3.LeaseRevokeResponse{}, nil
+// newLeaseEtcd 新建租约接口可以失败的内存 etcd
+func newLeaseEtcd() *leaseEtcd {
+	return &leaseEtcd{Etcd: fake.New()}
 }
 
-// TimeToLive 获取租约
-func (e *etcdLease) TimeToLive(ctx context.Context, id clientv3.LeaseID,
-	opts ...clientv3.LeaseOption) (*clientv3.LeaseTimeToLiveResponse, error) {
-	return &clientv3.LeaseTimeToLiveResponse{}, nil
+// setErr 设置接口返回的错误
+func (e *leaseEtcd) setErr(set func(e *leaseEtcd)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	set(e)
 }
 
-// Leases 获取所有租约
-func (e *etcdLease) Leases(ctx context.Context) (*clientv3.LeaseLeasesResponse, error) {
-	return &clientv3.LeaseLeasesResponse{}, nil
+// Grant 分配租约
+func (e *leaseEtcd) Grant(ctx context.Context, ttl int64) (*clientv3.LeaseGrantResponse, error) {
+	e.mu.Lock()
+	err := e.grantErr
+	e.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return e.Etcd.Grant(ctx, ttl)
 }
 
-// KeepAlive 监听keepAlive
-func (e *etcdLease) KeepAlive(ctx context.Context, id clientv3.LeaseID) (<-chan *clientv3.LeaseKeepAliveResponse,
+// KeepAlive 自动续约
+func (e *leaseEtcd) KeepAlive(ctx context.Context, id clientv3.LeaseID) (<-chan *clientv3.LeaseKeepAliveResponse,
 	error) {
-	ch := make(chan *clientv3.LeaseKeepAliveResponse, 10)
-	ch <- &clientv3.LeaseKeepAliveResponse{
-		ID: id,
+	e.mu.Lock()
+	err := e.keepAliveErr
+	e.mu.Unlock()
+	if err != nil {
+		return nil, err
 	}
-	return ch, nil
+	return e.Etcd.KeepAlive(ctx, id)
 }
 
-// KeepAliveOnce keepAlive一次
-func (e *etcdLease) KeepAliveOnce(ctx context.Context, id clientv3.LeaseID) (*clientv3.LeaseKeepAliveResponse, error) {
-	return &clientv3.LeaseKeepAliveResponse{
-		ID: id,
-	}, nil
-}
-
-// Close 关闭
-func (e *etcdLease) Close() error {
-	return nil
-}
-
-// newLeaseClient 获取etcd客户端
-func newLeaseClient() *clientv3.Client {
-	client, _ := clientv3.New(clientv3.Config{
-		Endpoints: []string{"127.0.0.1:2379"},
-	})
-	client.Lease = newLease()
-	return client
+// KeepAliveOnce 续约一次
+func (e *leaseEtcd) KeepAliveOnce(ctx context.Context, id clientv3.LeaseID) (*clientv3.LeaseKeepAliveResponse, error) {
+	e.mu.Lock()
+	err := e.keepAliveOnceErr
+	e.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return e.Etcd.KeepAliveOnce(ctx, id)
 }
 
-// newLease 新建一个Lease，实现etcd的Lease接口
-func newLease() clientv3.Lease {
-	return &etcdLease{}
+// Revoke 撤销租约
+func (e *leaseEtcd) Revoke(ctx context.Context, id clientv3.LeaseID) (*clientv3.LeaseRevokeResponse, error) {
+	e.mu.Lock()
+	err := e.revokeErr
+	if err == nil {
+		e.revoked = append(e.revoked, id)
+	}
+	e.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return e.Etcd.Revoke(ctx, id)
 }
 
 func Test_newLeaseManager(t *testing.T) {
 	Convey("新建租约管理", t, func() {
-		c := newLeaseClient()
-		m := NewLeaseManager(c)
+		e := fake.New()
+		defer e.Close()
+		m := NewLeaseManager(e)
 		So(m, ShouldNotBeNil)
 	})
 }
@@ -103,8 +111,9 @@ func Test_leaseManager_GetLease(t *testing.T) {
 	Convey("获取租约", t, func() {
 		defaultForceKeepAliveTime = time.Millisecond * 100
 		ttl := time.Second * 10
-		c := newLeaseClient()
-		lm := NewLeaseManager(c)
+		e := newLeaseEtcd()
+		defer e.Close()
+		lm := NewLeaseManager(e)
 		firstLeaseId, _, err := lm.GetLease(context.Background(), ttl)
 		So(err, ShouldBeNil)
 		secondLeaseId, _, err := lm.GetLease(context.Background(), ttl)
@@ -119,24 +128,16 @@ func Test_leaseManager_GetLease(t *testing.T) {
 		// 同一个ttl获取到的租约一致
 		So(firstLeaseId, ShouldEqual, secondLeaseId)
 
-		// mock KeepAliveOnce返回错误使得管理器删除
-		keepAliveOncePatch := ApplyMethod(reflect.TypeOf(c.Lease), "KeepAliveOnce", func(lease *etcdLease,
-			ctx context.Context, id clientv3.LeaseID) (*clientv3.LeaseKeepAliveResponse, error) {
-			return nil, errors.New("keepAliveOnce fail")
-		})
-		defer keepAliveOncePatch.Reset()
+		// KeepAliveOnce返回错误使得管理器删除
+		e.setErr(func(e *leaseEtcd) { e.keepAliveOnceErr = errors.New("keepAliveOnce fail") })
 		// 睡眠使得下次获取租约需要强制keepALive
 		time.Sleep(defaultForceKeepAliveTime)
 		newLeaseId, _, err := lm.GetLease(context.Background(), ttl)
 		So(err, ShouldBeNil)
 		// 此时就变成了不同租约
 		So(firstLeaseId, ShouldNotEqual, newLeaseId)
-		// mock Grant返回错误
-		grantPatch := ApplyMethod(reflect.TypeOf(c.Lease), "Grant", func(lease *etcdLease,
-			ctx context.Context, ttl int64) (*clientv3.LeaseGrantResponse, error) {
-			return nil, errors.New("grant fail")
-		})
-		defer grantPatch.Reset()
+		// Grant返回错误
+		e.setErr(func(e *leaseEtcd) { e.grantErr = errors.New("grant fail") })
 		// 睡眠使得下次获取租约需要强制keepALive
 		time.Sleep(defaultForceKeepAliveTime)
 		// 由于grant失败因此返回失败
@@ -148,45 +149,70 @@ func Test_leaseManager_GetLease(t *testing.T) {
 
 func Test_leaseManager_leaseKeepAlive(t *testing.T) {
 	Convey("续期租约", t, func() {
-		c := newLeaseClient()
-		lm := NewLeaseManager(c)
+		e := newLeaseEtcd()
+		defer e.Close()
+		lm := NewLeaseManager(e).(*leaseManagerImpl)
+
+		// 租约被撤销后续约结束，管理器删除租约并通知失效
+		leaseID, exit, err := lm.GetLease(context.Background(), time.Second*10)
+		So(err, ShouldBeNil)
+		_, err = e.Etcd.Revoke(context.Background(), leaseID)
+		So(err, ShouldBeNil)
+		select {
+		case _, ok := <-exit:
+			So(ok, ShouldBeFalse)
+		case <-time.After(time.Second):
+			So("lease exit is not notified", ShouldBeEmpty)
+		}
+		lm.leaseMu.Lock()
+		So(len(lm.leaseMap), ShouldEqual, 0)
+		lm.leaseMu.Unlock()
 
+		// KeepAlive 返回错误时直接结束
+		e.setErr(func(e *leaseEtcd) { e.keepAliveErr = errors.New("keepAlive fail") })
 		lease := &leaseHolder{
-			leaseID:            clientv3.LeaseID(rand.Int()),
+			leaseID:            clientv3.LeaseID(1),
 			forceKeepAliveTime: time.Now().Add(defaultForceKeepAliveTime),
-			exit:               make(chan bool),
+			exit:               make(chan bool, 1),
 			ttl:                time.Second * 10,
 		}
-		// mock KeepAlive 正常返回
-		keepAlivePatch := ApplyMethod(reflect.TypeOf(c.Lease), "KeepAlive", func(lease *etcdLease,
-			ctx context.Context, id clientv3.LeaseID) (<-chan *clientv3.LeaseKeepAliveResponse, error) {
-			ch := make(chan *clientv3.LeaseKeepAliveResponse, 10)
-			ch <- &clientv3.LeaseKeepAliveResponse{
-				ID: id,
-			}
-			go func() {
-				time.Sleep(time.Millisecond * 100)
-				close(ch)
-			}()
-			return ch, nil
-		})
-
-		lmImpl, ok := lm.(*leaseManagerImpl)
-		if !ok {
-			return
-		}
+		lm.leaseKeepAlive(context.Background(), lease)
+	})
+}
+
+func Test_leaseManager_Revoke(t *testing.T) {
+	Convey("撤销租约", t, func() {
+		e := newLeaseEtcd()
+		defer e.Close()
+		lm := NewLeaseManager(e)
 
-		lmImpl.leaseKeepAlive(lease)
+		firstLeaseID, firstExit, err := lm.GetLease(context.Background(), time.Second*10)
+		So(err, ShouldBeNil)
+		secondLeaseID, _, err := lm.GetLease(context.Background(), time.Second*20)
+		So(err, ShouldBeNil)
 
-		keepAlivePatch.Reset()
+		revoker, ok := lm.(LeaseRevoker)
+		So(ok, ShouldBeTrue)
+		So(revoker.Revoke(context.Background()), ShouldBeNil)
+		So(e.revoked, ShouldContain, firstLeaseID)
+		So(e.revoked, ShouldContain, secondLeaseID)
+		// 撤销后通知租约失效
+		_, ok = <-firstExit
+		So(ok, ShouldBeFalse)
+		So(len(lm.(*leaseManagerImpl).leaseMap), ShouldEqual, 0)
+
+		// 撤销后可以重新获取租约
+		newLeaseID, _, err := lm.GetLease(context.Background(), time.Second*10)
+		So(err, ShouldBeNil)
+		So(newLeaseID, ShouldNotEqual, firstLeaseID)
 
-		// mock KeepAlive 返回错误
-		keepAlivePatch = ApplyMethod(reflect.TypeOf(c.Lease), "KeepAlive", func(lease *etcdLease,
-			ctx context.Context, id clientv3.LeaseID) (<-chan *clientv3.LeaseKeepAliveResponse, error) {
-			return nil, errors.New("keepAlive fail")
-		})
-		lease.exit = make(chan bool, 1)
-		lmImpl.leaseKeepAlive(lease)
+		// 撤销失败返回错误
+		e.setErr(func(e *leaseEtcd) { e.revokeErr = errors.New("revoke fail") })
+		So(revoker.Revoke(context.Background()), ShouldNotBeNil)
 
+		// 关闭后无法获取租约
+		So(revoker.Close(context.Background()), ShouldBeNil)
+		_, _, err = lm.GetLease(context.Background(), time.Second*10)
+		So(err, ShouldEqual, ErrLeaseManagerClosed)
 	})
 }
@@ -0,0 +1,54 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2025 Tencent.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package client
+
+import (
+	"trpc.group/trpc-go/trpc-go/plugin"
+)
+
+func init() {
+	plugin.Register(PluginName, &Plugin{})
+}
+
+const (
+	// PluginType 共享 etcd 客户端插件类型
+	PluginType = "etcd"
+	// PluginName 共享 etcd 客户端插件名
+	PluginName = "client"
+)
+
+// Plugin 共享 etcd 客户端插件，配置的每个客户端以名字注册，selector 和 registry 插件通过名字引用
+type Plugin struct{}
+
+// Type 插件类型
+func (p *Plugin) Type() string {
+	return PluginType
+}
+
+// Setup 注册配置的所有 etcd 客户端
+func (p *Plugin) Setup(name string, decoder plugin.Decoder) error {
+	cfgs := make(map[string]*Config)
+	if err := decoder.Decode(&cfgs); err != nil {
+		return err
+	}
+	for clientName, cfg := range cfgs {
+		if cfg == nil {
+			cfg = &Config{}
+		}
+		if err := Register(clientName, cfg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
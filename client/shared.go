@@ -0,0 +1,108 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2025 Tencent.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package client
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+var (
+	// ErrClientNotFound 没有注册该名字的 etcd 客户端
+	ErrClientNotFound = errors.New("etcd client not found")
+	// ErrClientInUse etcd 客户端正在使用中，不能修改配置
+	ErrClientInUse = errors.New("etcd client is in use")
+
+	sharedMu      sync.Mutex
+	sharedClients = make(map[string]*sharedClient)
+)
+
+// sharedClient 命名的共享 etcd 客户端
+type sharedClient struct {
+	cfg    *Config
+	client *clientv3.Client
+	// refs 引用计数，为 0 时关闭客户端
+	refs int
+}
+
+// Register 注册命名的 etcd 客户端配置，客户端在第一次 Get 时创建。
+// 已经注册的名字在客户端使用中时只允许使用相同的配置重复注册
+func Register(name string, cfg *Config) error {
+	sharedMu.Lock()
+	defer sharedMu.Unlock()
+	if shared, ok := sharedClients[name]; ok && shared.refs > 0 {
+		if reflect.DeepEqual(shared.cfg, cfg) {
+			return nil
+		}
+		return ErrClientInUse
+	}
+	sharedClients[name] = &sharedClient{cfg: cfg}
+	return nil
+}
+
+// Get 获取命名的 etcd 客户端并增加引用计数，不再使用时需要调用 Release
+func Get(name string) (*clientv3.Client, error) {
+	sharedMu.Lock()
+	defer sharedMu.Unlock()
+	shared, ok := sharedClients[name]
+	if !ok {
+		return nil, ErrClientNotFound
+	}
+	if shared.client == nil {
+		c, err := GenerateEtcdClient(shared.cfg)
+		if err != nil {
+			return nil, err
+		}
+		shared.client = c
+	}
+	shared.refs++
+	return shared.client, nil
+}
+
+// Release 减少命名的 etcd 客户端的引用计数，没有引用时关闭客户端，下次 Get 时重新创建
+func Release(name string) error {
+	sharedMu.Lock()
+	defer sharedMu.Unlock()
+	shared, ok := sharedClients[name]
+	if !ok || shared.refs == 0 {
+		return ErrClientNotFound
+	}
+	shared.refs--
+	if shared.refs > 0 {
+		return nil
+	}
+	c := shared.client
+	shared.client = nil
+	return c.Close()
+}
+
+// Resolve name 不为空时获取命名的共享 etcd 客户端，否则使用 cfg 新建客户端。
+// 不再使用时调用返回的 release 释放客户端，共享客户端减少引用计数，新建的客户端直接关闭
+func Resolve(name string, cfg *Config) (c *clientv3.Client, release func() error, err error) {
+	if name != "" {
+		if c, err = Get(name); err != nil {
+			return nil, nil, err
+		}
+		return c, func() error {
+			return Release(name)
+		}, nil
+	}
+	if c, err = GenerateEtcdClient(cfg); err != nil {
+		return nil, nil, err
+	}
+	return c, c.Close, nil
+}
@@ -0,0 +1,103 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2023 Tencent.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package client
+
+import (
+	"testing"
+
+	. "github.com/glycerine/goconvey/convey"
+)
+
+// mapDecoder 将配置直接写入插件配置
+type mapDecoder struct {
+	cfgs map[string]*Config
+}
+
+// Decode 解析配置
+func (d *mapDecoder) Decode(cfg interface{}) error {
+	cfgs := cfg.(*map[string]*Config)
+	for name, c := range d.cfgs {
+		(*cfgs)[name] = c
+	}
+	return nil
+}
+
+func TestSharedClient(t *testing.T) {
+	Convey("测试共享 etcd 客户端", t, func() {
+		p := &Plugin{}
+		So(p.Type(), ShouldEqual, PluginType)
+		So(p.Setup(PluginName, &mapDecoder{cfgs: map[string]*Config{
+			"shared": {Address: "127.0.0.1:2379"},
+			"empty":  nil,
+		}}), ShouldBeNil)
+
+		_, err := Get("notexist")
+		So(err, ShouldEqual, ErrClientNotFound)
+		So(Release("notexist"), ShouldEqual, ErrClientNotFound)
+
+		// 同一个名字获取到同一个客户端
+		c1, err := Get("shared")
+		So(err, ShouldBeNil)
+		c2, err := Get("shared")
+		So(err, ShouldBeNil)
+		So(c1, ShouldEqual, c2)
+
+		// 使用中只允许相同配置重复注册
+		So(Register("shared", &Config{Address: "127.0.0.1:2379"}), ShouldBeNil)
+		So(Register("shared", &Config{Address: "127.0.0.2:2379"}), ShouldEqual, ErrClientInUse)
+
+		// 引用计数为 0 时关闭客户端，之后重新创建
+		So(Release("shared"), ShouldBeNil)
+		So(c1.Ctx().Err(), ShouldBeNil)
+		So(Release("shared"), ShouldBeNil)
+		So(c1.Ctx().Err(), ShouldNotBeNil)
+		So(Release("shared"), ShouldEqual, ErrClientNotFound)
+		c3, err := Get("shared")
+		So(err, ShouldBeNil)
+		So(c3, ShouldNotEqual, c1)
+		So(Release("shared"), ShouldBeNil)
+
+		// 没有使用时可以修改配置
+		So(Register("shared", &Config{CertFile: "/noexisted.crt", KeyFile: "/noexisted.key",
+			CaFile: "/noexisted.ca"}), ShouldBeNil)
+		_, err = Get("shared")
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestResolve(t *testing.T) {
+	Convey("测试按配置获取 etcd 客户端", t, func() {
+		So(Register("resolve", &Config{Address: "127.0.0.1:2379"}), ShouldBeNil)
+
+		// 指定名字时使用共享客户端，释放时减少引用计数
+		c, release, err := Resolve("resolve", nil)
+		So(err, ShouldBeNil)
+		shared, err := Get("resolve")
+		So(err, ShouldBeNil)
+		So(c, ShouldEqual, shared)
+		So(release(), ShouldBeNil)
+		So(c.Ctx().Err(), ShouldBeNil)
+		So(Release("resolve"), ShouldBeNil)
+		So(c.Ctx().Err(), ShouldNotBeNil)
+
+		_, _, err = Resolve("notexist", nil)
+		So(err, ShouldEqual, ErrClientNotFound)
+
+		// 未指定名字时创建独立客户端，释放时直接关闭
+		c, release, err = Resolve("", &Config{Address: "127.0.0.1:2379"})
+		So(err, ShouldBeNil)
+		So(release(), ShouldBeNil)
+		So(c.Ctx().Err(), ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,486 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2025 Tencent.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	tdiscovery "trpc.group/trpc-go/trpc-go/naming/discovery"
+	tregistry "trpc.group/trpc-go/trpc-go/naming/registry"
+	"trpc.group/trpc-go/trpc-naming-etcd/client"
+	"trpc.group/trpc-go/trpc-naming-etcd/discovery"
+	"trpc.group/trpc-go/trpc-naming-etcd/model"
+	"trpc.group/trpc-go/trpc-naming-etcd/registry"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+var (
+	// errUsage 命令参数错误
+	errUsage = errors.New("invalid arguments")
+	// errNodeNotFound 没有匹配的节点
+	errNodeNotFound = errors.New("no matched node")
+	// errConflict 读取节点后节点被其他进程修改或删除
+	errConflict = errors.New("node was modified concurrently, please retry")
+)
+
+// command 子命令
+type command struct {
+	name  string
+	usage string
+	desc  string
+	run   func(c *cli, fs *flag.FlagSet, args []string) error
+}
+
+// commands 所有子命令，按帮助信息中的顺序排列
+var commands = []*command{
+	{name: "services", usage: "services", desc: "列出所有服务和节点数", run: listServices},
+	{name: "nodes", usage: "nodes [-json] <service>", desc: "列出服务的节点和元数据", run: listNodes},
+	{name: "watch", usage: "watch <service>", desc: "实时输出服务的节点变更", run: watchNodes},
+	{name: "register", usage: "register -address <addr> [flags] <service>",
+		desc: "注册节点并保持续约，退出时取消注册", run: registerNode},
+	{name: "deregister", usage: "deregister (-address <addr> | -id <id>) <service>", desc: "删除节点",
+		run: deregisterNode},
+	{name: "drain", usage: "drain (-address <addr> | -id <id>) [-cancel] <service>",
+		desc: "将节点标记为下线中，选择器不再选中该节点", run: drainNode},
+	{name: "weight", usage: "weight (-address <addr> | -id <id>) -weight <weight> <service>",
+		desc: "修改节点权重", run: setWeight},
+}
+
+// findCommand 按名字查找子命令
+func findCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// etcdClient 命令使用的 etcd 接口，修改节点时使用事务检查节点没有被并发修改
+type etcdClient interface {
+	client.Etcd
+	Txn(ctx context.Context) clientv3.Txn
+}
+
+// cli 命令执行环境
+type cli struct {
+	ctx     context.Context
+	etcd    etcdClient
+	cfg     *registry.FactoryConfig
+	timeout time.Duration
+	out     io.Writer
+}
+
+// storedNode etcd 中的节点
+type storedNode struct {
+	key   string
+	value []byte
+	node  *model.Node
+	// modRevision 读取时节点的修改版本，写回时检查
+	modRevision int64
+}
+
+// execute 执行子命令
+func (c *cli) execute(cmd *command, args []string) error {
+	fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: etcdnaming %s\n\n%s\n", cmd.usage, cmd.desc)
+		fs.PrintDefaults()
+	}
+	return cmd.run(c, fs, args)
+}
+
+// requestContext etcd 请求使用的超时上下文
+func (c *cli) requestContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(c.ctx, c.timeout)
+}
+
+// nodes 获取服务在 etcd 中的所有节点，按节点 id 排序
+func (c *cli) nodes(serviceName string) ([]*storedNode, error) {
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	servicePath := model.ServicePath(c.cfg.Prefix, serviceName)
+	rsp, err := c.etcd.Get(ctx, servicePath, clientv3.WithPrefix())
+	if err != nil {
+		return nil, fmt.Errorf("get %s fail: %w", servicePath, err)
+	}
+	nodes := make([]*storedNode, 0, len(rsp.Kvs))
+	for _, kv := range rsp.Kvs {
+		if !model.IsServiceNode(servicePath, string(kv.Key)) {
+			continue
+		}
+		node, err := model.Unmarshal(kv.Value)
+		if err != nil || node == nil {
+			fmt.Fprintf(c.out, "skip invalid node %s: %v\n", kv.Key, err)
+			continue
+		}
+		nodes = append(nodes, &storedNode{key: string(kv.Key), value: kv.Value, node: node,
+			modRevision: kv.ModRevision})
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].node.ID < nodes[j].node.ID
+	})
+	return nodes, nil
+}
+
+// match 获取地址为 address 或 id 为 id 的节点，没有匹配的节点时返回错误
+func (c *cli) match(serviceName, address, id string) ([]*storedNode, error) {
+	if address == "" && id == "" {
+		return nil, fmt.Errorf("%w: address or id is required", errUsage)
+	}
+	nodes, err := c.nodes(serviceName)
+	if err != nil {
+		return nil, err
+	}
+	var matched []*storedNode
+	for _, n := range nodes {
+		if (address == "" || n.node.Address == address) && (id == "" || n.node.ID == id) {
+			matched = append(matched, n)
+		}
+	}
+	if len(matched) == 0 {
+		return nil, errNodeNotFound
+	}
+	return matched, nil
+}
+
+// update 修改匹配的节点，按节点原来的编码写回并保留租约。
+// 写入时检查节点在读取后没有被修改，被修改或删除时返回 errConflict，节点所在的进程重新注册时会覆盖这里的修改
+func (c *cli) update(serviceName, address, id string, update func(node *model.Node)) error {
+	nodes, err := c.match(serviceName, address, id)
+	if err != nil {
+		return err
+	}
+	for _, n := range nodes {
+		update(n.node)
+		codec, err := model.CodecOf(n.value)
+		if err != nil {
+			return err
+		}
+		value, err := model.MarshalWith(codec, n.node)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := c.requestContext()
+		rsp, err := c.etcd.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(n.key), "=", n.modRevision)).
+			Then(clientv3.OpPut(n.key, value, clientv3.WithIgnoreLease())).
+			Commit()
+		cancel()
+		if err != nil {
+			return fmt.Errorf("update %s fail: %w", n.key, err)
+		}
+		if !rsp.Succeeded {
+			return fmt.Errorf("update %s fail: %w", n.key, errConflict)
+		}
+		fmt.Fprintf(c.out, "updated %s %s\n", n.node.ID, n.node.Address)
+	}
+	return nil
+}
+
+// listServices 列出所有服务和节点数
+func listServices(c *cli, fs *flag.FlagSet, args []string) error {
+	if _, err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	root := model.ServicePath(c.cfg.Prefix, "")
+	rsp, err := c.etcd.Get(ctx, root, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return fmt.Errorf("get %s fail: %w", root, err)
+	}
+	counts := make(map[string]int)
+	for _, kv := range rsp.Kvs {
+		rest := strings.TrimPrefix(string(kv.Key), root)
+		i := strings.Index(rest, "/")
+		if i <= 0 || strings.Contains(rest[i+1:], "/") {
+			continue
+		}
+		counts[rest[:i]]++
+	}
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVICE\tNODES")
+	for _, name := range names {
+		fmt.Fprintf(w, "%s\t%d\n", name, counts[name])
+	}
+	return w.Flush()
+}
+
+// listNodes 列出服务的节点和元数据
+func listNodes(c *cli, fs *flag.FlagSet, args []string) error {
+	jsonOutput := fs.Bool("json", false, "以 json 格式输出节点的全部信息，每行一个节点")
+	positional, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	nodes, err := c.nodes(positional[0])
+	if err != nil {
+		return err
+	}
+	if *jsonOutput {
+		enc := json.NewEncoder(c.out)
+		for _, n := range nodes {
+			if err := enc.Encode(n.node); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tADDRESS\tWEIGHT\tSTATUS\tPROTOCOL\tVERSION\tZONE\tTAGS\tMETADATA")
+	for _, n := range nodes {
+		node := n.node
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\t%s\t%s\t%s\n", node.ID, node.Address, node.Weight,
+			orDash(node.Status), orDash(node.Protocol), orDash(node.Version), orDash(node.Zone),
+			orDash(strings.Join(node.Tags, ",")), orDash(formatMetadata(node.Metadata)))
+	}
+	return w.Flush()
+}
+
+// watchNodes 实时输出服务的节点变更，直到收到退出信号
+func watchNodes(c *cli, fs *flag.FlagSet, args []string) error {
+	positional, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	d, err := discovery.NewDiscovery(c.etcd, &discovery.Config{Prefix: c.cfg.Prefix})
+	if err != nil {
+		return err
+	}
+	defer d.(*discovery.Discovery).Close()
+	ctx, cancelCtx := c.requestContext()
+	events, cancel, err := d.(*discovery.Discovery).Watch(positional[0], tdiscovery.WithContext(ctx))
+	cancelCtx()
+	if err != nil {
+		// 获取全量节点期间收到退出信号
+		if c.ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+	defer cancel()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return nil
+		case event, ok := <-events:
+			if !ok {
+				return nil
+			}
+			now := time.Now().Format("15:04:05")
+			for _, change := range event.Changes {
+				fmt.Fprintf(c.out, "%s %-6s %s weight=%d%s\n", now, strings.ToUpper(change.EventType.String()),
+					change.Node.Address, change.Node.Weight, formatStatus(change.Node))
+			}
+			fmt.Fprintf(c.out, "%s nodes=%d\n", now, len(event.Nodes))
+		}
+	}
+}
+
+// registerNode 注册节点并保持续约，收到退出信号后取消注册。
+// 配置文件的 registry 插件中配置了该服务时使用服务的配置，命令行参数覆盖配置
+func registerNode(c *cli, fs *flag.FlagSet, args []string) error {
+	address := fs.String("address", "", "节点地址 ip:port")
+	weight := fs.Int("weight", 0, "权重")
+	ttl := fs.Int("ttl", 0, "租约过期时间，单位秒")
+	metadata := fs.String("metadata", "", "元数据，格式为 k1=v1,k2=v2")
+	protocol := fs.String("protocol", "", "业务协议")
+	version := fs.String("version", "", "服务版本")
+	zone := fs.String("zone", "", "可用区")
+	tags := fs.String("tags", "", "标签，多个标签用逗号分隔")
+	positional, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	if *address == "" {
+		fs.Usage()
+		return fmt.Errorf("%w: address is required", errUsage)
+	}
+	serviceName := positional[0]
+	cfg := service(c.cfg, serviceName).Config(c.cfg.Prefix)
+	if *weight > 0 {
+		cfg.Weight = *weight
+	}
+	if *ttl > 0 {
+		cfg.TTL = *ttl
+	}
+	if *metadata != "" {
+		if cfg.Metadata, err = parseMetadata(*metadata); err != nil {
+			return err
+		}
+	}
+	setString(&cfg.Protocol, *protocol)
+	setString(&cfg.Version, *version)
+	setString(&cfg.Zone, *zone)
+	if *tags != "" {
+		cfg.Tags = strings.Split(*tags, ",")
+	}
+	cfg.SyncRegister = true
+	r, err := registry.NewRegistry(c.etcd, cfg)
+	if err != nil {
+		return err
+	}
+	if err := r.Register(serviceName, tregistry.WithAddress(*address)); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "registered %s %s, interrupt to deregister\n", serviceName, *address)
+	<-c.ctx.Done()
+	if err := r.Deregister(serviceName); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "deregistered %s %s\n", serviceName, *address)
+	return nil
+}
+
+// deregisterNode 删除节点
+func deregisterNode(c *cli, fs *flag.FlagSet, args []string) error {
+	address := fs.String("address", "", "节点地址 ip:port")
+	id := fs.String("id", "", "节点 id")
+	positional, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	nodes, err := c.match(positional[0], *address, *id)
+	if err != nil {
+		return err
+	}
+	for _, n := range nodes {
+		ctx, cancel := c.requestContext()
+		_, err := c.etcd.Delete(ctx, n.key)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("delete %s fail: %w", n.key, err)
+		}
+		fmt.Fprintf(c.out, "deregistered %s %s\n", n.node.ID, n.node.Address)
+	}
+	return nil
+}
+
+// drainNode 将节点标记为下线中，-cancel 时恢复为正常
+func drainNode(c *cli, fs *flag.FlagSet, args []string) error {
+	address := fs.String("address", "", "节点地址 ip:port")
+	id := fs.String("id", "", "节点 id")
+	cancel := fs.Bool("cancel", false, "取消下线，节点恢复为正常状态")
+	positional, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	status := model.NodeStatusDraining
+	if *cancel {
+		status = ""
+	}
+	return c.update(positional[0], *address, *id, func(node *model.Node) {
+		node.Status = status
+	})
+}
+
+// setWeight 修改节点权重
+func setWeight(c *cli, fs *flag.FlagSet, args []string) error {
+	address := fs.String("address", "", "节点地址 ip:port")
+	id := fs.String("id", "", "节点 id")
+	weight := fs.Int("weight", 0, "权重，必须大于 0")
+	positional, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	if *weight <= 0 {
+		fs.Usage()
+		return fmt.Errorf("%w: weight must be greater than 0", errUsage)
+	}
+	return c.update(positional[0], *address, *id, func(node *model.Node) {
+		node.Weight = *weight
+	})
+}
+
+// parseArgs 解析命令参数，参数可以在服务名之前或之后，位置参数个数不等于 n 时返回错误
+func parseArgs(fs *flag.FlagSet, args []string, n int) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if len(positional) != n {
+		fs.Usage()
+		return nil, errUsage
+	}
+	return positional, nil
+}
+
+// parseMetadata 解析 k1=v1,k2=v2 格式的元数据
+func parseMetadata(s string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		i := strings.Index(kv, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("%w: invalid metadata %s", errUsage, kv)
+		}
+		metadata[kv[:i]] = kv[i+1:]
+	}
+	return metadata, nil
+}
+
+// formatMetadata 按 key 排序输出 k1=v1,k2=v2 格式的元数据
+func formatMetadata(metadata map[string]string) string {
+	kvs := make([]string, 0, len(metadata))
+	for k, v := range metadata {
+		kvs = append(kvs, k+"="+v)
+	}
+	sort.Strings(kvs)
+	return strings.Join(kvs, ",")
+}
+
+// formatStatus 输出节点的非正常状态
+func formatStatus(node *tregistry.Node) string {
+	if status, ok := node.Metadata[model.MetadataKeyStatus].(string); ok && status != "" {
+		return " status=" + status
+	}
+	return ""
+}
+
+// setString value 不为空时设置
+func setString(dst *string, value string) {
+	if value != "" {
+		*dst = value
+	}
+}
+
+// orDash 空字符串输出为 -
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,283 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2023 Tencent.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"trpc.group/trpc-go/trpc-naming-etcd/client/fake"
+	"trpc.group/trpc-go/trpc-naming-etcd/model"
+	"trpc.group/trpc-go/trpc-naming-etcd/registry"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	. "github.com/glycerine/goconvey/convey"
+)
+
+// syncBuffer 并发安全的输出缓冲
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+// Write 写入输出
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// String 获取输出
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// Reset 清空输出
+func (b *syncBuffer) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf.Reset()
+}
+
+// waitOutput 等待输出中包含 s，超时返回 false
+func (b *syncBuffer) waitOutput(s string) bool {
+	for i := 0; i < 100; i++ {
+		if strings.Contains(b.String(), s) {
+			return true
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return false
+}
+
+// newTestCLI 新建使用内存 etcd 的命令执行环境
+func newTestCLI(ctx context.Context, e *fake.Etcd) (*cli, *syncBuffer) {
+	out := &syncBuffer{}
+	return &cli{
+		ctx:     ctx,
+		etcd:    e,
+		cfg:     &registry.FactoryConfig{Prefix: "/test/"},
+		timeout: time.Second,
+		out:     out,
+	}, out
+}
+
+// putTestNode 写入带租约的节点
+func putTestNode(e *fake.Etcd, codec string, node *model.Node) {
+	ctx := context.Background()
+	c, err := model.GetCodec(codec)
+	So(err, ShouldBeNil)
+	value, err := model.MarshalWith(c, node)
+	So(err, ShouldBeNil)
+	lease, err := e.Grant(ctx, 60)
+	So(err, ShouldBeNil)
+	_, err = e.Put(ctx, model.NodePath("/test/", node.Name, node.ID), value, clientv3.WithLease(lease.ID))
+	So(err, ShouldBeNil)
+}
+
+// getTestNode 读取节点
+func getTestNode(e *fake.Etcd, service, id string) (*model.Node, int64) {
+	rsp, err := e.Get(context.Background(), model.NodePath("/test/", service, id))
+	So(err, ShouldBeNil)
+	if len(rsp.Kvs) == 0 {
+		return nil, 0
+	}
+	node, err := model.Unmarshal(rsp.Kvs[0].Value)
+	So(err, ShouldBeNil)
+	return node, rsp.Kvs[0].Lease
+}
+
+func TestCommands(t *testing.T) {
+	Convey("测试查看和管理节点的命令", t, func() {
+		e := fake.New()
+		defer e.Close()
+		c, out := newTestCLI(context.Background(), e)
+		execute := func(args ...string) error {
+			out.Reset()
+			return c.execute(findCommand(args[0]), args[1:])
+		}
+		putTestNode(e, model.CodecJSON, &model.Node{Name: "svc.a", ID: "a1", Address: "127.0.0.1:8000", Weight: 10,
+			Metadata: map[string]string{"env": "prod", "app": "a"}, Version: "v1"})
+		putTestNode(e, model.CodecProto, &model.Node{Name: "svc.a", ID: "a2", Address: "127.0.0.1:8001", Weight: 10})
+		putTestNode(e, model.CodecJSON, &model.Node{Name: "svc.b", ID: "b1", Address: "127.0.0.1:9000", Weight: 1})
+
+		So(execute("services"), ShouldBeNil)
+		So(out.String(), ShouldContainSubstring, "svc.a    2")
+		So(out.String(), ShouldContainSubstring, "svc.b    1")
+
+		So(execute("nodes", "svc.a"), ShouldBeNil)
+		So(out.String(), ShouldContainSubstring, "app=a,env=prod")
+		So(out.String(), ShouldContainSubstring, "127.0.0.1:8001")
+		So(execute("nodes", "svc.a", "-json"), ShouldBeNil)
+		So(out.String(), ShouldContainSubstring, `"address":"127.0.0.1:8000"`)
+		So(execute("nodes"), ShouldEqual, errUsage)
+
+		// 修改后保留节点原来的编码和租约
+		_, lease := getTestNode(e, "svc.a", "a2")
+		So(execute("drain", "-address", "127.0.0.1:8001", "svc.a"), ShouldBeNil)
+		node, newLease := getTestNode(e, "svc.a", "a2")
+		So(node.Status, ShouldEqual, model.NodeStatusDraining)
+		So(newLease, ShouldEqual, lease)
+		rsp, err := e.Get(context.Background(), model.NodePath("/test/", "svc.a", "a2"))
+		So(err, ShouldBeNil)
+		codec, err := model.CodecOf(rsp.Kvs[0].Value)
+		So(err, ShouldBeNil)
+		So(codec.Name(), ShouldEqual, model.CodecProto)
+		So(execute("drain", "svc.a", "-id", "a2", "-cancel"), ShouldBeNil)
+		node, _ = getTestNode(e, "svc.a", "a2")
+		So(node.Status, ShouldEqual, "")
+
+		So(execute("weight", "-id", "a1", "-weight", "50", "svc.a"), ShouldBeNil)
+		node, _ = getTestNode(e, "svc.a", "a1")
+		So(node.Weight, ShouldEqual, 50)
+		So(node.Metadata["env"], ShouldEqual, "prod")
+		So(execute("weight", "-id", "a1", "svc.a"), ShouldNotBeNil)
+		So(execute("weight", "-weight", "50", "svc.a"), ShouldNotBeNil)
+		So(execute("weight", "-id", "notExist", "-weight", "50", "svc.a"), ShouldEqual, errNodeNotFound)
+
+		So(execute("deregister", "-address", "127.0.0.1:9000", "svc.b"), ShouldBeNil)
+		node, _ = getTestNode(e, "svc.b", "b1")
+		So(node, ShouldBeNil)
+	})
+}
+
+func TestCommands_UpdateConflict(t *testing.T) {
+	Convey("读取节点后节点被并发修改时不覆盖", t, func() {
+		e := fake.New()
+		defer e.Close()
+		c, _ := newTestCLI(context.Background(), e)
+		putTestNode(e, model.CodecJSON, &model.Node{Name: "svc.a", ID: "a1", Address: "127.0.0.1:8000", Weight: 10})
+
+		// 节点所在的进程在读取之后重新写入了节点
+		err := c.update("svc.a", "127.0.0.1:8000", "", func(node *model.Node) {
+			putTestNode(e, model.CodecJSON, &model.Node{Name: "svc.a", ID: "a1", Address: "127.0.0.1:8000",
+				Weight: 20})
+			node.Status = model.NodeStatusDraining
+		})
+		So(errors.Is(err, errConflict), ShouldBeTrue)
+		node, _ := getTestNode(e, "svc.a", "a1")
+		So(node.Weight, ShouldEqual, 20)
+		So(node.Status, ShouldEqual, "")
+
+		// 读取之后节点被删除
+		err = c.update("svc.a", "127.0.0.1:8000", "", func(node *model.Node) {
+			_, err := e.Delete(context.Background(), model.NodePath("/test/", "svc.a", "a1"))
+			So(err, ShouldBeNil)
+		})
+		So(errors.Is(err, errConflict), ShouldBeTrue)
+		node, _ = getTestNode(e, "svc.a", "a1")
+		So(node, ShouldBeNil)
+	})
+}
+
+func TestCommands_RegisterAndWatch(t *testing.T) {
+	Convey("测试注册节点和监听变更", t, func() {
+		e := fake.New()
+		defer e.Close()
+		watchCtx, stopWatch := context.WithCancel(context.Background())
+		watcher, watchOut := newTestCLI(watchCtx, e)
+		watchDone := make(chan error, 1)
+		go func() {
+			watchDone <- watcher.execute(findCommand("watch"), []string{"svc.a"})
+		}()
+		So(watchOut.waitOutput("nodes=0"), ShouldBeTrue)
+
+		registerCtx, stopRegister := context.WithCancel(context.Background())
+		c, out := newTestCLI(registerCtx, e)
+		c.cfg.Services = []registry.Service{{ServiceName: "svc.a", Weight: 20,
+			Metadata: map[string]string{"env": "dev"}}}
+		registerDone := make(chan error, 1)
+		go func() {
+			registerDone <- c.execute(findCommand("register"),
+				[]string{"-address", "127.0.0.1:8000", "-metadata", "env=prod,app=a", "svc.a"})
+		}()
+		var nodes []*storedNode
+		for i := 0; i < 100 && len(nodes) == 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+			var err error
+			nodes, err = c.nodes("svc.a")
+			So(err, ShouldBeNil)
+		}
+		So(len(nodes), ShouldEqual, 1)
+		// 使用配置文件中的服务配置，命令行参数覆盖配置
+		So(nodes[0].node.Weight, ShouldEqual, 20)
+		So(nodes[0].node.Metadata, ShouldResemble, map[string]string{"env": "prod", "app": "a"})
+		So(watchOut.waitOutput("CREATE 127.0.0.1:8000 weight=20"), ShouldBeTrue)
+
+		stopRegister()
+		So(<-registerDone, ShouldBeNil)
+		So(out.String(), ShouldContainSubstring, "deregistered svc.a 127.0.0.1:8000")
+		nodes, err := c.nodes("svc.a")
+		So(err, ShouldBeNil)
+		So(len(nodes), ShouldEqual, 0)
+
+		So(watchOut.waitOutput("DELETE 127.0.0.1:8000"), ShouldBeTrue)
+		stopWatch()
+		So(<-watchDone, ShouldBeNil)
+	})
+}
+
+// unreachableEtcd 模拟无法连接的 etcd，读取一直阻塞到 ctx 结束
+type unreachableEtcd struct {
+	*fake.Etcd
+}
+
+// Get 阻塞到 ctx 结束
+func (e *unreachableEtcd) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse,
+	error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestCommands_WatchUnreachable(t *testing.T) {
+	Convey("etcd 无法连接时收到退出信号后停止监听", t, func() {
+		e := &unreachableEtcd{Etcd: fake.New()}
+		defer e.Close()
+		ctx, stop := context.WithCancel(context.Background())
+		c, _ := newTestCLI(ctx, e.Etcd)
+		c.etcd = e
+		c.timeout = time.Hour
+		done := make(chan error, 1)
+		go func() {
+			done <- c.execute(findCommand("watch"), []string{"svc.a"})
+		}()
+		time.Sleep(50 * time.Millisecond)
+		stop()
+		select {
+		case err := <-done:
+			So(err, ShouldBeNil)
+		case <-time.After(time.Second):
+			So("watch not stopped", ShouldBeEmpty)
+		}
+	})
+}
+
+func Test_parseMetadata(t *testing.T) {
+	Convey("测试解析元数据参数", t, func() {
+		metadata, err := parseMetadata("a=1,b=x=y")
+		So(err, ShouldBeNil)
+		So(metadata, ShouldResemble, map[string]string{"a": "1", "b": "x=y"})
+		So(formatMetadata(metadata), ShouldEqual, "a=1,b=x=y")
+		_, err = parseMetadata("a")
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,135 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2025 Tencent.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"trpc.group/trpc-go/trpc-naming-etcd/client"
+	"trpc.group/trpc-go/trpc-naming-etcd/registry"
+
+	"gopkg.in/yaml.v3"
+)
+
+// fileConfig trpc 框架配置文件中与 etcd 插件相关的部分
+type fileConfig struct {
+	Plugins struct {
+		Etcd struct {
+			Client map[string]*client.Config `yaml:"client"`
+		} `yaml:"etcd"`
+		// Selector 和 Registry 插件的连接配置字段相同，都按 registry 插件的配置解析
+		Selector map[string]*registry.FactoryConfig `yaml:"selector"`
+		Registry map[string]*registry.FactoryConfig `yaml:"registry"`
+	} `yaml:"plugins"`
+}
+
+// options 全局命令行参数
+type options struct {
+	conf    string
+	plugin  string
+	address string
+	prefix  string
+	timeout int
+}
+
+// loadConfig 从配置文件中读取插件 name 的连接配置，优先使用 selector 插件的配置，
+// 命令行中的地址和前缀覆盖配置文件，配置文件不存在且指定了地址时只使用命令行参数
+func loadConfig(opts *options) (*client.Config, *registry.FactoryConfig, error) {
+	factoryCfg := &registry.FactoryConfig{}
+	clientCfg, err := loadFile(opts, factoryCfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	if opts.address != "" {
+		clientCfg = &client.Config{
+			Address:  opts.address,
+			Username: factoryCfg.Username,
+			Password: factoryCfg.Password,
+			CertFile: factoryCfg.TLS.CertFile,
+			KeyFile:  factoryCfg.TLS.KeyFile,
+			CaFile:   factoryCfg.TLS.CaFile,
+		}
+	}
+	if opts.prefix != "" {
+		factoryCfg.Prefix = opts.prefix
+	}
+	if factoryCfg.Prefix == "" {
+		factoryCfg.Prefix = client.DefaultEtcdPrefix
+	}
+	if opts.timeout > 0 {
+		clientCfg.Timeout = opts.timeout
+	}
+	return clientCfg, factoryCfg, nil
+}
+
+// loadFile 读取配置文件，返回连接 etcd 的配置
+func loadFile(opts *options, factoryCfg *registry.FactoryConfig) (*client.Config, error) {
+	b, err := ioutil.ReadFile(opts.conf)
+	if err != nil {
+		if os.IsNotExist(err) && opts.address != "" {
+			return &client.Config{}, nil
+		}
+		return nil, fmt.Errorf("read config %s fail: %w", opts.conf, err)
+	}
+	cfg := &fileConfig{}
+	if err := yaml.Unmarshal(b, cfg); err != nil {
+		return nil, fmt.Errorf("parse config %s fail: %w", opts.conf, err)
+	}
+	selectorCfg := cfg.Plugins.Selector[opts.plugin]
+	registryCfg := cfg.Plugins.Registry[opts.plugin]
+	found := selectorCfg
+	if found == nil {
+		found = registryCfg
+	}
+	if found == nil {
+		if opts.address != "" {
+			return &client.Config{}, nil
+		}
+		return nil, fmt.Errorf("etcd plugin %s not found in %s", opts.plugin, opts.conf)
+	}
+	*factoryCfg = *found
+	// 注册的服务配置只在 registry 插件中
+	factoryCfg.Services = nil
+	if registryCfg != nil {
+		factoryCfg.Services = registryCfg.Services
+	}
+	if factoryCfg.Client != "" {
+		shared, ok := cfg.Plugins.Etcd.Client[factoryCfg.Client]
+		if !ok || shared == nil {
+			return nil, fmt.Errorf("etcd client %s not found in %s", factoryCfg.Client, opts.conf)
+		}
+		return shared, nil
+	}
+	return &client.Config{
+		Address:  factoryCfg.Address,
+		Timeout:  factoryCfg.Timeout,
+		Username: factoryCfg.Username,
+		Password: factoryCfg.Password,
+		CertFile: factoryCfg.TLS.CertFile,
+		KeyFile:  factoryCfg.TLS.KeyFile,
+		CaFile:   factoryCfg.TLS.CaFile,
+	}, nil
+}
+
+// service 获取 registry 插件中服务的配置，没有配置时返回空配置
+func service(factoryCfg *registry.FactoryConfig, name string) *registry.Service {
+	for i := range factoryCfg.Services {
+		if factoryCfg.Services[i].ServiceName == name {
+			return &factoryCfg.Services[i]
+		}
+	}
+	return &registry.Service{ServiceName: name}
+}
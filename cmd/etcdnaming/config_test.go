@@ -0,0 +1,91 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2023 Tencent.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"trpc.group/trpc-go/trpc-naming-etcd/client"
+
+	. "github.com/glycerine/goconvey/convey"
+)
+
+const testConfig = `
+plugins:
+  etcd:
+    client:
+      shared:
+        address: 127.0.0.3:2379
+        username: root
+  registry:
+    etcd:
+      address: 127.0.0.1:2379
+      Prefix: /registry/
+      tls:
+        cafile: ca.crt
+      service:
+        - name: svc.a
+          weight: 10
+    etcd-shared:
+      client: shared
+  selector:
+    etcd:
+      address: 127.0.0.2:2379
+      timeout: 3
+    etcd-missing:
+      client: missing
+`
+
+func Test_loadConfig(t *testing.T) {
+	Convey("测试从框架配置文件读取连接配置", t, func() {
+		file := filepath.Join(t.TempDir(), "trpc_go.yaml")
+		So(ioutil.WriteFile(file, []byte(testConfig), 0644), ShouldBeNil)
+
+		// selector 插件的连接配置优先，服务配置来自 registry 插件
+		clientCfg, factoryCfg, err := loadConfig(&options{conf: file, plugin: "etcd"})
+		So(err, ShouldBeNil)
+		So(clientCfg.Address, ShouldEqual, "127.0.0.2:2379")
+		So(clientCfg.Timeout, ShouldEqual, 3)
+		So(factoryCfg.Prefix, ShouldEqual, client.DefaultEtcdPrefix)
+		So(len(factoryCfg.Services), ShouldEqual, 1)
+		So(service(factoryCfg, "svc.a").Weight, ShouldEqual, 10)
+		So(service(factoryCfg, "svc.b").ServiceName, ShouldEqual, "svc.b")
+
+		// 共享客户端
+		clientCfg, _, err = loadConfig(&options{conf: file, plugin: "etcd-shared", prefix: "/cli/", timeout: 1})
+		So(err, ShouldBeNil)
+		So(clientCfg.Address, ShouldEqual, "127.0.0.3:2379")
+		So(clientCfg.Username, ShouldEqual, "root")
+		So(clientCfg.Timeout, ShouldEqual, 1)
+
+		// 命令行地址覆盖配置文件
+		clientCfg, factoryCfg, err = loadConfig(&options{conf: file, plugin: "etcd", address: "127.0.0.9:2379",
+			prefix: "/cli/"})
+		So(err, ShouldBeNil)
+		So(clientCfg.Address, ShouldEqual, "127.0.0.9:2379")
+		So(factoryCfg.Prefix, ShouldEqual, "/cli/")
+
+		_, _, err = loadConfig(&options{conf: file, plugin: "etcd-missing"})
+		So(err, ShouldNotBeNil)
+		_, _, err = loadConfig(&options{conf: file, plugin: "notExist"})
+		So(err, ShouldNotBeNil)
+		_, _, err = loadConfig(&options{conf: file + ".notExist", plugin: "etcd"})
+		So(err, ShouldNotBeNil)
+		clientCfg, _, err = loadConfig(&options{conf: file + ".notExist", plugin: "etcd", address: "127.0.0.9:2379"})
+		So(err, ShouldBeNil)
+		So(clientCfg.Address, ShouldEqual, "127.0.0.9:2379")
+	})
+}
@@ -0,0 +1,96 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2025 Tencent.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+// etcdnaming 查看和管理注册在 etcd 中的服务，读取与插件相同的 trpc 框架配置文件连接 etcd。
+//
+// 用法：
+//
+//	etcdnaming [-conf ./trpc_go.yaml] [-plugin etcd] [-address addr] [-prefix prefix] <command> [flags] [service]
+//
+// 支持的命令见 etcdnaming -h
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"trpc.group/trpc-go/trpc-naming-etcd/client"
+)
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err := run(ctx, os.Args[1:], os.Stdout)
+	stop()
+	if err != nil && !errors.Is(err, flag.ErrHelp) {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// run 解析全局参数，连接 etcd 后执行命令
+func run(ctx context.Context, args []string, out io.Writer) error {
+	opts := &options{}
+	fs := flag.NewFlagSet("etcdnaming", flag.ContinueOnError)
+	fs.StringVar(&opts.conf, "conf", "./trpc_go.yaml", "trpc 框架配置文件")
+	fs.StringVar(&opts.plugin, "plugin", "etcd", "配置文件中 selector 或 registry 插件的名字")
+	fs.StringVar(&opts.address, "address", "", "etcd 地址，多个地址用逗号分隔，覆盖配置文件")
+	fs.StringVar(&opts.prefix, "prefix", "", "注册前缀，覆盖配置文件")
+	fs.IntVar(&opts.timeout, "timeout", 0, "etcd 请求超时时间，单位秒，覆盖配置文件")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: etcdnaming [flags] <command> [command flags] [service]\n\ncommands:\n")
+		for _, cmd := range commands {
+			fmt.Fprintf(fs.Output(), "  %-10s %s\n", cmd.name, cmd.desc)
+		}
+		fmt.Fprintf(fs.Output(), "\nflags:\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errUsage
+	}
+	cmd := findCommand(fs.Arg(0))
+	if cmd == nil {
+		fs.Usage()
+		return fmt.Errorf("unknown command %s", fs.Arg(0))
+	}
+	clientCfg, factoryCfg, err := loadConfig(opts)
+	if err != nil {
+		return err
+	}
+	etcdClient, err := client.GenerateEtcdClient(clientCfg)
+	if err != nil {
+		return fmt.Errorf("connect etcd fail: %w", err)
+	}
+	defer etcdClient.Close()
+	c := &cli{
+		ctx:     ctx,
+		etcd:    etcdClient,
+		cfg:     factoryCfg,
+		timeout: client.DefaultTimeout,
+		out:     out,
+	}
+	if clientCfg.Timeout > 0 {
+		c.timeout = time.Duration(clientCfg.Timeout) * time.Second
+	}
+	return c.execute(cmd, fs.Args()[1:])
+}
@@ -15,13 +15,20 @@ package naming
 
 // FactoryConfig 组件配置
 type FactoryConfig struct {
-	Address     string            `yaml:"address,omitempty"`
-	Timeout     int               `yaml:"timeout,omitempty"`
-	Username    string            `yaml:"username,omitempty"`
-	Password    string            `yaml:"password,omitempty"`
-	Prefix      string            `yaml:"Prefix,omitempty"`
-	LoadBalance LoadBalanceConfig `yaml:"load_balance,omitempty"`
-	TLS         TLSConfig         `yaml:"tls,omitempty"`
+	Client          string            `yaml:"client,omitempty"`
+	Address         string            `yaml:"address,omitempty"`
+	Timeout         int               `yaml:"timeout,omitempty"`
+	Username        string            `yaml:"username,omitempty"`
+	Password        string            `yaml:"password,omitempty"`
+	Prefix          string            `yaml:"Prefix,omitempty"`
+	LoadBalance     LoadBalanceConfig `yaml:"load_balance,omitempty"`
+	TLS             TLSConfig         `yaml:"tls,omitempty"`
+	Snapshot        SnapshotConfig    `yaml:"snapshot,omitempty"`
+	CacheExpire     int               `yaml:"cache_expire,omitempty"`
+	StaleWhileError bool              `yaml:"stale_while_error,omitempty"`
+	Outlier         OutlierConfig     `yaml:"outlier_detection,omitempty"`
+	RouteRules      []RouteRuleConfig `yaml:"route_rules,omitempty"`
+	Locality        LocalityConfig    `yaml:"locality,omitempty"`
 }
 
 // LoadBalanceConfig 负载均衡配置
@@ -36,3 +43,63 @@ type TLSConfig struct {
 	KeyFile  string `json:"keyfile"`
 	CaFile   string `json:"cafile"`
 }
+
+// SnapshotConfig 本地快照配置
+type SnapshotConfig struct {
+	// File 快照文件路径，为空时不开启
+	File string `yaml:"file,omitempty"`
+	// Interval 快照写入间隔，单位秒，默认 30 秒
+	Interval int `yaml:"interval,omitempty"`
+	// MaxStaleness 快照最大可用时长，单位秒，0 表示不限制
+	MaxStaleness int `yaml:"max_staleness,omitempty"`
+}
+
+// OutlierConfig 异常节点摘除配置
+type OutlierConfig struct {
+	// Enable 为 true 时摘除异常节点，默认不开启
+	Enable bool `yaml:"enable,omitempty"`
+	// ConsecutiveErrors 连续失败多少次后摘除节点，默认 5 次
+	ConsecutiveErrors int `yaml:"consecutive_errors,omitempty"`
+	// ErrorRate 统计周期内错误率达到多少后摘除节点，默认 0.5
+	ErrorRate float64 `yaml:"error_rate,omitempty"`
+	// MinRequests 统计周期内请求数达到多少后才按错误率摘除节点，默认 20
+	MinRequests int `yaml:"min_requests,omitempty"`
+	// Interval 错误率统计周期，单位秒，默认 10 秒
+	Interval int `yaml:"interval,omitempty"`
+	// BaseEjectionTime 首次摘除时长，单位秒，默认 30 秒
+	BaseEjectionTime int `yaml:"base_ejection_time,omitempty"`
+	// MaxEjectionTime 最大摘除时长，单位秒，默认 300 秒
+	MaxEjectionTime int `yaml:"max_ejection_time,omitempty"`
+	// MaxEjectionPercent 最多摘除服务节点的百分比，默认 50
+	MaxEjectionPercent int `yaml:"max_ejection_percent,omitempty"`
+}
+
+// RouteRuleConfig 元数据路由规则配置
+type RouteRuleConfig struct {
+	// Service 规则生效的服务名，为空时对所有没有单独配置规则的服务生效
+	Service string `yaml:"service,omitempty"`
+	// Routes 按顺序尝试的路由，前一个路由没有匹配的节点时使用下一个
+	Routes []RouteConfig `yaml:"routes,omitempty"`
+}
+
+// RouteConfig 路由匹配条件配置
+type RouteConfig struct {
+	// Metadata 节点元数据需要等于的值
+	Metadata map[string]string `yaml:"metadata,omitempty"`
+	// ContextKeys 从请求上下文透传信息中获取值的元数据键
+	ContextKeys []string `yaml:"context_keys,omitempty"`
+}
+
+// LocalityConfig 就近访问配置
+type LocalityConfig struct {
+	// Zone 调用方所在可用区，Zone 和 Region 都为空时不开启
+	Zone string `yaml:"zone,omitempty"`
+	// Region 调用方所在地域
+	Region string `yaml:"region,omitempty"`
+	// ZoneKey 节点元数据中可用区的键，默认 zone
+	ZoneKey string `yaml:"zone_key,omitempty"`
+	// RegionKey 节点元数据中地域的键，默认 region
+	RegionKey string `yaml:"region_key,omitempty"`
+	// MinHealthyPercent 本地健康节点占比低于该值时扩展到更大范围，默认 70
+	MinHealthyPercent int `yaml:"min_healthy_percent,omitempty"`
+}
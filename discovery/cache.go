@@ -15,15 +15,22 @@ package discovery
 
 import (
 	"errors"
+	"os"
 	"sync"
 	"time"
 
+	"trpc.group/trpc-go/trpc-go/log"
 	tdiscovery "trpc.group/trpc-go/trpc-go/naming/discovery"
 	tregistry "trpc.group/trpc-go/trpc-go/naming/registry"
+	"trpc.group/trpc-go/trpc-naming-etcd/client"
 	etcderror "trpc.group/trpc-go/trpc-naming-etcd/error"
+	"trpc.group/trpc-go/trpc-naming-etcd/internal/metrics"
 	"trpc.group/trpc-go/trpc-naming-etcd/model"
+)
 
-	clientv3 "go.etcd.io/etcd/client/v3"
+const (
+	// defaultCacheExpire 默认缓存过期时间
+	defaultCacheExpire = 30 * time.Second
 )
 
 var (
@@ -39,31 +46,115 @@ type cache struct {
 	expires map[string]time.Time
 	// watched 是否被调用过，调用过才关注改变，否则不关注
 	watched map[string]bool
+	// staled 正在使用过期缓存的服务
+	staled map[string]bool
 	// 当前缓存的 etcd 数据版本
 	version int64
+	// versions 各服务缓存的节点对应的 etcd 数据版本，删除缓存后保留，用于判断快照是否比缓存旧
+	versions map[string]int64
 	// 退出
 	exit chan bool
 	// watcher 监听 etcd 变更
 	watcher *etcdWatcher
+	// subscribers 服务节点变更的订阅者
+	subscribers map[string]map[*subscriber]bool
+	// snapshot 本地快照，未开启时为 nil
+	snapshot *snapshot
+	cfg      *Config
 }
 
-// setLocked 设置服务节点，必须要获取锁后操作
-func (c *cache) setLocked(serviceName string, nodes []*tregistry.Node) {
+// setLocked 设置服务节点和节点对应的数据版本，必须要获取锁后操作
+func (c *cache) setLocked(serviceName string, version int64, nodes []*tregistry.Node) {
 	c.nodeCache[serviceName] = nodes
-	c.expires[serviceName] = time.Now().Add(30 * time.Second)
+	c.versions[serviceName] = version
+	metrics.SetNodes(c.cfg.Name, serviceName, len(nodes))
+	c.expires[serviceName] = time.Now().Add(c.expire())
+	delete(c.staled, serviceName)
+	for sub := range c.subscribers[serviceName] {
+		sub.push(nodes)
+	}
+}
+
+// expire 缓存过期时间
+func (c *cache) expire() time.Duration {
+	if c.cfg == nil || c.cfg.CacheExpire <= 0 {
+		return defaultCacheExpire
+	}
+	return c.cfg.CacheExpire
+}
+
+// stale 获取服务的缓存节点，即使缓存已经过期，并标记服务正在使用过期缓存
+func (c *cache) stale(serviceName string) ([]*tregistry.Node, bool) {
+	c.Lock()
+	defer c.Unlock()
+	nodes, ok := c.nodeCache[serviceName]
+	if !ok {
+		return nil, false
+	}
+	if !c.isValid(nodes, c.expires[serviceName]) {
+		c.staled[serviceName] = true
+	}
+	return nodes, true
+}
+
+// isStale 判断服务是否正在使用过期缓存
+func (c *cache) isStale(serviceName string) bool {
+	c.RLock()
+	defer c.RUnlock()
+	return c.staled[serviceName]
+}
+
+// subscribe 添加订阅者，已经有缓存时立即推送当前节点
+func (c *cache) subscribe(sub *subscriber) {
+	c.Lock()
+	defer c.Unlock()
+	subs, ok := c.subscribers[sub.serviceName]
+	if !ok {
+		subs = make(map[*subscriber]bool)
+		c.subscribers[sub.serviceName] = subs
+	}
+	subs[sub] = true
+	if nodes, ok := c.nodeCache[sub.serviceName]; ok {
+		sub.push(nodes)
+	}
+}
+
+// unsubscribe 移除并停止订阅者
+func (c *cache) unsubscribe(sub *subscriber) {
+	c.Lock()
+	defer c.Unlock()
+	if subs, ok := c.subscribers[sub.serviceName]; ok {
+		delete(subs, sub)
+		if len(subs) == 0 {
+			delete(c.subscribers, sub.serviceName)
+		}
+	}
+	sub.stop()
 }
 
-// invalidCache 删除服务缓存
-func (c *cache) invalidCache(serviceName string) {
+// invalidCache 删除服务缓存。服务有订阅者时保留节点继续接收 watch 变更，只将缓存标记为过期，
+// 返回 true 表示需要立即重新获取
+func (c *cache) invalidCache(serviceName string) bool {
 	c.Lock()
+	defer c.Unlock()
+	if len(c.subscribers[serviceName]) > 0 {
+		if _, ok := c.nodeCache[serviceName]; ok {
+			c.expires[serviceName] = time.Time{}
+		}
+		return true
+	}
 	c.deleteLocked(serviceName)
-	c.Unlock()
+	return false
 }
 
 // deleteLocked 删除服务缓存，必须要获取锁后操作
 func (c *cache) deleteLocked(serviceName string) {
+	if _, ok := c.nodeCache[serviceName]; ok {
+		metrics.SetNodes(c.cfg.Name, serviceName, 0)
+	}
 	delete(c.nodeCache, serviceName)
 	delete(c.expires, serviceName)
+	delete(c.staled, serviceName)
 }
 
 // cache 缓存服务节点
@@ -83,73 +174,111 @@ func (c *cache) cache(serviceName string, version int64, nodes []*tregistry.Node
 		return nil
 	}
 	if len(nodes) == 0 {
-		c.setLocked(serviceName, emptyNodes)
+		c.setLocked(serviceName, version, emptyNodes)
 		return nil
 	}
-	c.setLocked(serviceName, nodes)
+	c.setLocked(serviceName, version, nodes)
 	return nil
 }
 
-// update 根据 etcd 变更更新缓存
+// update 根据 etcd 变更更新缓存，同一次通知中的所有变更在一次加锁中全部生效
 func (c *cache) update(result *watchResult) {
-	if result == nil || result.Node == nil {
+	if result == nil {
+		return
+	}
+	if result.Resync {
+		c.resync(result)
 		return
 	}
 
 	c.Lock()
 	defer c.Unlock()
-	serviceName := result.Node.Name
 	// 过时数据
 	if result.Version < c.version {
 		return
 	}
-	// 不关注的节点直接返回
-	if _, ok := c.watched[serviceName]; !ok {
-		return
+	changed := make(map[string][]*tregistry.Node)
+	for _, event := range result.Events {
+		if event == nil || event.Node == nil {
+			continue
+		}
+		serviceName := event.Node.Name
+		// 不关注的节点直接跳过
+		if _, ok := c.watched[serviceName]; !ok {
+			continue
+		}
+		nodes, ok := changed[serviceName]
+		if !ok {
+			// 只在获取过全量数据后才开始增量更新
+			if nodes, ok = c.nodeCache[serviceName]; !ok {
+				continue
+			}
+		}
+		changed[serviceName] = applyEvent(nodes, event)
 	}
-	nodes, ok := c.nodeCache[serviceName]
-	if !ok {
-		// 只在获取过全量数据后才开始增量更新
+	if len(changed) == 0 {
 		return
 	}
+	metrics.Incr(metrics.CacheUpdate)
 	// 更新数据版本
 	c.version = result.Version
-
-	var node *tregistry.Node
-	var index int
-	for i, n := range nodes {
-		if n.Address == result.Node.Address {
-			node = n
-			index = i
+	for serviceName, nodes := range changed {
+		if len(nodes) == 0 {
+			nodes = emptyNodes
 		}
+		c.setLocked(serviceName, result.Version, nodes)
 	}
+}
 
-	switch result.EventType {
+// applyEvent 将单个变更应用到节点列表上，返回新的节点列表，不修改原列表
+func applyEvent(nodes []*tregistry.Node, event *watchEvent) []*tregistry.Node {
+	newNodes := make([]*tregistry.Node, 0, len(nodes)+1)
+	switch event.EventType {
 	case Create, Update:
+		var found bool
+		for _, n := range nodes {
+			// 之前已经缓存过该节点则覆盖
+			if n.Address == event.Node.Address {
+				n = model.ConvertNode(event.Node)
+				found = true
+			}
+			newNodes = append(newNodes, n)
+		}
 		// 之前没有缓存过该节点则新增
-		if node == nil {
-			c.setLocked(serviceName, append(nodes, model.ConvertNode(result.Node)))
-			return
+		if !found {
+			newNodes = append(newNodes, model.ConvertNode(event.Node))
 		}
-		// 之前已经缓存过该节点则覆盖
-		nodes[index] = model.ConvertNode(result.Node)
 	case Delete:
-		if node == nil {
-			return
-		}
-		var newCacheNodes []*tregistry.Node
-		for _, cacheNode := range nodes {
-			if cacheNode.Address != result.Node.Address {
-				newCacheNodes = append(newCacheNodes, cacheNode)
+		for _, n := range nodes {
+			if n.Address != event.Node.Address {
+				newNodes = append(newNodes, n)
 			}
 		}
-		if len(newCacheNodes) == 0 {
-			newCacheNodes = emptyNodes
-		}
-		c.setLocked(serviceName, newCacheNodes)
 	default:
+		return nodes
+	}
+	return newNodes
+}
+
+// resync 使用 etcd 全量数据覆盖所有已缓存的服务
+func (c *cache) resync(result *watchResult) {
+	c.Lock()
+	defer c.Unlock()
+	if result.Version < c.version {
 		return
 	}
+	c.version = result.Version
+	services := make(map[string][]*tregistry.Node)
+	for _, node := range result.Nodes {
+		services[node.Name] = append(services[node.Name], model.ConvertNode(node))
+	}
+	for serviceName := range c.nodeCache {
+		nodes, ok := services[serviceName]
+		if !ok {
+			nodes = emptyNodes
+		}
+		c.setLocked(serviceName, result.Version, nodes)
+	}
 }
 
 // List 从缓存获取服务节点
@@ -216,17 +345,107 @@ func (c *cache) stop() {
 		close(c.exit)
 	}
 	c.watcher.stop()
+	// 停止后缓存不再更新，节点数清零
+	for serviceName := range c.nodeCache {
+		metrics.SetNodes(c.cfg.Name, serviceName, 0)
+	}
+	for _, subs := range c.subscribers {
+		for sub := range subs {
+			sub.stop()
+		}
+	}
+	c.subscribers = make(map[string]map[*subscriber]bool)
+}
+
+// restore 使用本地快照中的节点恢复服务缓存，并标记为正在使用过期缓存。
+// 缓存中已经有该服务比快照新的数据时，快照已经过时，不使用
+func (c *cache) restore(serviceName string) ([]*tregistry.Node, bool) {
+	c.Lock()
+	defer c.Unlock()
+	if c.snapshot == nil || c.versions[serviceName] > c.snapshot.Revision {
+		return nil, false
+	}
+	nodes, ok := c.snapshot.nodes(serviceName, c.cfg.SnapshotMaxStaleness)
+	if !ok {
+		return nil, false
+	}
+	c.setLocked(serviceName, c.snapshot.Revision, nodes)
+	c.staled[serviceName] = true
+	return nodes, true
+}
+
+// snapshotLoop 定期将缓存写入本地快照
+func (c *cache) snapshotLoop() {
+	ticker := time.NewTicker(c.cfg.SnapshotInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.saveSnapshot()
+		case <-c.exit:
+			return
+		}
+	}
+}
+
+// saveSnapshot 将缓存合并到快照并写入文件，只有 watch 连接正常时缓存才与 etcd 一致，否则不写入
+func (c *cache) saveSnapshot() {
+	if !c.watcher.isConnected() {
+		return
+	}
+	now := time.Now()
+	c.Lock()
+	s := &snapshot{
+		Revision: c.version,
+		Services: make(map[string]*snapshotService),
+	}
+	// 保留快照中本进程还没有获取过的服务
+	if c.snapshot != nil {
+		for serviceName, service := range c.snapshot.Services {
+			if c.cfg.SnapshotMaxStaleness > 0 && now.Sub(service.UpdatedAt) > c.cfg.SnapshotMaxStaleness {
+				continue
+			}
+			s.Services[serviceName] = service
+		}
+	}
+	for serviceName, nodes := range c.nodeCache {
+		// 正在使用过期缓存或者从快照恢复的服务保留之前的快照
+		if c.staled[serviceName] {
+			continue
+		}
+		s.Services[serviceName] = newSnapshotService(nodes, now)
+	}
+	c.snapshot = s
+	c.Unlock()
+	if err := s.save(c.cfg.SnapshotFile); err != nil {
+		log.Errorf("save discovery snapshot to %s fail, err: %v", c.cfg.SnapshotFile, err)
+	}
 }
 
 // newCache 新建缓存
-func newCache(etcdClient *clientv3.Client, cfg *Config) (*cache, error) {
+func newCache(etcdClient client.Etcd, cfg *Config) (*cache, error) {
 	watcher := newEtcdWatcher(etcdClient, cfg)
 	c := &cache{
-		watched:   make(map[string]bool),
-		nodeCache: make(map[string][]*tregistry.Node),
-		expires:   make(map[string]time.Time),
-		exit:      make(chan bool),
-		watcher:   watcher,
+		watched:     make(map[string]bool),
+		staled:      make(map[string]bool),
+		nodeCache:   make(map[string][]*tregistry.Node),
+		versions:    make(map[string]int64),
+		expires:     make(map[string]time.Time),
+		exit:        make(chan bool),
+		watcher:     watcher,
+		subscribers: make(map[string]map[*subscriber]bool),
+		cfg:         cfg,
+	}
+	if cfg.SnapshotFile != "" {
+		s, err := loadSnapshot(cfg.SnapshotFile)
+		if err != nil && !os.IsNotExist(err) {
+			log.Warnf("load discovery snapshot from %s fail, err: %v", cfg.SnapshotFile, err)
+		}
+		c.snapshot = s
+		if cfg.SnapshotInterval <= 0 {
+			cfg.SnapshotInterval = defaultSnapshotInterval
+		}
+		go c.snapshotLoop()
 	}
 	go c.watch()
 	return c, nil
@@ -15,58 +15,24 @@ package discovery
 
 import (
 	"context"
-	"reflect"
+	"sync"
 	"testing"
 	"time"
 
+	"trpc.group/trpc-go/trpc-go/metrics"
 	tregistry "trpc.group/trpc-go/trpc-go/naming/registry"
+	"trpc.group/trpc-go/trpc-naming-etcd/client"
+	"trpc.group/trpc-go/trpc-naming-etcd/client/fake"
 	"trpc.group/trpc-go/trpc-naming-etcd/model"
 
-	"go.etcd.io/etcd/api/v3/etcdserverpb"
-	"go.etcd.io/etcd/api/v3/mvccpb"
-	clientv3 "go.etcd.io/etcd/client/v3"
-
-	. "github.com/agiledragon/gomonkey"
 	. "github.com/glycerine/goconvey/convey"
 )
 
-// cacheWatcher 实现etcd的Watcher接口
-type cacheWatcher struct {
-}
-
-// Watch 关注key变化
-func (c *cacheWatcher) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
-	return make(chan clientv3.WatchResponse, 1)
-}
-
-// RequestProgress 请求处理
-func (c *cacheWatcher) RequestProgress(ctx context.Context) error {
-	return nil
-}
-
-// Close 关闭clientWatcher
-func (c *cacheWatcher) Close() error {
-	return nil
-}
-
-// newCacheEtcdClient 获取etcd客户端
-func newCacheEtcdClient() *clientv3.Client {
-	client, _ := clientv3.New(clientv3.Config{
-		Endpoints: []string{"127.0.0.1:2379"},
-	})
-	client.Watcher = newClientWatcher()
-	return client
-}
-
-// newClientWatcher 新建一个watcher，实现etcd的watcher接口
-func newClientWatcher() clientv3.Watcher {
-	return &cacheWatcher{}
-}
-
 func Test_cache_List(t *testing.T) {
 	Convey("通过缓存获取服务列表", t, func() {
-		client := newCacheEtcdClient()
-		c, err := newCache(client, &Config{})
+		e := fake.New()
+		defer e.Close()
+		c, err := newCache(e, &Config{})
 		So(err, ShouldBeNil)
 		So(c, ShouldNotBeNil)
 		// 兼容nil
@@ -80,9 +46,10 @@ func Test_cache_List(t *testing.T) {
 		}
 		// 由于没有关注过test服务，此时更新不会生效
 		c.update(&watchResult{
-			EventType: Create,
-			Version:   1,
-			Node:      firstNode,
+			Version: 1,
+			Events: []*watchEvent{
+				{EventType: Create, Node: firstNode},
+			},
 		})
 		// 由于节点为0，此时应该报错，同时List也代表着关注了test服务，后续更新可以生效
 		nodes, err := c.List("test")
@@ -91,9 +58,10 @@ func Test_cache_List(t *testing.T) {
 		// 先缓存一次，模拟获取过数据
 		_ = c.cache("test", 2, emptyNodes)
 		c.update(&watchResult{
-			EventType: Create,
-			Version:   2,
-			Node:      firstNode,
+			Version: 2,
+			Events: []*watchEvent{
+				{EventType: Create, Node: firstNode},
+			},
 		})
 		// 此时能够获取到缓存
 		nodes, err = c.List("test")
@@ -102,9 +70,10 @@ func Test_cache_List(t *testing.T) {
 		firstNode.Weight = 50
 		// 更新老版本数据，应该跳过不更新
 		c.update(&watchResult{
-			EventType: Update,
-			Version:   3,
-			Node:      firstNode,
+			Version: 3,
+			Events: []*watchEvent{
+				{EventType: Update, Node: firstNode},
+			},
 		})
 		// 此时能够获取到缓存
 		nodes, err = c.List("test")
@@ -120,15 +89,17 @@ func Test_cache_List(t *testing.T) {
 			Weight:   100,
 		}
 		c.update(&watchResult{
-			EventType: Create,
-			Version:   4,
-			Node:      secondNode,
+			Version: 4,
+			Events: []*watchEvent{
+				{EventType: Create, Node: secondNode},
+			},
 		})
 		// 删除一个节点
 		c.update(&watchResult{
-			EventType: Delete,
-			Version:   5,
-			Node:      firstNode,
+			Version: 5,
+			Events: []*watchEvent{
+				{EventType: Delete, Node: firstNode},
+			},
 		})
 
 		// 此时只能获取到第二个节点
@@ -139,9 +110,10 @@ func Test_cache_List(t *testing.T) {
 
 		// 删除第二个 节点
 		c.update(&watchResult{
-			EventType: Delete,
-			Version:   6,
-			Node:      secondNode,
+			Version: 6,
+			Events: []*watchEvent{
+				{EventType: Delete, Node: secondNode},
+			},
 		})
 		// 此时什么也获取不到
 		nodes, err = c.List("test")
@@ -151,8 +123,9 @@ func Test_cache_List(t *testing.T) {
 
 func Test_cache_cache(t *testing.T) {
 	Convey("cache", t, func() {
-		client := newCacheEtcdClient()
-		c, err := newCache(client, &Config{})
+		e := fake.New()
+		defer e.Close()
+		c, err := newCache(e, &Config{})
 		So(err, ShouldBeNil)
 		So(c, ShouldNotBeNil)
 		// 缓存空
@@ -190,8 +163,9 @@ func Test_cache_cache(t *testing.T) {
 
 func Test_cache_isValid(t *testing.T) {
 	Convey("测试cache的isValid函数", t, func() {
-		client := newCacheEtcdClient()
-		c, err := newCache(client, &Config{})
+		e := fake.New()
+		defer e.Close()
+		c, err := newCache(e, &Config{})
 		So(err, ShouldBeNil)
 		So(c, ShouldNotBeNil)
 
@@ -211,8 +185,9 @@ func Test_cache_isValid(t *testing.T) {
 
 func Test_cache_stop(t *testing.T) {
 	Convey("测试cache的stop函数", t, func() {
-		client := newCacheEtcdClient()
-		c, err := newCache(client, &Config{})
+		e := fake.New()
+		defer e.Close()
+		c, err := newCache(e, &Config{})
 		So(err, ShouldBeNil)
 		So(c, ShouldNotBeNil)
 		c.stop()
@@ -223,62 +198,224 @@ func Test_cache_stop(t *testing.T) {
 
 func Test_cache_watch(t *testing.T) {
 	Convey("测试cache的watch函数", t, func() {
-		client := newCacheEtcdClient()
-		c, err := newCache(client, &Config{})
+		e := fake.New()
+		defer e.Close()
+		c, err := newCache(e, &Config{RetryInterval: 10 * time.Millisecond})
 		So(err, ShouldBeNil)
 		So(c, ShouldNotBeNil)
+		defer c.stop()
 		nodes, err := c.List("test")
 		So(err, ShouldBeNil)
 		So(len(nodes), ShouldEqual, 0)
 		// 先缓存一次，模拟获取过数据
 		_ = c.cache("test", 1, emptyNodes)
-		// mock Watch 正常返回
-		watchPatch := ApplyMethod(reflect.TypeOf(client.Watcher), "Watch", func(lease *cacheWatcher,
-			ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
+		for i := 0; i < 100 && !c.watcher.isConnected(); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		So(c.watcher.isConnected(), ShouldBeTrue)
+
+		// watch 到的变更更新缓存，watch 断开后自动重连
+		putNode := func(port string) {
 			node := &model.Node{
 				Name:     "test",
-				ID:       model.ServiceID("127.0.0.1", "8080", "123"),
-				Address:  "127.0.0.1:8080",
+				ID:       model.ServiceID("127.0.0.1", port, "123"),
+				Address:  "127.0.0.1:" + port,
 				Metadata: map[string]string{"key": "value"},
 				Weight:   100,
 			}
 			value, _ := model.Marshal(node)
-			etcdCh := make(chan clientv3.WatchResponse, 10)
-			// 新建
-			etcdCh <- clientv3.WatchResponse{
-				Header: etcdserverpb.ResponseHeader{
-					Revision: 100,
-				},
-				Events: []*clientv3.Event{
-					{
-						Type: clientv3.EventTypePut,
-						Kv: &mvccpb.KeyValue{
-							Key:            []byte(key),
-							Value:          []byte(value),
-							CreateRevision: 100,
-							ModRevision:    100,
-						},
-					},
-				},
-				Canceled: false,
+			_, err := e.Put(context.Background(), model.NodePath(client.DefaultEtcdPrefix, "test", node.ID), value)
+			So(err, ShouldBeNil)
+		}
+		waitNodes := func(n int) bool {
+			for i := 0; i < 100; i++ {
+				if nodes, _ := c.List("test"); len(nodes) == n {
+					return true
+				}
+				time.Sleep(10 * time.Millisecond)
 			}
-			etcdCh <- clientv3.WatchResponse{
-				Header: etcdserverpb.ResponseHeader{
-					Revision: 100,
-				},
-				Canceled: true,
+			return false
+		}
+		putNode("8080")
+		So(waitNodes(1), ShouldBeTrue)
+		e.DropWatches()
+		putNode("8081")
+		So(waitNodes(2), ShouldBeTrue)
+	})
+}
+
+func Test_cache_updateBatch(t *testing.T) {
+	Convey("同一次通知中的多个变更全部生效", t, func() {
+		e := fake.New()
+		defer e.Close()
+		c, err := newCache(e, &Config{})
+		So(err, ShouldBeNil)
+		newNode := func(port string) *model.Node {
+			return &model.Node{
+				Name:    "test",
+				ID:      model.ServiceID("127.0.0.1", port, "123"),
+				Address: "127.0.0.1:" + port,
 			}
-			return etcdCh
+		}
+		_, _ = c.List("test")
+		_ = c.cache("test", 1, []*tregistry.Node{model.ConvertNode(newNode("8080"))})
+		before, _ := c.List("test")
+
+		c.update(&watchResult{
+			Version: 2,
+			Events: []*watchEvent{
+				{EventType: Create, Node: newNode("8081")},
+				{EventType: Create, Node: newNode("8082")},
+				{EventType: Delete, Node: newNode("8080")},
+				{EventType: Create, Node: &model.Node{Name: "unwatched", Address: "127.0.0.1:9000"}},
+			},
+		})
+		nodes, err := c.List("test")
+		So(err, ShouldBeNil)
+		So(len(nodes), ShouldEqual, 2)
+		So(nodes[0].Address, ShouldEqual, "127.0.0.1:8081")
+		So(nodes[1].Address, ShouldEqual, "127.0.0.1:8082")
+		So(c.version, ShouldEqual, 2)
+		// 已经返回给调用方的列表不会被修改
+		So(len(before), ShouldEqual, 1)
+		So(before[0].Address, ShouldEqual, "127.0.0.1:8080")
+
+		// 一次删除多个节点
+		c.update(&watchResult{
+			Version: 3,
+			Events: []*watchEvent{
+				{EventType: Delete, Node: newNode("8081")},
+				{EventType: Delete, Node: newNode("8082")},
+			},
 		})
-		defer watchPatch.Reset()
-		c.watch()
+		_, err = c.List("test")
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func Test_cache_resync(t *testing.T) {
+	Convey("测试全量同步覆盖缓存", t, func() {
+		e := fake.New()
+		defer e.Close()
+		c, err := newCache(e, &Config{})
+		So(err, ShouldBeNil)
+		firstNode := &model.Node{
+			Name:    "test",
+			ID:      model.ServiceID("127.0.0.1", "8080", "123"),
+			Address: "127.0.0.1:8080",
+		}
+		secondNode := &model.Node{
+			Name:    "test",
+			ID:      model.ServiceID("127.0.0.1", "8081", "123"),
+			Address: "127.0.0.1:8081",
+		}
+		_, _ = c.List("test")
+		_, _ = c.List("test1")
+		_ = c.cache("test", 1, []*tregistry.Node{model.ConvertNode(firstNode)})
+		_ = c.cache("test1", 1, []*tregistry.Node{model.ConvertNode(firstNode)})
+
+		c.update(&watchResult{
+			Version: 10,
+			Resync:  true,
+			Nodes:   []*model.Node{secondNode},
+		})
+		nodes, err := c.List("test")
+		So(err, ShouldBeNil)
+		So(len(nodes), ShouldEqual, 1)
+		So(nodes[0].Address, ShouldEqual, "127.0.0.1:8081")
+		// 全量数据中不存在的服务被清空
+		_, err = c.List("test1")
+		So(err, ShouldNotBeNil)
+
+		// 过时的全量数据被忽略
+		c.update(&watchResult{
+			Version: 5,
+			Resync:  true,
+			Nodes:   []*model.Node{firstNode},
+		})
+		nodes, _ = c.List("test")
+		So(nodes[0].Address, ShouldEqual, "127.0.0.1:8081")
+	})
+}
+
+// nodesSink 记录每个插件和服务最近一次上报的节点数
+type nodesSink struct {
+	mu    sync.Mutex
+	nodes map[string]float64
+}
+
+// Name 返回 sink 名
+func (s *nodesSink) Name() string {
+	return "naming-etcd-discovery-test"
+}
+
+// Report 记录节点数
+func (s *nodesSink) Report(rec metrics.Record, opts ...metrics.Option) error {
+	var key string
+	for _, dim := range rec.GetDimensions() {
+		key += dim.Value + "/"
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range rec.GetMetrics() {
+		if m.Name() == "trpc.naming.etcd.discovery.nodes" {
+			s.nodes[key] = m.Value()
+		}
+	}
+	return nil
+}
+
+// testNodesSink 在测试开始前注册，避免与其他用例遗留的 watch 协程并发注册 sink
+var testNodesSink = &nodesSink{nodes: make(map[string]float64)}
+
+func init() {
+	metrics.RegisterMetricsSink(testNodesSink)
+}
+
+// get 获取插件 plugin 中服务的节点数
+func (s *nodesSink) get(plugin, serviceName string) (float64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.nodes[plugin+"/"+serviceName+"/"]
+	return v, ok
+}
+
+func Test_cache_nodesMetrics(t *testing.T) {
+	Convey("按插件上报服务的节点数，删除缓存后清零", t, func() {
+		sink := testNodesSink
+		e := fake.New()
+		defer e.Close()
+		gz, err := newCache(e, &Config{Name: "etcd-gz"})
+		So(err, ShouldBeNil)
+		sh, err := newCache(e, &Config{Name: "etcd-sh"})
+		So(err, ShouldBeNil)
+		node := &tregistry.Node{ServiceName: "test", Address: "127.0.0.1:8080"}
+		_, _ = gz.List("test")
+		_, _ = sh.List("test")
+		So(gz.cache("test", 1, []*tregistry.Node{node, node}), ShouldBeNil)
+		So(sh.cache("test", 1, []*tregistry.Node{node}), ShouldBeNil)
+		v, _ := sink.get("etcd-gz", "test")
+		So(v, ShouldEqual, 2)
+		v, _ = sink.get("etcd-sh", "test")
+		So(v, ShouldEqual, 1)
+
+		So(gz.invalidCache("test"), ShouldBeFalse)
+		v, _ = sink.get("etcd-gz", "test")
+		So(v, ShouldEqual, 0)
+		v, _ = sink.get("etcd-sh", "test")
+		So(v, ShouldEqual, 1)
+		gz.stop()
+		sh.stop()
+		v, _ = sink.get("etcd-sh", "test")
+		So(v, ShouldEqual, 0)
 	})
 }
 
 func Test_newCache(t *testing.T) {
 	Convey("新建缓存", t, func() {
-		client := newCacheEtcdClient()
-		c, err := newCache(client, &Config{})
+		e := fake.New()
+		defer e.Close()
+		c, err := newCache(e, &Config{})
 		So(err, ShouldBeNil)
 		So(c, ShouldNotBeNil)
 	})
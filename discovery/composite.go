@@ -0,0 +1,361 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2025 Tencent.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package discovery
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"trpc.group/trpc-go/trpc-go/log"
+	tdiscovery "trpc.group/trpc-go/trpc-go/naming/discovery"
+	tregistry "trpc.group/trpc-go/trpc-go/naming/registry"
+	etcderror "trpc.group/trpc-go/trpc-naming-etcd/error"
+	"trpc.group/trpc-go/trpc-naming-etcd/model"
+)
+
+const (
+	// MetadataKeyCluster 节点来源集群在 trpc 节点元数据中的 key
+	MetadataKeyCluster = "etcd_cluster"
+	// defaultClusterTimeout 单个集群获取节点的默认超时时间
+	defaultClusterTimeout = time.Second
+)
+
+var (
+	errNoCluster      = errors.New("composite discovery has no cluster")
+	errClusterTimeout = errors.New("composite discovery cluster timeout")
+)
+
+// Cluster 组合服务发现中的一个集群
+type Cluster struct {
+	// Name 集群名，写入节点元数据 MetadataKeyCluster
+	Name string
+	// Discovery 集群的服务发现
+	Discovery tdiscovery.Discovery
+	// Timeout 从集群获取节点的超时时间，超时的集群不影响其余集群的结果，默认 1 秒
+	Timeout time.Duration
+}
+
+// nodeWatcher 支持订阅节点变更的服务发现
+type nodeWatcher interface {
+	Watch(serviceName string, opts ...tdiscovery.Option) (<-chan *Event, func(), error)
+}
+
+// CompositeDiscovery 组合多个集群的服务发现，合并各集群的节点并按节点 id 去重，
+// 排在前面的集群优先，部分集群不可用时使用其余集群的节点
+type CompositeDiscovery struct {
+	clusters []Cluster
+	// retryInterval 集群订阅失败后首次重试的等待时间
+	retryInterval time.Duration
+}
+
+// NewCompositeDiscovery 新建组合服务发现
+func NewCompositeDiscovery(clusters ...Cluster) (tdiscovery.Discovery, error) {
+	if len(clusters) == 0 {
+		return nil, errNoCluster
+	}
+	return &CompositeDiscovery{clusters: clusters, retryInterval: defaultRetryInterval}, nil
+}
+
+// List 并发获取所有集群的节点并合并，每个集群单独超时，所有集群都失败时返回第一个集群的错误
+func (c *CompositeDiscovery) List(serviceName string, opts ...tdiscovery.Option) ([]*tregistry.Node, error) {
+	type listResult struct {
+		i     int
+		nodes []*tregistry.Node
+		err   error
+	}
+	results := make([][]*tregistry.Node, len(c.clusters))
+	errs := make([]error, len(c.clusters))
+	ch := make(chan listResult, len(c.clusters))
+	for i := range c.clusters {
+		errs[i] = errClusterTimeout
+		go func(i int) {
+			ctx, cancel := c.clusterContext(i, opts)
+			defer cancel()
+			nodes, err := c.clusters[i].Discovery.List(serviceName, withContext(opts, ctx)...)
+			ch <- listResult{i: i, nodes: nodes, err: err}
+		}(i)
+	}
+	// 集群没有按 ctx 及时返回时不再等待
+	timer := time.NewTimer(c.maxTimeout())
+	defer timer.Stop()
+	for received := 0; received < len(c.clusters); received++ {
+		select {
+		case r := <-ch:
+			results[r.i], errs[r.i] = r.nodes, r.err
+			continue
+		case <-timer.C:
+		}
+		break
+	}
+
+	var firstErr error
+	var available bool
+	for i, err := range errs {
+		switch err {
+		case nil, etcderror.ErrServerNotAvailable:
+			available = true
+		default:
+			log.Warnf("list %s from cluster %s fail, err: %v", serviceName, c.clusters[i].Name, err)
+			results[i] = nil
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	if !available {
+		return nil, firstErr
+	}
+	nodes := c.merge(results)
+	if len(nodes) == 0 {
+		return emptyNodes, etcderror.ErrServerNotAvailable
+	}
+	return nodes, nil
+}
+
+// merge 合并各集群的节点，按节点 id 去重，并在元数据中标记节点来源集群
+func (c *CompositeDiscovery) merge(results [][]*tregistry.Node) []*tregistry.Node {
+	var nodes []*tregistry.Node
+	seen := make(map[string]bool)
+	for i, clusterNodes := range results {
+		for _, node := range clusterNodes {
+			id := model.NodeID(node)
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			nodes = append(nodes, tagCluster(node, c.clusters[i].Name))
+		}
+	}
+	if nodes == nil {
+		return emptyNodes
+	}
+	return nodes
+}
+
+// tagCluster 复制节点并在元数据中标记来源集群，不修改原节点
+func tagCluster(node *tregistry.Node, cluster string) *tregistry.Node {
+	n := *node
+	n.Metadata = make(map[string]interface{}, len(node.Metadata)+1)
+	for k, v := range node.Metadata {
+		n.Metadata[k] = v
+	}
+	n.Metadata[MetadataKeyCluster] = cluster
+	return &n
+}
+
+// Watch 订阅所有集群中 serviceName 的节点变更，任一集群变化时通知合并后的节点，
+// 订阅失败或者超时的集群在后台重试，所有集群都订阅失败时返回第一个集群的错误
+func (c *CompositeDiscovery) Watch(serviceName string, opts ...tdiscovery.Option) (<-chan *Event, func(), error) {
+	w := &compositeWatch{
+		discovery: c,
+		sub:       newSubscriber(serviceName),
+		latest:    make([][]*tregistry.Node, len(c.clusters)),
+		exit:      make(chan bool),
+	}
+	type watchResult struct {
+		i   int
+		err error
+	}
+	// 不支持订阅的集群没有结果
+	errs := make([]error, len(c.clusters))
+	ch := make(chan watchResult, len(c.clusters))
+	var watching int
+	for i, cluster := range c.clusters {
+		if _, ok := cluster.Discovery.(nodeWatcher); !ok {
+			errs[i] = errNoCluster
+			continue
+		}
+		errs[i] = errClusterTimeout
+		watching++
+		go func(i int) {
+			ch <- watchResult{i: i, err: w.watch(i, serviceName, opts...)}
+		}(i)
+	}
+	// 超时的集群在订阅返回后自行加入或者重试
+	timer := time.NewTimer(c.maxTimeout())
+	defer timer.Stop()
+	for received := 0; received < watching; received++ {
+		select {
+		case r := <-ch:
+			errs[r.i] = r.err
+			continue
+		case <-timer.C:
+		}
+		break
+	}
+	firstErr := errNoCluster
+	for _, err := range errs {
+		if err == nil {
+			return w.sub.events, w.stop, nil
+		}
+		if firstErr == errNoCluster {
+			firstErr = err
+		}
+	}
+	w.stop()
+	return nil, nil, firstErr
+}
+
+// Subscribe 订阅所有集群中 serviceName 的节点变更，节点变化时在独立的协程中依次调用 callback，
+// 返回取消订阅的函数
+func (c *CompositeDiscovery) Subscribe(serviceName string, callback func(*Event),
+	opts ...tdiscovery.Option) (func(), error) {
+	events, cancel, err := c.Watch(serviceName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for event := range events {
+			callback(event)
+		}
+	}()
+	return cancel, nil
+}
+
+// compositeWatch 组合服务发现的一次订阅
+type compositeWatch struct {
+	mu        sync.Mutex
+	discovery *CompositeDiscovery
+	sub       *subscriber
+	// latest 各集群最新的节点
+	latest  [][]*tregistry.Node
+	cancels []func()
+	exit    chan bool
+	once    sync.Once
+}
+
+// watch 订阅集群 i，失败时在后台重试
+func (w *compositeWatch) watch(i int, serviceName string, opts ...tdiscovery.Option) error {
+	events, cancel, err := w.discovery.watchCluster(i, serviceName, opts...)
+	if err != nil {
+		log.Warnf("watch %s from cluster %s fail, err: %v", serviceName, w.discovery.clusters[i].Name, err)
+		go w.retry(i, serviceName, opts...)
+		return err
+	}
+	w.add(i, events, cancel)
+	return nil
+}
+
+// add 转发集群 i 的节点变更，订阅已经停止时直接取消
+func (w *compositeWatch) add(i int, events <-chan *Event, cancel func()) {
+	w.mu.Lock()
+	select {
+	case <-w.exit:
+		w.mu.Unlock()
+		cancel()
+		return
+	default:
+	}
+	w.cancels = append(w.cancels, cancel)
+	w.mu.Unlock()
+	go func() {
+		for event := range events {
+			w.update(i, event.Nodes)
+		}
+	}()
+}
+
+// update 记录集群 i 的最新节点并通知合并后的节点
+func (w *compositeWatch) update(i int, nodes []*tregistry.Node) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.latest[i] = nodes
+	w.sub.push(w.discovery.merge(w.latest))
+}
+
+// retry 按退避策略重试订阅集群 i，直到成功或者订阅停止
+func (w *compositeWatch) retry(i int, serviceName string, opts ...tdiscovery.Option) {
+	cluster := w.discovery.clusters[i]
+	b := newRetryBackOff(w.discovery.retryInterval, defaultMaxRetryInterval)
+	for {
+		timer := time.NewTimer(b.NextBackOff())
+		select {
+		case <-timer.C:
+		case <-w.exit:
+			timer.Stop()
+			return
+		}
+		events, cancel, err := w.discovery.watchCluster(i, serviceName, opts...)
+		if err != nil {
+			log.Tracef("retry watch %s from cluster %s fail, err: %v", serviceName, cluster.Name, err)
+			continue
+		}
+		w.add(i, events, cancel)
+		return
+	}
+}
+
+// stop 停止订阅，可以多次调用
+func (w *compositeWatch) stop() {
+	w.once.Do(func() {
+		w.mu.Lock()
+		close(w.exit)
+		cancels := w.cancels
+		w.cancels = nil
+		w.mu.Unlock()
+		for _, cancel := range cancels {
+			cancel()
+		}
+		w.sub.stop()
+	})
+}
+
+// watchCluster 使用集群的超时时间订阅集群 i
+func (c *CompositeDiscovery) watchCluster(i int, serviceName string,
+	opts ...tdiscovery.Option) (<-chan *Event, func(), error) {
+	ctx, cancel := c.clusterContext(i, opts)
+	defer cancel()
+	return c.clusters[i].Discovery.(nodeWatcher).Watch(serviceName, withContext(opts, ctx)...)
+}
+
+// clusterContext 在调用方的 ctx 上加上集群 i 的超时时间
+func (c *CompositeDiscovery) clusterContext(i int, opts []tdiscovery.Option) (context.Context, context.CancelFunc) {
+	o := &tdiscovery.Options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	ctx := o.Ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return context.WithTimeout(ctx, c.clusters[i].timeout())
+}
+
+// maxTimeout 所有集群中最长的超时时间
+func (c *CompositeDiscovery) maxTimeout() time.Duration {
+	var timeout time.Duration
+	for _, cluster := range c.clusters {
+		if t := cluster.timeout(); t > timeout {
+			timeout = t
+		}
+	}
+	return timeout
+}
+
+// timeout 集群的超时时间
+func (c Cluster) timeout() time.Duration {
+	if c.Timeout <= 0 {
+		return defaultClusterTimeout
+	}
+	return c.Timeout
+}
+
+// withContext 复制 opts 并追加 ctx，不修改调用方的 opts
+func withContext(opts []tdiscovery.Option, ctx context.Context) []tdiscovery.Option {
+	newOpts := make([]tdiscovery.Option, 0, len(opts)+1)
+	newOpts = append(newOpts, opts...)
+	return append(newOpts, tdiscovery.WithContext(ctx))
+}
@@ -0,0 +1,227 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2023 Tencent.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package discovery
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	tdiscovery "trpc.group/trpc-go/trpc-go/naming/discovery"
+	tregistry "trpc.group/trpc-go/trpc-go/naming/registry"
+	etcderror "trpc.group/trpc-go/trpc-naming-etcd/error"
+	"trpc.group/trpc-go/trpc-naming-etcd/model"
+
+	. "github.com/glycerine/goconvey/convey"
+)
+
+// fakeDiscovery 返回固定节点的服务发现
+type fakeDiscovery struct {
+	mu       sync.Mutex
+	nodes    []*tregistry.Node
+	err      error
+	watchErr error
+	events   chan *Event
+	canceled bool
+}
+
+// List 获取节点
+func (f *fakeDiscovery) List(serviceName string, opts ...tdiscovery.Option) ([]*tregistry.Node, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.nodes, f.err
+}
+
+// Watch 订阅节点变更
+func (f *fakeDiscovery) Watch(serviceName string, opts ...tdiscovery.Option) (<-chan *Event, func(), error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.watchErr != nil {
+		return nil, nil, f.watchErr
+	}
+	f.events = make(chan *Event, 1)
+	f.events <- &Event{ServiceName: serviceName, Nodes: f.nodes}
+	events := f.events
+	return events, func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if !f.canceled {
+			f.canceled = true
+			close(events)
+		}
+	}, nil
+}
+
+// blockingDiscovery 模拟无法连接的集群，获取节点和订阅阻塞到 ctx 结束，ignoreCtx 为 true 时阻塞到 release 关闭
+type blockingDiscovery struct {
+	ignoreCtx bool
+	release   chan struct{}
+}
+
+// wait 阻塞直到超时或者 release 关闭
+func (b *blockingDiscovery) wait(opts ...tdiscovery.Option) error {
+	o := &tdiscovery.Options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if b.ignoreCtx {
+		<-b.release
+		return errors.New("etcd unavailable")
+	}
+	<-o.Ctx.Done()
+	return o.Ctx.Err()
+}
+
+// List 获取节点
+func (b *blockingDiscovery) List(serviceName string, opts ...tdiscovery.Option) ([]*tregistry.Node, error) {
+	return nil, b.wait(opts...)
+}
+
+// Watch 订阅节点变更
+func (b *blockingDiscovery) Watch(serviceName string, opts ...tdiscovery.Option) (<-chan *Event, func(), error) {
+	return nil, nil, b.wait(opts...)
+}
+
+// compositeNode 新建带 id 的节点
+func compositeNode(id, address string) *tregistry.Node {
+	return model.ConvertNode(&model.Node{Name: "service", ID: id, Address: address})
+}
+
+func TestCompositeDiscovery_List(t *testing.T) {
+	Convey("测试组合服务发现获取节点", t, func() {
+		_, err := NewCompositeDiscovery()
+		So(err, ShouldNotBeNil)
+
+		sh := &fakeDiscovery{nodes: []*tregistry.Node{compositeNode("a", "127.0.0.1:8000"),
+			compositeNode("b", "127.0.0.1:8001")}}
+		gz := &fakeDiscovery{nodes: []*tregistry.Node{compositeNode("b", "127.0.0.1:8001"),
+			compositeNode("c", "127.0.0.1:8002")}}
+		d, err := NewCompositeDiscovery(Cluster{Name: "sh", Discovery: sh}, Cluster{Name: "gz", Discovery: gz})
+		So(err, ShouldBeNil)
+
+		// 按 id 去重，标记来源集群，不修改原节点
+		nodes, err := d.List("service")
+		So(err, ShouldBeNil)
+		So(len(nodes), ShouldEqual, 3)
+		So(nodes[1].Metadata[MetadataKeyCluster], ShouldEqual, "sh")
+		So(nodes[2].Metadata[MetadataKeyCluster], ShouldEqual, "gz")
+		So(sh.nodes[0].Metadata[MetadataKeyCluster], ShouldBeNil)
+
+		// 部分集群不可用时使用其余集群的节点
+		sh.err = errors.New("etcd unavailable")
+		nodes, err = d.List("service")
+		So(err, ShouldBeNil)
+		So(len(nodes), ShouldEqual, 2)
+		So(nodes[0].Metadata[MetadataKeyCluster], ShouldEqual, "gz")
+
+		// 可用的集群都没有节点
+		gz.nodes, gz.err = emptyNodes, etcderror.ErrServerNotAvailable
+		_, err = d.List("service")
+		So(err, ShouldEqual, etcderror.ErrServerNotAvailable)
+
+		// 所有集群都不可用
+		gz.err = errors.New("etcd unavailable")
+		_, err = d.List("service")
+		So(err, ShouldEqual, sh.err)
+	})
+}
+
+func TestCompositeDiscovery_Watch(t *testing.T) {
+	Convey("测试组合服务发现订阅节点变更", t, func() {
+		sh := &fakeDiscovery{nodes: []*tregistry.Node{compositeNode("a", "127.0.0.1:8000")},
+			watchErr: errors.New("etcd unavailable")}
+		gz := &fakeDiscovery{nodes: []*tregistry.Node{compositeNode("b", "127.0.0.1:8001")}}
+		d, err := NewCompositeDiscovery(Cluster{Name: "sh", Discovery: sh}, Cluster{Name: "gz", Discovery: gz})
+		So(err, ShouldBeNil)
+		cd := d.(*CompositeDiscovery)
+		cd.retryInterval = 10 * time.Millisecond
+
+		// 部分集群订阅失败时使用其余集群的节点
+		events, cancel, err := cd.Watch("service")
+		So(err, ShouldBeNil)
+		event := <-events
+		So(len(event.Nodes), ShouldEqual, 1)
+		So(event.Nodes[0].Metadata[MetadataKeyCluster], ShouldEqual, "gz")
+
+		// 订阅失败的集群在后台重试成功后合并节点
+		sh.mu.Lock()
+		sh.watchErr = nil
+		sh.mu.Unlock()
+		event = <-events
+		So(len(event.Nodes), ShouldEqual, 2)
+		So(event.Nodes[0].Metadata[MetadataKeyCluster], ShouldEqual, "sh")
+
+		// 集群节点变化
+		gz.events <- &Event{ServiceName: "service", Nodes: emptyNodes}
+		event = <-events
+		So(len(event.Nodes), ShouldEqual, 1)
+		So(len(event.Changes), ShouldEqual, 1)
+		So(event.Changes[0].EventType, ShouldEqual, Delete)
+
+		cancel()
+		_, ok := <-events
+		So(ok, ShouldBeFalse)
+		So(sh.canceled, ShouldBeTrue)
+		So(gz.canceled, ShouldBeTrue)
+
+		// 所有集群都订阅失败
+		gz.watchErr = errors.New("etcd unavailable")
+		sh.watchErr = gz.watchErr
+		_, _, err = cd.Watch("service")
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestCompositeDiscovery_Timeout(t *testing.T) {
+	Convey("测试集群无法连接时不等待该集群", t, func() {
+		release := make(chan struct{})
+		defer close(release)
+		sh := &blockingDiscovery{}
+		bj := &blockingDiscovery{ignoreCtx: true, release: release}
+		gz := &fakeDiscovery{nodes: []*tregistry.Node{compositeNode("b", "127.0.0.1:8001")}}
+		d, err := NewCompositeDiscovery(Cluster{Name: "sh", Discovery: sh, Timeout: 50 * time.Millisecond},
+			Cluster{Name: "bj", Discovery: bj, Timeout: 50 * time.Millisecond},
+			Cluster{Name: "gz", Discovery: gz, Timeout: 50 * time.Millisecond})
+		So(err, ShouldBeNil)
+
+		// 调用方的超时时间更长时，按集群的超时时间返回其余集群的节点
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		start := time.Now()
+		nodes, err := d.List("service", tdiscovery.WithContext(ctx))
+		So(err, ShouldBeNil)
+		So(len(nodes), ShouldEqual, 1)
+		So(nodes[0].Metadata[MetadataKeyCluster], ShouldEqual, "gz")
+		So(time.Since(start), ShouldBeLessThan, time.Second)
+
+		start = time.Now()
+		events, stop, err := d.(*CompositeDiscovery).Watch("service", tdiscovery.WithContext(ctx))
+		So(err, ShouldBeNil)
+		defer stop()
+		So(time.Since(start), ShouldBeLessThan, time.Second)
+		event := <-events
+		So(len(event.Nodes), ShouldEqual, 1)
+		So(event.Nodes[0].Metadata[MetadataKeyCluster], ShouldEqual, "gz")
+
+		// 所有集群都超时
+		d, err = NewCompositeDiscovery(Cluster{Name: "sh", Discovery: sh, Timeout: 50 * time.Millisecond})
+		So(err, ShouldBeNil)
+		_, err = d.List("service")
+		So(err, ShouldNotBeNil)
+		_, _, err = d.(*CompositeDiscovery).Watch("service")
+		So(err, ShouldNotBeNil)
+	})
+}
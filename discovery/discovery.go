@@ -15,12 +15,16 @@
 package discovery
 
 import (
+	"context"
 	"sync"
+	"time"
 
 	"trpc.group/trpc-go/trpc-go/log"
 	tdiscovery "trpc.group/trpc-go/trpc-go/naming/discovery"
 	tregistry "trpc.group/trpc-go/trpc-go/naming/registry"
 	"trpc.group/trpc-go/trpc-naming-etcd/client"
+	etcderror "trpc.group/trpc-go/trpc-naming-etcd/error"
+	"trpc.group/trpc-go/trpc-naming-etcd/internal/metrics"
 	"trpc.group/trpc-go/trpc-naming-etcd/model"
 
 	clientv3 "go.etcd.io/etcd/client/v3"
@@ -33,8 +37,24 @@ var (
 
 // Config 配置
 type Config struct {
+	// Name 插件名，作为监控指标的维度区分不同插件
+	Name string
 	// Prefix 注册前缀
 	Prefix string
+	// SnapshotFile 本地快照文件路径，etcd 不可用时使用快照中的节点，为空时不开启
+	SnapshotFile string
+	// SnapshotInterval 快照写入间隔，默认 30 秒
+	SnapshotInterval time.Duration
+	// SnapshotMaxStaleness 快照最大可用时长，超过后不再使用，0 表示不限制
+	SnapshotMaxStaleness time.Duration
+	// CacheExpire 缓存过期时间，默认 30 秒
+	CacheExpire time.Duration
+	// StaleWhileError 为 true 时缓存过期后如果从 etcd 获取失败，继续使用过期的缓存，并在后台重试刷新
+	StaleWhileError bool
+	// RetryInterval watch 断开或者后台刷新失败后首次重试的等待时间，之后指数增长，默认 500 毫秒
+	RetryInterval time.Duration
+	// MaxRetryInterval 重试的最大等待时间，默认 30 秒
+	MaxRetryInterval time.Duration
 }
 
 // Discovery 服务发现
@@ -42,15 +62,20 @@ type Discovery struct {
 	sync.RWMutex
 	cache      *cache
 	sg         singleflight.Group
-	etcdClient *clientv3.Client
+	etcdClient client.KV
 	cfg        *Config
+	// refreshing 正在后台刷新的服务
+	refreshing map[string]bool
 }
 
 // NewDiscovery 新建etcd服务发现
-func NewDiscovery(etcdClient *clientv3.Client, cfg *Config) (tdiscovery.Discovery, error) {
+func NewDiscovery(etcdClient client.Etcd, cfg *Config) (tdiscovery.Discovery, error) {
 	if cfg.Prefix == "" {
 		cfg.Prefix = client.DefaultEtcdPrefix
 	}
+	if cfg.CacheExpire <= 0 {
+		cfg.CacheExpire = defaultCacheExpire
+	}
 	c, err := newCache(etcdClient, cfg)
 	if err != nil {
 		return nil, err
@@ -59,40 +84,200 @@ func NewDiscovery(etcdClient *clientv3.Client, cfg *Config) (tdiscovery.Discover
 		cache:      c,
 		etcdClient: etcdClient,
 		cfg:        cfg,
+		refreshing: make(map[string]bool),
 	}
 
 	return e, nil
 }
 
+// Close 停止 watch 和后台刷新，关闭所有订阅，之后不再更新缓存
+func (d *Discovery) Close() {
+	d.cache.stop()
+}
+
 // List 获取serviceName的节点
 func (d *Discovery) List(serviceName string, opts ...tdiscovery.Option) ([]*tregistry.Node, error) {
 	nodes, err := d.cache.List(serviceName, opts...)
 	if err != nil {
+		metrics.Incr(metrics.DiscoveryListFail)
 		return nil, err
 	}
 	if len(nodes) > 0 {
+		metrics.Incr(metrics.DiscoveryCacheHit)
 		return nodes, nil
 	}
+	// 后台正在刷新，说明 etcd 不可用，直接使用过期的缓存
+	if d.cfg.StaleWhileError && d.isRefreshing(serviceName) {
+		if nodes, ok := d.cache.stale(serviceName); ok {
+			metrics.Incr(metrics.DiscoveryStale)
+			return staleResult(nodes)
+		}
+	}
 	// 缓存没找到，去etcd获取
+	metrics.Incr(metrics.DiscoveryCacheMiss)
 	val, err, _ := d.sg.Do(serviceName, func() (interface{}, error) {
 		version, nodes, e := d.listFromEtcd(serviceName, opts...)
 		if e != nil {
-			return nil, e
+			return d.fallback(serviceName, e)
 		}
 		cacheErr := d.cache.cache(serviceName, version, nodes)
 		// 如果缓存返回数据过期，代表获取节点期间服务有更新，删除缓存下一次重新获取
 		if cacheErr == errStaleData {
-			d.cache.invalidCache(serviceName)
+			d.invalidate(serviceName)
 		}
 		return nodes, nil
 	})
 	if err != nil {
+		metrics.Incr(metrics.DiscoveryListFail)
 		log.Errorf("get %s node from etcd fail, err = %v", serviceName, err)
 		return nil, err
 	}
 	return val.([]*tregistry.Node), nil
 }
 
+// IsStale 判断 serviceName 当前是否在使用过期的缓存
+func (d *Discovery) IsStale(serviceName string) bool {
+	return d.cache.isStale(serviceName)
+}
+
+// fallback etcd 获取失败时兜底，优先使用过期的缓存，其次使用本地快照
+func (d *Discovery) fallback(serviceName string, err error) (interface{}, error) {
+	if d.cfg.StaleWhileError {
+		if nodes, ok := d.cache.stale(serviceName); ok {
+			log.Warnf("get %s node from etcd fail, use stale cache instead, err = %v", serviceName, err)
+			metrics.Incr(metrics.DiscoveryStale)
+			d.refresh(serviceName)
+			return staleResult(nodes)
+		}
+	}
+	// etcd 不可用时使用本地快照兜底，快照中的节点写入缓存并在后台刷新，之后的调用直接从缓存返回
+	if nodes, ok := d.cache.restore(serviceName); ok {
+		log.Warnf("get %s node from etcd fail, use snapshot instead, err = %v", serviceName, err)
+		metrics.Incr(metrics.DiscoveryStale)
+		d.refresh(serviceName)
+		return staleResult(nodes)
+	}
+	return nil, err
+}
+
+// staleResult 返回过期缓存或者快照中的节点，与缓存一致，服务没有节点时返回服务不可用
+func staleResult(nodes []*tregistry.Node) ([]*tregistry.Node, error) {
+	if len(nodes) == 0 {
+		return nil, etcderror.ErrServerNotAvailable
+	}
+	return nodes, nil
+}
+
+// invalidate 删除服务缓存，服务有订阅者时立即从 etcd 重新获取，开启 StaleWhileError 时失败后在后台重试
+func (d *Discovery) invalidate(serviceName string) {
+	if !d.cache.invalidCache(serviceName) {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), client.DefaultTimeout)
+		defer cancel()
+		if _, err := d.Resync(ctx, serviceName); err != nil {
+			log.Tracef("refetch %s node after invalidation fail, err = %v", serviceName, err)
+			if d.cfg.StaleWhileError {
+				d.refresh(serviceName)
+			}
+		}
+	}()
+}
+
+// isRefreshing 判断 serviceName 是否正在后台刷新
+func (d *Discovery) isRefreshing(serviceName string) bool {
+	d.RLock()
+	defer d.RUnlock()
+	return d.refreshing[serviceName]
+}
+
+// refresh 在后台按退避策略重试从 etcd 获取 serviceName 的节点，直到成功或者缓存停止
+func (d *Discovery) refresh(serviceName string) {
+	d.Lock()
+	if d.refreshing[serviceName] {
+		d.Unlock()
+		return
+	}
+	d.refreshing[serviceName] = true
+	d.Unlock()
+
+	go func() {
+		defer func() {
+			d.Lock()
+			delete(d.refreshing, serviceName)
+			d.Unlock()
+		}()
+		b := d.cfg.retryBackOff()
+		for {
+			timer := time.NewTimer(b.NextBackOff())
+			select {
+			case <-timer.C:
+			case <-d.cache.exit:
+				timer.Stop()
+				return
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), client.DefaultTimeout)
+			version, nodes, err := d.listFromEtcd(serviceName, tdiscovery.WithContext(ctx))
+			cancel()
+			if err != nil {
+				log.Tracef("refresh %s node from etcd fail, err = %v", serviceName, err)
+				continue
+			}
+			// 数据过期时重试，不删除缓存，保证过期的缓存一直可用
+			if d.cache.cache(serviceName, version, nodes) == nil {
+				return
+			}
+		}
+	}()
+}
+
+// Watch 订阅 serviceName 的节点变更，返回的通道首先收到一次全量节点，之后每次节点变化收到一次通知，
+// 消费不及时的多次变更会合并为一次通知。调用返回的取消函数后通道会被关闭
+func (d *Discovery) Watch(serviceName string, opts ...tdiscovery.Option) (<-chan *Event, func(), error) {
+	sub := newSubscriber(serviceName)
+	d.cache.subscribe(sub)
+	cancel := func() {
+		d.cache.unsubscribe(sub)
+	}
+	// 获取全量节点，同时标记关注该服务，没有指定 ctx 时使用默认超时，避免 etcd 不可用时一直阻塞
+	o := &tdiscovery.Options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.Ctx == nil {
+		ctx, cancelCtx := context.WithTimeout(context.Background(), client.DefaultTimeout)
+		defer cancelCtx()
+		opts = append(opts, tdiscovery.WithContext(ctx))
+	}
+	nodes, err := d.List(serviceName, opts...)
+	if err != nil && err != etcderror.ErrServerNotAvailable {
+		cancel()
+		return nil, nil, err
+	}
+	if nodes == nil {
+		nodes = emptyNodes
+	}
+	sub.init(nodes)
+	return sub.events, cancel, nil
+}
+
+// Subscribe 订阅 serviceName 的节点变更，节点变化时在独立的协程中依次调用 callback，
+// 返回取消订阅的函数
+func (d *Discovery) Subscribe(serviceName string, callback func(*Event),
+	opts ...tdiscovery.Option) (func(), error) {
+	events, cancel, err := d.Watch(serviceName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for event := range events {
+			callback(event)
+		}
+	}()
+	return cancel, nil
+}
+
 // listFromEtcd 获取serviceName在注册中心注册的节点
 func (d *Discovery) listFromEtcd(serviceName string, opts ...tdiscovery.Option) (int64, []*tregistry.Node, error) {
 	o := &tdiscovery.Options{}
@@ -101,12 +286,18 @@ func (d *Discovery) listFromEtcd(serviceName string, opts ...tdiscovery.Option)
 	}
 
 	// 从etcd获取
-	rsp, err := d.etcdClient.Get(o.Ctx, model.ServicePath(d.cfg.Prefix, serviceName), clientv3.WithPrefix())
+	servicePath := model.ServicePath(d.cfg.Prefix, serviceName)
+	start := time.Now()
+	rsp, err := d.etcdClient.Get(o.Ctx, servicePath, clientv3.WithPrefix())
+	metrics.ObserveEtcd(metrics.EtcdGet, start, err)
 	if err != nil {
 		return 0, nil, err
 	}
 	var services []*tregistry.Node
 	for _, n := range rsp.Kvs {
+		if !model.IsServiceNode(servicePath, string(n.Key)) {
+			continue
+		}
 		node, err := model.Unmarshal(n.Value)
 		if err != nil {
 			log.Errorf("unmarshal node fail, err: %s\n", err.Error())
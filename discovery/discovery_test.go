@@ -16,184 +16,348 @@ package discovery
 
 import (
 	"context"
-	"math/rand"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	tdiscovery "trpc.group/trpc-go/trpc-go/naming/discovery"
+	"trpc.group/trpc-go/trpc-naming-etcd/client"
+	"trpc.group/trpc-go/trpc-naming-etcd/client/fake"
+	etcderror "trpc.group/trpc-go/trpc-naming-etcd/error"
 	"trpc.group/trpc-go/trpc-naming-etcd/model"
 
-	"go.etcd.io/etcd/api/v3/etcdserverpb"
-	"go.etcd.io/etcd/api/v3/mvccpb"
 	clientv3 "go.etcd.io/etcd/client/v3"
 
 	. "github.com/glycerine/goconvey/convey"
 )
 
-// etcdLease 实现etcd Lease接口
-type etcdLease struct {
+// discoveryEtcd 在内存 etcd 上模拟读取失败，记录最近一次读取的 key 和 ctx
+type discoveryEtcd struct {
+	*fake.Etcd
+	mu     sync.Mutex
+	getErr error
+	getKey string
+	getCtx context.Context
 }
 
-// Grant 分配租约
-func (e *etcdLease) Grant(ctx context.Context, ttl int64) (*clientv3.LeaseGrantResponse, error) {
-	return &clientv3.LeaseGrantResponse{
-		ID:  clientv3.LeaseID(rand.Int()),
-		TTL: ttl,
-	}, nil
-}
-
-// Revoke 移除租约
-func (e *etcdLease) Revoke(ctx context.Context, id clientv3.LeaseID) (*clientv3.LeaseRevokeResponse, error) {
-	return &clientv3.LeaseRevokeResponse{}, nil
-}
-
-// TimeToLive 获取租约
-func (e *etcdLease) TimeToLive(ctx context.Context, id clientv3.LeaseID,
-	opts ...clientv3.LeaseOption) (*clientv3.LeaseTimeToLiveResponse, error) {
-	return &clientv3.LeaseTimeToLiveResponse{}, nil
+// newDiscoveryEtcd 新建写入了 test 服务一个节点的内存 etcd
+func newDiscoveryEtcd() *discoveryEtcd {
+	e := &discoveryEtcd{Etcd: fake.New()}
+	node := &model.Node{
+		Name:     "test",
+		ID:       model.ServiceID("127.0.0.1", "8080", "123"),
+		Address:  "127.0.0.1:8080",
+		Metadata: map[string]string{"key": "value"},
+		Weight:   100,
+	}
+	value, _ := model.Marshal(node)
+	_, _ = e.Put(context.Background(), model.NodePath(client.DefaultEtcdPrefix, node.Name, node.ID), value)
+	return e
 }
 
-// Leases 获取所有租约
-func (e *etcdLease) Leases(ctx context.Context) (*clientv3.LeaseLeasesResponse, error) {
-	return &clientv3.LeaseLeasesResponse{}, nil
+// setGetErr 设置读取返回的错误，为 nil 时恢复正常
+func (e *discoveryEtcd) setGetErr(err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.getErr = err
 }
 
-// KeepAlive 监听keepAlive
-func (e *etcdLease) KeepAlive(ctx context.Context, id clientv3.LeaseID) (<-chan *clientv3.LeaseKeepAliveResponse,
+// Get 读取 key
+func (e *discoveryEtcd) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse,
 	error) {
-	ch := make(chan *clientv3.LeaseKeepAliveResponse, 10)
-	ch <- &clientv3.LeaseKeepAliveResponse{
-		ID: id,
+	e.mu.Lock()
+	err := e.getErr
+	e.getKey = key
+	e.getCtx = ctx
+	e.mu.Unlock()
+	if err != nil {
+		return nil, err
 	}
-	return ch, nil
+	return e.Etcd.Get(ctx, key, opts...)
 }
 
-// KeepAliveOnce keepAlive一次
-func (e *etcdLease) KeepAliveOnce(ctx context.Context, id clientv3.LeaseID) (*clientv3.LeaseKeepAliveResponse, error) {
-	return &clientv3.LeaseKeepAliveResponse{
-		ID: id,
-	}, nil
+// newEtcdRegistry 新建使用内存 etcd 的服务发现
+func newEtcdRegistry() *Discovery {
+	r, _ := NewDiscovery(newDiscoveryEtcd(), &Config{})
+	return r.(*Discovery)
 }
 
-// Close 关闭
-func (e *etcdLease) Close() error {
-	return nil
-}
+func TestEtcdDiscovery_List(t *testing.T) {
+	Convey("测试registry的List函数", t, func() {
+		r := newEtcdRegistry()
+		defer r.Close()
+		nodes, err := r.List("test", tdiscovery.WithContext(context.Background()))
+		So(err, ShouldBeNil)
+		So(len(nodes), ShouldNotEqual, 0)
+	})
 
-// newLease 新建一个Lease，实现etcd的Lease接口
-func newLease() clientv3.Lease {
-	return &etcdLease{}
 }
 
-// registryWatcher 实现etcd的Watcher接口
-type registryWatcher struct {
-}
+func TestEtcdDiscovery_Watch(t *testing.T) {
+	Convey("测试订阅服务节点变更", t, func() {
+		r := newEtcdRegistry()
+		defer r.Close()
+		events, cancel, err := r.Watch("test")
+		So(err, ShouldBeNil)
 
-// Watch 关注key变化
-func (c *registryWatcher) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
-	return make(chan clientv3.WatchResponse, 1)
-}
+		// 首次收到全量节点
+		event := <-events
+		So(event.ServiceName, ShouldEqual, "test")
+		So(len(event.Nodes), ShouldEqual, 1)
+		So(len(event.Changes), ShouldEqual, 1)
+		So(event.Changes[0].EventType, ShouldEqual, Create)
+		// 没有指定 ctx 时使用默认超时获取全量节点
+		e := r.etcdClient.(*discoveryEtcd)
+		e.mu.Lock()
+		_, ok := e.getCtx.Deadline()
+		e.mu.Unlock()
+		So(ok, ShouldBeTrue)
+		// 使用调用方指定的 ctx
+		_, cancelOther, err := r.Watch("other", tdiscovery.WithContext(context.Background()))
+		So(err, ShouldBeNil)
+		cancelOther()
+		e.mu.Lock()
+		_, ok = e.getCtx.Deadline()
+		e.mu.Unlock()
+		So(ok, ShouldBeFalse)
 
-// RequestProgress 请求处理
-func (c *registryWatcher) RequestProgress(ctx context.Context) error {
-	return nil
-}
+		newNode := &model.Node{
+			Name:    "test",
+			ID:      model.ServiceID("127.0.0.1", "8081", "123"),
+			Address: "127.0.0.1:8081",
+		}
+		r.cache.update(&watchResult{
+			Version: r.cache.version + 1,
+			Events:  []*watchEvent{{EventType: Create, Node: newNode}},
+		})
+		event = <-events
+		So(len(event.Nodes), ShouldEqual, 2)
+		So(len(event.Changes), ShouldEqual, 1)
+		So(event.Changes[0].EventType, ShouldEqual, Create)
+		So(event.Changes[0].Node.Address, ShouldEqual, "127.0.0.1:8081")
 
-// Close 关闭clientWatcher
-func (c *registryWatcher) Close() error {
-	return nil
-}
+		// 未及时消费的多次变更合并为一次通知
+		newNode.Weight = 10
+		r.cache.update(&watchResult{
+			Version: r.cache.version + 1,
+			Events:  []*watchEvent{{EventType: Update, Node: newNode}},
+		})
+		r.cache.update(&watchResult{
+			Version: r.cache.version + 1,
+			Events:  []*watchEvent{{EventType: Delete, Node: &model.Node{Name: "test", Address: "127.0.0.1:8080"}}},
+		})
+		event = <-events
+		So(len(event.Nodes), ShouldEqual, 1)
+		So(len(event.Changes), ShouldEqual, 2)
+		So(event.Changes[0].EventType, ShouldEqual, Update)
+		So(event.Changes[0].Node.Weight, ShouldEqual, 10)
+		So(event.Changes[1].EventType, ShouldEqual, Delete)
+		So(event.Changes[1].Node.Address, ShouldEqual, "127.0.0.1:8080")
 
-// registryKv 实现etcd的KV接口
-type registryKv struct {
+		// 取消订阅后通道关闭
+		cancel()
+		_, ok = <-events
+		So(ok, ShouldBeFalse)
+	})
 }
 
-// Put 存储kv
-func (r *registryKv) Put(ctx context.Context, key, val string,
-	opts ...clientv3.OpOption) (*clientv3.PutResponse, error) {
-	return &clientv3.PutResponse{}, nil
+func TestEtcdDiscovery_Subscribe(t *testing.T) {
+	Convey("测试回调方式订阅服务节点变更", t, func() {
+		r := newEtcdRegistry()
+		defer r.Close()
+		events := make(chan *Event, 1)
+		unsubscribe, err := r.Subscribe("test", func(event *Event) {
+			events <- event
+		})
+		So(err, ShouldBeNil)
+		event := <-events
+		So(len(event.Nodes), ShouldEqual, 1)
+		unsubscribe()
+		// 可以多次取消
+		unsubscribe()
+	})
 }
 
-// Get 获取kv
-func (r *registryKv) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
-	node := &model.Node{
-		Name:     "test",
-		ID:       model.ServiceID("127.0.0.1", "8080", "123"),
-		Address:  "127.0.0.1:8080",
-		Metadata: map[string]string{"key": "value"},
-		Weight:   100,
-	}
-	value, _ := model.Marshal(node)
-	return &clientv3.GetResponse{
-		Kvs: []*mvccpb.KeyValue{
-			{
-				Key:            []byte(key),
-				CreateRevision: 100,
-				ModRevision:    100,
-				Value:          []byte(value),
-			},
-		},
-		Header: &etcdserverpb.ResponseHeader{
-			Revision: rand.Int63(),
-		},
-	}, nil
-}
+func TestEtcdDiscovery_ListSnapshot(t *testing.T) {
+	Convey("测试etcd不可用时使用本地快照", t, func() {
+		dir, err := ioutil.TempDir("", "snapshot")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		file := filepath.Join(dir, "discovery.json")
 
-// Delete 删除kv
-func (r *registryKv) Delete(ctx context.Context, key string,
-	opts ...clientv3.OpOption) (*clientv3.DeleteResponse, error) {
-	return &clientv3.DeleteResponse{}, nil
-}
+		// 正常运行时写入快照
+		c := newDiscoveryEtcd()
+		defer c.Close()
+		d, err := NewDiscovery(c, &Config{SnapshotFile: file, SnapshotInterval: time.Hour})
+		So(err, ShouldBeNil)
+		r := d.(*Discovery)
+		nodes, err := r.List("test", tdiscovery.WithContext(context.Background()))
+		So(err, ShouldBeNil)
+		So(len(nodes), ShouldEqual, 1)
+		// watch 未连接时不写入快照
+		r.cache.saveSnapshot()
+		_, err = os.Stat(file)
+		So(os.IsNotExist(err), ShouldBeTrue)
+		atomic.StoreInt32(&r.cache.watcher.connected, 1)
+		r.cache.saveSnapshot()
+		r.cache.stop()
+		// 快照中记录了写入时缓存的数据版本和没有节点的服务
+		s, err := loadSnapshot(file)
+		So(err, ShouldBeNil)
+		So(s.Revision, ShouldEqual, c.Revision())
+		s.Services["empty"] = newSnapshotService(emptyNodes, time.Now())
+		s.Services["newer"] = s.Services["test"]
+		So(s.save(file), ShouldBeNil)
 
-// Compact 压缩kv历史
-func (r *registryKv) Compact(ctx context.Context, rev int64,
-	opts ...clientv3.CompactOption) (*clientv3.CompactResponse, error) {
-	return &clientv3.CompactResponse{}, nil
-}
+		// 重启后 etcd 不可用，使用快照
+		c.setGetErr(errors.New("etcd unavailable"))
+		d, err = NewDiscovery(c, &Config{SnapshotFile: file, SnapshotMaxStaleness: time.Minute,
+			RetryInterval: 10 * time.Millisecond})
+		So(err, ShouldBeNil)
+		r = d.(*Discovery)
+		defer r.Close()
+		nodes, err = r.List("test", tdiscovery.WithContext(context.Background()))
+		So(err, ShouldBeNil)
+		So(len(nodes), ShouldEqual, 1)
+		So(nodes[0].Address, ShouldEqual, "127.0.0.1:8080")
+		// 快照中的节点写入缓存并在后台刷新，之后直接从缓存返回
+		So(r.IsStale("test"), ShouldBeTrue)
+		So(r.isRefreshing("test"), ShouldBeTrue)
+		nodes, err = r.cache.List("test")
+		So(err, ShouldBeNil)
+		So(len(nodes), ShouldEqual, 1)
+		// 快照中没有的服务仍然报错
+		_, err = r.List("test1", tdiscovery.WithContext(context.Background()))
+		So(err, ShouldNotBeNil)
+		// 快照中服务没有节点时与缓存一致返回服务不可用
+		_, err = r.List("empty", tdiscovery.WithContext(context.Background()))
+		So(err, ShouldEqual, etcderror.ErrServerNotAvailable)
+		// 缓存中已经有比快照新的数据时不使用快照
+		r.cache.Lock()
+		r.cache.versions["newer"] = s.Revision + 1
+		r.cache.Unlock()
+		_, err = r.List("newer", tdiscovery.WithContext(context.Background()))
+		So(err, ShouldNotBeNil)
+		So(err, ShouldNotEqual, etcderror.ErrServerNotAvailable)
 
-// Do 不使用事务执行op
-func (r *registryKv) Do(ctx context.Context, op clientv3.Op) (clientv3.OpResponse, error) {
-	return clientv3.OpResponse{}, nil
-}
+		// 从快照恢复的服务写入快照时保留之前的快照
+		atomic.StoreInt32(&r.cache.watcher.connected, 1)
+		r.cache.saveSnapshot()
+		saved, err := loadSnapshot(file)
+		So(err, ShouldBeNil)
+		So(saved.Services["test"].UpdatedAt.Equal(s.Services["test"].UpdatedAt), ShouldBeTrue)
 
-// Txn 事务操作
-func (r *registryKv) Txn(ctx context.Context) clientv3.Txn {
-	return nil
+		// etcd 恢复后后台刷新成功，不再使用快照
+		c.setGetErr(nil)
+		for i := 0; i < 100 && r.IsStale("test"); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		So(r.IsStale("test"), ShouldBeFalse)
+	})
 }
 
-// newDiscoveryEtcdClient 获取etcd客户端
-func newDiscoveryEtcdClient() *clientv3.Client {
-	client, _ := clientv3.New(clientv3.Config{
-		Endpoints: []string{"127.0.0.1:2379"},
+func TestEtcdDiscovery_ListStale(t *testing.T) {
+	Convey("测试缓存过期后etcd不可用时使用过期缓存", t, func() {
+		c := newDiscoveryEtcd()
+		defer c.Close()
+		d, err := NewDiscovery(c, &Config{CacheExpire: time.Minute, StaleWhileError: true,
+			RetryInterval: 10 * time.Millisecond})
+		So(err, ShouldBeNil)
+		r := d.(*Discovery)
+		nodes, err := r.List("test", tdiscovery.WithContext(context.Background()))
+		So(err, ShouldBeNil)
+		So(len(nodes), ShouldEqual, 1)
+		So(r.cache.expires["test"].Sub(time.Now()), ShouldBeGreaterThan, 50*time.Second)
+		So(r.IsStale("test"), ShouldBeFalse)
+
+		// 缓存过期且 etcd 不可用
+		r.cache.Lock()
+		r.cache.expires["test"] = time.Now().Add(-time.Second)
+		r.cache.Unlock()
+		c.setGetErr(errors.New("etcd unavailable"))
+		nodes, err = r.List("test", tdiscovery.WithContext(context.Background()))
+		So(err, ShouldBeNil)
+		So(len(nodes), ShouldEqual, 1)
+		So(r.IsStale("test"), ShouldBeTrue)
+		So(r.isRefreshing("test"), ShouldBeTrue)
+		// 后台刷新期间直接使用过期缓存
+		nodes, err = r.List("test", tdiscovery.WithContext(context.Background()))
+		So(err, ShouldBeNil)
+		So(len(nodes), ShouldEqual, 1)
+
+		// etcd 恢复后后台刷新成功
+		c.setGetErr(nil)
+		for i := 0; i < 500 && r.isRefreshing("test"); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		So(r.isRefreshing("test"), ShouldBeFalse)
+		So(r.IsStale("test"), ShouldBeFalse)
+
+		// 过期缓存中服务没有节点时返回服务不可用
+		_, err = r.List("empty", tdiscovery.WithContext(context.Background()))
+		So(err, ShouldBeNil)
+		r.cache.Lock()
+		r.cache.expires["empty"] = time.Now().Add(-time.Second)
+		r.cache.Unlock()
+		c.setGetErr(errors.New("etcd unavailable"))
+		_, err = r.List("empty", tdiscovery.WithContext(context.Background()))
+		So(err, ShouldEqual, etcderror.ErrServerNotAvailable)
+		So(r.isRefreshing("empty"), ShouldBeTrue)
+		_, err = r.List("empty", tdiscovery.WithContext(context.Background()))
+		So(err, ShouldEqual, etcderror.ErrServerNotAvailable)
+		r.cache.stop()
 	})
-	client.Watcher = newDiscoveryWatcher()
-	client.Lease = newLease()
-	client.KV = newRegistryKv()
-	return client
-}
 
-// newRegistryKv 新建一个watcher，实现etcd的KV接口
-func newRegistryKv() clientv3.KV {
-	return &registryKv{}
-}
+	Convey("没有开启 StaleWhileError 时不使用过期缓存，也不在后台刷新", t, func() {
+		c := newDiscoveryEtcd()
+		defer c.Close()
+		d, err := NewDiscovery(c, &Config{RetryInterval: 10 * time.Millisecond})
+		So(err, ShouldBeNil)
+		r := d.(*Discovery)
+		defer r.Close()
+		events, cancel, err := r.Watch("test")
+		So(err, ShouldBeNil)
+		defer cancel()
+		<-events
 
-// newDiscoveryWatcher 新建一个watcher，实现etcd的watcher接口
-func newDiscoveryWatcher() clientv3.Watcher {
-	return &cacheWatcher{}
-}
+		// 有订阅者的服务删除缓存后重新获取失败
+		c.setGetErr(errors.New("etcd unavailable"))
+		r.invalidate("test")
+		time.Sleep(50 * time.Millisecond)
+		So(r.isRefreshing("test"), ShouldBeFalse)
+		_, err = r.List("test", tdiscovery.WithContext(context.Background()))
+		So(err, ShouldNotBeNil)
 
-// newEtcdRegistry 新建etcd注册客户端
-func newEtcdRegistry() *Discovery {
-	c := newDiscoveryEtcdClient()
-	r, _ := NewDiscovery(c, &Config{})
-	return r.(*Discovery)
+		// 其他原因在后台刷新时也不使用过期缓存
+		r.refresh("test")
+		_, err = r.List("test", tdiscovery.WithContext(context.Background()))
+		So(err, ShouldNotBeNil)
+	})
 }
 
-func TestEtcdDiscovery_List(t *testing.T) {
-	Convey("测试registry的List函数", t, func() {
-		r := newEtcdRegistry()
-		nodes, err := r.List("test", tdiscovery.WithContext(context.Background()))
+func TestEtcdDiscovery_listFromEtcd(t *testing.T) {
+	Convey("测试只获取服务目录下的节点，不会匹配到名字前缀相同的其他服务", t, func() {
+		c := newDiscoveryEtcd()
+		defer c.Close()
+		for _, service := range []string{"trpc.app.Greeter", "trpc.app.Greeter2"} {
+			value, _ := model.Marshal(&model.Node{Name: service, Address: "127.0.0.1:8080"})
+			_, err := c.Put(context.Background(), model.NodePath("/registry", service, "id"), value)
+			So(err, ShouldBeNil)
+		}
+		d, err := NewDiscovery(c, &Config{Prefix: "/registry"})
 		So(err, ShouldBeNil)
-		So(len(nodes), ShouldNotEqual, 0)
+		defer d.(*Discovery).Close()
+		_, nodes, err := d.(*Discovery).listFromEtcd("trpc.app.Greeter", tdiscovery.WithContext(context.Background()))
+		So(err, ShouldBeNil)
+		c.mu.Lock()
+		So(c.getKey, ShouldEqual, "/registry/trpc.app.Greeter/")
+		c.mu.Unlock()
+		So(len(nodes), ShouldEqual, 1)
+		So(nodes[0].ServiceName, ShouldEqual, "trpc.app.Greeter")
 	})
-
 }
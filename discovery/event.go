@@ -13,6 +13,10 @@
 
 package discovery
 
+import (
+	tregistry "trpc.group/trpc-go/trpc-go/naming/registry"
+)
+
 // EventType is the type of event
 //
 //go:generate stringer -type EventType -linecomment=true
@@ -28,3 +32,21 @@ const (
 	// Update is the update event type
 	Update
 )
+
+// NodeChange 单个节点的变更
+type NodeChange struct {
+	// EventType 变更类型
+	EventType EventType
+	// Node 变更的节点，删除时为删除前的节点
+	Node *tregistry.Node
+}
+
+// Event 服务节点变更通知
+type Event struct {
+	// ServiceName 服务名
+	ServiceName string
+	// Nodes 变更后服务的全量节点
+	Nodes []*tregistry.Node
+	// Changes 与上一次通知相比发生变更的节点，首次通知时全部为 Create
+	Changes []*NodeChange
+}
@@ -0,0 +1,161 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2025 Tencent.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package discovery
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	tregistry "trpc.group/trpc-go/trpc-go/naming/registry"
+	"trpc.group/trpc-go/trpc-naming-etcd/model"
+)
+
+const (
+	// defaultSnapshotInterval 默认快照写入间隔
+	defaultSnapshotInterval = 30 * time.Second
+)
+
+// snapshot 服务发现缓存的本地快照，etcd 不可用时兜底使用
+type snapshot struct {
+	// Revision 写入快照时缓存的 etcd 数据版本，服务缓存的数据比快照新时不使用快照
+	Revision int64 `json:"revision"`
+	// Services 服务节点
+	Services map[string]*snapshotService `json:"services"`
+}
+
+// snapshotService 单个服务的快照
+type snapshotService struct {
+	// UpdatedAt 最后一次确认与 etcd 一致的时间
+	UpdatedAt time.Time `json:"updated_at"`
+	// Nodes 服务节点
+	Nodes []*snapshotNode `json:"nodes"`
+}
+
+// snapshotNode 快照中的节点，只保存 tregistry.Node 中可序列化的字段
+type snapshotNode struct {
+	ServiceName string                 `json:"service_name"`
+	Address     string                 `json:"address"`
+	Network     string                 `json:"network,omitempty"`
+	Protocol    string                 `json:"protocol,omitempty"`
+	SetName     string                 `json:"set_name,omitempty"`
+	Weight      int                    `json:"weight"`
+	Metadata    map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// loadSnapshot 从文件加载快照
+func loadSnapshot(file string) (*snapshot, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	s := &snapshot{}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, err
+	}
+	if s.Services == nil {
+		s.Services = make(map[string]*snapshotService)
+	}
+	for _, service := range s.Services {
+		for _, n := range service.Nodes {
+			restoreMetadata(n.Metadata)
+		}
+	}
+	return s, nil
+}
+
+// restoreMetadata 恢复 json 反序列化后类型发生变化的元数据
+func restoreMetadata(meta map[string]interface{}) {
+	if values, ok := meta[model.MetadataKeyTags].([]interface{}); ok {
+		tags := make([]string, 0, len(values))
+		for _, v := range values {
+			if tag, ok := v.(string); ok {
+				tags = append(tags, tag)
+			}
+		}
+		meta[model.MetadataKeyTags] = tags
+	}
+	if v, ok := meta[model.MetadataKeyStartTime].(string); ok {
+		if startTime, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			meta[model.MetadataKeyStartTime] = startTime
+		}
+	}
+}
+
+// save 将快照写入文件，先写临时文件再重命名，避免写入中断导致快照损坏
+func (s *snapshot) save(file string) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// nodes 获取服务在快照中的节点，超过 maxStaleness 的快照不可用，maxStaleness 为 0 表示不限制
+func (s *snapshot) nodes(serviceName string, maxStaleness time.Duration) ([]*tregistry.Node, bool) {
+	service, ok := s.Services[serviceName]
+	if !ok {
+		return nil, false
+	}
+	if maxStaleness > 0 && time.Since(service.UpdatedAt) > maxStaleness {
+		return nil, false
+	}
+	nodes := make([]*tregistry.Node, 0, len(service.Nodes))
+	for _, n := range service.Nodes {
+		nodes = append(nodes, &tregistry.Node{
+			ServiceName: n.ServiceName,
+			Address:     n.Address,
+			Network:     n.Network,
+			Protocol:    n.Protocol,
+			SetName:     n.SetName,
+			Weight:      n.Weight,
+			Metadata:    n.Metadata,
+		})
+	}
+	return nodes, true
+}
+
+// newSnapshotService 根据缓存的节点生成服务快照
+func newSnapshotService(nodes []*tregistry.Node, updatedAt time.Time) *snapshotService {
+	service := &snapshotService{
+		UpdatedAt: updatedAt,
+		Nodes:     make([]*snapshotNode, 0, len(nodes)),
+	}
+	for _, n := range nodes {
+		service.Nodes = append(service.Nodes, &snapshotNode{
+			ServiceName: n.ServiceName,
+			Address:     n.Address,
+			Network:     n.Network,
+			Protocol:    n.Protocol,
+			SetName:     n.SetName,
+			Weight:      n.Weight,
+			Metadata:    n.Metadata,
+		})
+	}
+	return service
+}
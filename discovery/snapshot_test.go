@@ -0,0 +1,81 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2025 Tencent.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package discovery
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	tregistry "trpc.group/trpc-go/trpc-go/naming/registry"
+	"trpc.group/trpc-go/trpc-naming-etcd/model"
+
+	. "github.com/glycerine/goconvey/convey"
+)
+
+func Test_snapshot_save(t *testing.T) {
+	Convey("测试快照的保存和加载", t, func() {
+		dir, err := ioutil.TempDir("", "snapshot")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		file := filepath.Join(dir, "discovery.json")
+
+		_, err = loadSnapshot(file)
+		So(os.IsNotExist(err), ShouldBeTrue)
+
+		startTime := time.Unix(1700000000, 0)
+		s := &snapshot{
+			Services: map[string]*snapshotService{
+				"test": newSnapshotService([]*tregistry.Node{
+					{
+						ServiceName: "test",
+						Address:     "127.0.0.1:8080",
+						Protocol:    "trpc",
+						Weight:      100,
+						Metadata: map[string]interface{}{"key": "value", model.MetadataKeyTags: []string{"canary"},
+							model.MetadataKeyStartTime: startTime},
+					},
+				}, time.Now()),
+				"old": newSnapshotService(emptyNodes, time.Now().Add(-time.Hour)),
+			},
+		}
+		So(s.save(file), ShouldBeNil)
+
+		loaded, err := loadSnapshot(file)
+		So(err, ShouldBeNil)
+		nodes, ok := loaded.nodes("test", time.Minute)
+		So(ok, ShouldBeTrue)
+		So(len(nodes), ShouldEqual, 1)
+		So(nodes[0].Address, ShouldEqual, "127.0.0.1:8080")
+		So(nodes[0].Metadata["key"], ShouldEqual, "value")
+		So(nodes[0].Protocol, ShouldEqual, "trpc")
+		// 反序列化后恢复元数据的类型
+		So(nodes[0].Metadata[model.MetadataKeyTags], ShouldResemble, []string{"canary"})
+		So(nodes[0].Metadata[model.MetadataKeyStartTime].(time.Time).Equal(startTime), ShouldBeTrue)
+		// 超过最大可用时长的快照不可用
+		_, ok = loaded.nodes("old", time.Minute)
+		So(ok, ShouldBeFalse)
+		_, ok = loaded.nodes("old", 0)
+		So(ok, ShouldBeTrue)
+		_, ok = loaded.nodes("notExist", 0)
+		So(ok, ShouldBeFalse)
+
+		// 损坏的快照加载失败
+		So(ioutil.WriteFile(file, []byte("{"), 0644), ShouldBeNil)
+		_, err = loadSnapshot(file)
+		So(err, ShouldNotBeNil)
+	})
+}
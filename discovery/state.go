@@ -0,0 +1,143 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2025 Tencent.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package discovery
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	tdiscovery "trpc.group/trpc-go/trpc-go/naming/discovery"
+	tregistry "trpc.group/trpc-go/trpc-go/naming/registry"
+)
+
+// State 服务发现当前的缓存状态，用于排查路由问题
+type State struct {
+	// Revision 缓存对应的 etcd 数据版本
+	Revision int64 `json:"revision"`
+	// WatchConnected watch 连接是否正常，正常时缓存与 etcd 保持一致
+	WatchConnected bool `json:"watch_connected"`
+	// Watched 关注变更的服务
+	Watched []string `json:"watched"`
+	// Refreshing 正在后台刷新的服务
+	Refreshing []string `json:"refreshing"`
+	// Services 已缓存的服务，服务名 -> 缓存状态
+	Services map[string]*ServiceState `json:"services"`
+}
+
+// ServiceState 单个服务的缓存状态
+type ServiceState struct {
+	// Nodes 缓存的节点
+	Nodes []*NodeState `json:"nodes"`
+	// Expire 缓存过期时间
+	Expire time.Time `json:"expire"`
+	// Expired 缓存是否已经过期
+	Expired bool `json:"expired"`
+	// Stale 是否正在使用过期缓存
+	Stale bool `json:"stale"`
+	// Subscribers 订阅者个数
+	Subscribers int `json:"subscribers"`
+}
+
+// NodeState 缓存的节点
+type NodeState struct {
+	Address  string                 `json:"address"`
+	Network  string                 `json:"network,omitempty"`
+	Protocol string                 `json:"protocol,omitempty"`
+	SetName  string                 `json:"set_name,omitempty"`
+	Weight   int                    `json:"weight"`
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// State 获取当前的缓存状态
+func (d *Discovery) State() *State {
+	s := d.cache.state()
+	d.RLock()
+	for serviceName := range d.refreshing {
+		s.Refreshing = append(s.Refreshing, serviceName)
+	}
+	d.RUnlock()
+	sort.Strings(s.Refreshing)
+	return s
+}
+
+// Resync 立即从 etcd 获取 serviceName 的节点并覆盖缓存，之后关注该服务的变更
+func (d *Discovery) Resync(ctx context.Context, serviceName string) ([]*tregistry.Node, error) {
+	d.cache.markWatched(serviceName)
+	version, nodes, err := d.listFromEtcd(serviceName, tdiscovery.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if err := d.cache.cache(serviceName, version, nodes); err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+// Invalidate 删除 serviceName 的缓存，下次获取节点时从 etcd 重新获取。
+// 服务有订阅者时保留节点，并立即从 etcd 重新获取
+func (d *Discovery) Invalidate(serviceName string) {
+	d.invalidate(serviceName)
+}
+
+// state 获取缓存状态
+func (c *cache) state() *State {
+	c.RLock()
+	defer c.RUnlock()
+	now := time.Now()
+	s := &State{
+		Revision:       c.version,
+		WatchConnected: c.watcher.isConnected(),
+		Watched:        make([]string, 0, len(c.watched)),
+		Services:       make(map[string]*ServiceState, len(c.nodeCache)),
+	}
+	for serviceName := range c.watched {
+		s.Watched = append(s.Watched, serviceName)
+	}
+	sort.Strings(s.Watched)
+	for serviceName, nodes := range c.nodeCache {
+		expire := c.expires[serviceName]
+		service := &ServiceState{
+			Nodes:       make([]*NodeState, 0, len(nodes)),
+			Expire:      expire,
+			Expired:     now.After(expire),
+			Stale:       c.staled[serviceName],
+			Subscribers: len(c.subscribers[serviceName]),
+		}
+		for _, n := range nodes {
+			service.Nodes = append(service.Nodes, newNodeState(n))
+		}
+		s.Services[serviceName] = service
+	}
+	return s
+}
+
+// markWatched 标记关注 serviceName 的变更
+func (c *cache) markWatched(serviceName string) {
+	c.Lock()
+	c.watched[serviceName] = true
+	c.Unlock()
+}
+
+// newNodeState 转换缓存的节点，tregistry.Node 中的函数字段无法序列化
+func newNodeState(n *tregistry.Node) *NodeState {
+	return &NodeState{
+		Address:  n.Address,
+		Network:  n.Network,
+		Protocol: n.Protocol,
+		SetName:  n.SetName,
+		Weight:   n.Weight,
+		Metadata: n.Metadata,
+	}
+}
@@ -0,0 +1,109 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2023 Tencent.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package discovery
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"trpc.group/trpc-go/trpc-naming-etcd/client/fake"
+
+	. "github.com/glycerine/goconvey/convey"
+)
+
+func TestDiscovery_State(t *testing.T) {
+	Convey("测试查询缓存状态、删除缓存和强制同步", t, func() {
+		ctx := context.Background()
+		e := fake.New()
+		defer e.Close()
+		putNode(e, "1")
+		td, err := NewDiscovery(e, &Config{Prefix: "/fake/"})
+		So(err, ShouldBeNil)
+		d := td.(*Discovery)
+		defer d.cache.stop()
+
+		nodes, err := d.List("test")
+		So(err, ShouldBeNil)
+		So(len(nodes), ShouldEqual, 1)
+		state := d.State()
+		So(state.Revision, ShouldEqual, e.Revision())
+		So(state.Watched, ShouldResemble, []string{"test"})
+		So(len(state.Services), ShouldEqual, 1)
+		service := state.Services["test"]
+		So(service.Expired, ShouldBeFalse)
+		So(service.Stale, ShouldBeFalse)
+		So(service.Nodes[0].Address, ShouldEqual, "1")
+
+		// 删除缓存后仍然关注变更，下次获取时从 etcd 重新获取
+		d.Invalidate("test")
+		state = d.State()
+		So(len(state.Services), ShouldEqual, 0)
+		So(state.Watched, ShouldResemble, []string{"test"})
+
+		putNode(e, "2")
+		nodes, err = d.Resync(ctx, "test")
+		So(err, ShouldBeNil)
+		So(len(nodes), ShouldEqual, 2)
+		So(len(d.State().Services["test"].Nodes), ShouldEqual, 2)
+
+		// 没有获取过的服务强制同步后开始关注
+		nodes, err = d.Resync(ctx, "other")
+		So(err, ShouldBeNil)
+		So(len(nodes), ShouldEqual, 0)
+		So(d.State().Watched, ShouldResemble, []string{"other", "test"})
+
+		So(e.Close(), ShouldBeNil)
+		_, err = d.Resync(ctx, "test")
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestDiscovery_InvalidateSubscribed(t *testing.T) {
+	Convey("删除有订阅者的服务缓存后立即重新获取，订阅者继续收到变更", t, func() {
+		e := fake.New()
+		defer e.Close()
+		putNode(e, "1")
+		td, err := NewDiscovery(e, &Config{Prefix: "/fake/"})
+		So(err, ShouldBeNil)
+		d := td.(*Discovery)
+		defer d.cache.stop()
+		events, cancel, err := d.Watch("test")
+		So(err, ShouldBeNil)
+		defer cancel()
+		event := <-events
+		So(len(event.Nodes), ShouldEqual, 1)
+		for i := 0; i < 100 && !d.cache.watcher.isConnected(); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		d.Invalidate("test")
+		for i := 0; i < 100 && d.State().Services["test"].Expired; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		So(d.State().Services["test"].Expired, ShouldBeFalse)
+
+		// 重新获取时也会推送节点，直到收到新增的节点
+		putNode(e, "2")
+		timeout := time.After(time.Second)
+		for len(event.Nodes) != 2 {
+			select {
+			case event = <-events:
+			case <-timeout:
+				So(len(event.Nodes), ShouldEqual, 2)
+				return
+			}
+		}
+	})
+}
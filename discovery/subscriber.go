@@ -0,0 +1,162 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2025 Tencent.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package discovery
+
+import (
+	"reflect"
+	"sync"
+
+	tregistry "trpc.group/trpc-go/trpc-go/naming/registry"
+)
+
+// subscriber 服务节点变更的订阅者
+//
+// 缓存更新时只记录最新的全量节点并发出信号，不会阻塞缓存；订阅者消费慢时，
+// 多次变更会合并为一次通知，Changes 为合并后的差异，因此不会丢失最终状态
+type subscriber struct {
+	serviceName string
+	mu          sync.Mutex
+	// base 上一次通知给订阅者的全量节点
+	base []*tregistry.Node
+	// latest 缓存中最新的全量节点
+	latest []*tregistry.Node
+	// delivered 是否已经通知过，首次通知即使没有节点也要下发
+	delivered bool
+	notify    chan struct{}
+	events    chan *Event
+	exit      chan bool
+	once      sync.Once
+}
+
+// newSubscriber 新建订阅者
+func newSubscriber(serviceName string) *subscriber {
+	s := &subscriber{
+		serviceName: serviceName,
+		notify:      make(chan struct{}, 1),
+		events:      make(chan *Event),
+		exit:        make(chan bool),
+	}
+	go s.run()
+	return s
+}
+
+// push 记录最新的全量节点并通知订阅者，不会阻塞
+func (s *subscriber) push(nodes []*tregistry.Node) {
+	s.mu.Lock()
+	s.latest = nodes
+	s.mu.Unlock()
+	s.signal()
+}
+
+// init 设置初始节点，如果已经收到过缓存推送则忽略
+func (s *subscriber) init(nodes []*tregistry.Node) {
+	s.mu.Lock()
+	if s.latest != nil {
+		s.mu.Unlock()
+		return
+	}
+	s.latest = nodes
+	s.mu.Unlock()
+	s.signal()
+}
+
+// signal 发出变更信号，已经有未处理的信号时直接返回
+func (s *subscriber) signal() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// stop 停止订阅，可以多次调用
+func (s *subscriber) stop() {
+	s.once.Do(func() {
+		close(s.exit)
+	})
+}
+
+// run 将变更转发给订阅者，停止后关闭事件通道
+func (s *subscriber) run() {
+	defer close(s.events)
+	for {
+		select {
+		case <-s.notify:
+		case <-s.exit:
+			return
+		}
+		for event := s.next(); event != nil; {
+			select {
+			case s.events <- event:
+				s.commit(event)
+				event = nil
+			case <-s.notify:
+				// 等待消费期间又有新的变更，重新计算合并后的通知
+				event = s.next()
+			case <-s.exit:
+				return
+			}
+		}
+	}
+}
+
+// next 计算最新节点与上一次通知的差异，没有变化时返回 nil
+func (s *subscriber) next() *Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.latest == nil {
+		return nil
+	}
+	changes := diffNodes(s.base, s.latest)
+	if len(changes) == 0 && s.delivered {
+		return nil
+	}
+	return &Event{
+		ServiceName: s.serviceName,
+		Nodes:       s.latest,
+		Changes:     changes,
+	}
+}
+
+// commit 记录已经通知给订阅者的节点
+func (s *subscriber) commit(event *Event) {
+	s.mu.Lock()
+	s.base = event.Nodes
+	s.delivered = true
+	s.mu.Unlock()
+}
+
+// diffNodes 按地址比较两次全量节点，返回新增、更新、删除的节点
+func diffNodes(oldNodes, newNodes []*tregistry.Node) []*NodeChange {
+	old := make(map[string]*tregistry.Node, len(oldNodes))
+	for _, n := range oldNodes {
+		old[n.Address] = n
+	}
+	var changes []*NodeChange
+	for _, n := range newNodes {
+		o, ok := old[n.Address]
+		delete(old, n.Address)
+		switch {
+		case !ok:
+			changes = append(changes, &NodeChange{EventType: Create, Node: n})
+		case o != n && !reflect.DeepEqual(o, n):
+			changes = append(changes, &NodeChange{EventType: Update, Node: n})
+		}
+	}
+	for _, n := range oldNodes {
+		if _, ok := old[n.Address]; ok {
+			changes = append(changes, &NodeChange{EventType: Delete, Node: n})
+		}
+	}
+	return changes
+}
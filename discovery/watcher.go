@@ -15,30 +15,55 @@ package discovery
 
 import (
 	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
 
 	"trpc.group/trpc-go/trpc-go/log"
+	"trpc.group/trpc-go/trpc-naming-etcd/client"
+	"trpc.group/trpc-go/trpc-naming-etcd/internal/metrics"
 	"trpc.group/trpc-go/trpc-naming-etcd/model"
 
 	clientv3 "go.etcd.io/etcd/client/v3"
 )
 
-// watchResult 包装 etcd 改变通知
-type watchResult struct {
-	Version   int64
+const (
+	// defaultRetryInterval watch 断开或者后台刷新失败后首次重试的等待时间
+	defaultRetryInterval = 500 * time.Millisecond
+	// defaultMaxRetryInterval watch 断开或者后台刷新失败后重试的最大等待时间
+	defaultMaxRetryInterval = 30 * time.Second
+)
+
+// watchEvent 单个节点的变更
+type watchEvent struct {
 	EventType EventType
 	Node      *model.Node
 }
 
+// watchResult 包装 etcd 一次改变通知，同一个版本下的所有变更一起下发
+type watchResult struct {
+	Version int64
+	Events  []*watchEvent
+	// Resync 为 true 时代表全量同步，Nodes 为 etcd 中当前所有节点
+	Resync bool
+	Nodes  []*model.Node
+}
+
 // etcdWatcher etcd watcher
 type etcdWatcher struct {
 	exit       chan bool
 	watchPath  string
-	etcdClient *clientv3.Client
+	etcdClient client.Etcd
 	cfg        *Config
+	// revision 最近一次收到的 etcd 数据版本，重连时从下一个版本继续 watch，使用原子操作读写
+	revision int64
+	// connected watch 连接是否正常，1 表示正常
+	connected int32
 }
 
 // newEtcdWatcher 新建 etcd watcher
-func newEtcdWatcher(etcdClient *clientv3.Client, cfg *Config) *etcdWatcher {
+func newEtcdWatcher(etcdClient client.Etcd, cfg *Config) *etcdWatcher {
 	return &etcdWatcher{
 		etcdClient: etcdClient,
 		cfg:        cfg,
@@ -52,60 +77,214 @@ func (ew *etcdWatcher) stop() {
 	close(ew.exit)
 }
 
-// Watch 返回etcd变更
+// Watch 返回etcd变更，watch 异常断开后会自动重连，直到 stop 被调用
 func (ew *etcdWatcher) watch() <-chan *watchResult {
 	resultChan := make(chan *watchResult)
 	go func() {
 		defer func() {
 			close(resultChan)
 		}()
-		ctx, cancel := context.WithCancel(context.Background())
-		go func() {
-			<-ew.exit
-			cancel()
-		}()
-		for wresp := range ew.etcdClient.Watch(ctx, ew.watchPath, clientv3.WithPrefix(), clientv3.WithPrevKV()) {
-			if wresp.Err() != nil {
-				return
-			}
-			var result *watchResult
-			for _, ev := range wresp.Events {
-				value := ev.Kv.Value
-				var eventType EventType
-				switch ev.Type {
-				case clientv3.EventTypePut:
-					if ev.IsCreate() {
-						eventType = Create
-					} else if ev.IsModify() {
-						eventType = Update
+		b := ew.cfg.retryBackOff()
+		// 首次 watch 从最新版本开始，无需全量同步
+		needResync := false
+		for {
+			if needResync {
+				if !ew.resync(resultChan) {
+					if !ew.wait(b.NextBackOff()) {
+						return
 					}
-				case clientv3.EventTypeDelete:
-					eventType = Delete
-					value = ev.PrevKv.Value
-				}
-				node, err := model.Unmarshal(value)
-				if err != nil {
-					log.Errorf("unmarshal node fail, err: %s\n", err.Error())
-					continue
-				}
-				if node == nil {
 					continue
 				}
-				result = &watchResult{
-					Version:   wresp.Header.Revision,
-					EventType: eventType,
-					Node:      node,
+				needResync = false
+			}
+			compacted, ok := ew.watchOnce(resultChan, b)
+			if !ok {
+				return
+			}
+			metrics.Incr(metrics.WatchRestart)
+			// 数据已被压缩或者未收到过任何版本，无法断点续传，需要全量同步
+			needResync = compacted || ew.getRevision() == 0
+			if !ew.wait(b.NextBackOff()) {
+				return
+			}
+		}
+	}()
+	return resultChan
+}
+
+// watchOnce 建立一次 watch 并转发变更，watch 断开时返回，
+// compacted 表示断开原因是数据被压缩，ok 为 false 表示 watcher 已经停止
+func (ew *etcdWatcher) watchOnce(resultChan chan<- *watchResult, b backoff.BackOff) (compacted bool, ok bool) {
+	ctx, cancel := context.WithCancel(clientv3.WithRequireLeader(context.Background()))
+	defer cancel()
+	defer atomic.StoreInt32(&ew.connected, 0)
+	opts := []clientv3.OpOption{clientv3.WithPrefix(), clientv3.WithPrevKV(), clientv3.WithCreatedNotify()}
+	fromLatest := true
+	if revision := ew.getRevision(); revision > 0 {
+		opts = append(opts, clientv3.WithRev(revision+1))
+		fromLatest = false
+	}
+	watchChan := ew.etcdClient.Watch(ctx, ew.watchPath, opts...)
+	for {
+		var wresp clientv3.WatchResponse
+		select {
+		case wresp, ok = <-watchChan:
+			if !ok {
+				return false, !ew.stopped()
+			}
+		case <-ew.exit:
+			return false, false
+		}
+		if err := wresp.Err(); err != nil {
+			log.Warnf("etcd watch %s interrupted at revision %d, err: %v", ew.watchPath, ew.getRevision(), err)
+			return wresp.CompactRevision != 0, !ew.stopped()
+		}
+		b.Reset()
+		atomic.StoreInt32(&ew.connected, 1)
+		revision := resumeRevision(wresp, fromLatest)
+		events := make([]*watchEvent, 0, len(wresp.Events))
+		for _, ev := range wresp.Events {
+			value := ev.Kv.Value
+			var eventType EventType
+			switch ev.Type {
+			case clientv3.EventTypePut:
+				if ev.IsCreate() {
+					eventType = Create
+				} else if ev.IsModify() {
+					eventType = Update
 				}
+			case clientv3.EventTypeDelete:
+				eventType = Delete
+				value = ev.PrevKv.Value
+			}
+			node, err := model.Unmarshal(value)
+			if err != nil {
+				log.Errorf("unmarshal node fail, err: %s\n", err.Error())
+				continue
 			}
-			if result == nil {
+			if node == nil {
 				continue
 			}
+			events = append(events, &watchEvent{
+				EventType: eventType,
+				Node:      node,
+			})
+		}
+		if len(events) > 0 {
 			select {
-			case resultChan <- result:
+			case resultChan <- &watchResult{Version: revision, Events: events}:
 			case <-ew.exit:
-				return
+				return false, false
 			}
 		}
-	}()
-	return resultChan
+		if revision > ew.getRevision() {
+			atomic.StoreInt64(&ew.revision, revision)
+		}
+	}
+}
+
+// resumeRevision 返回收到响应后可以续传的版本，为 0 时不推进。
+// 响应头中的版本是 etcd 当前的版本，创建通知和追赶历史数据时可能超过已下发的事件，
+// 只有从最新版本开始 watch 的创建通知和已追上最新版本后才会收到的进度通知可以使用
+func resumeRevision(wresp clientv3.WatchResponse, fromLatest bool) int64 {
+	if n := len(wresp.Events); n > 0 {
+		return wresp.Events[n-1].Kv.ModRevision
+	}
+	if wresp.Created && fromLatest {
+		return wresp.Header.Revision
+	}
+	if wresp.IsProgressNotify() {
+		return wresp.Header.Revision
+	}
+	return 0
+}
+
+// resync 从 etcd 全量拉取所有节点并通知缓存覆盖，成功后从拉取的版本继续 watch
+func (ew *etcdWatcher) resync(resultChan chan<- *watchResult) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), client.DefaultTimeout)
+	defer cancel()
+	start := time.Now()
+	rsp, err := ew.etcdClient.Get(ctx, ew.watchPath, clientv3.WithPrefix())
+	metrics.ObserveEtcd(metrics.EtcdGet, start, err)
+	if err != nil {
+		log.Errorf("etcd resync %s fail, err: %v", ew.watchPath, err)
+		return false
+	}
+	metrics.Incr(metrics.WatchResync)
+	nodes := make([]*model.Node, 0, len(rsp.Kvs))
+	for _, kv := range rsp.Kvs {
+		node, err := model.Unmarshal(kv.Value)
+		if err != nil {
+			log.Errorf("unmarshal node fail, err: %s\n", err.Error())
+			continue
+		}
+		if node == nil {
+			continue
+		}
+		nodes = append(nodes, node)
+	}
+	atomic.StoreInt64(&ew.revision, rsp.Header.Revision)
+	select {
+	case resultChan <- &watchResult{Version: rsp.Header.Revision, Resync: true, Nodes: nodes}:
+		return true
+	case <-ew.exit:
+		return false
+	}
+}
+
+// wait 等待重连，watcher 停止时返回 false
+func (ew *etcdWatcher) wait(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ew.exit:
+		return false
+	}
+}
+
+// getRevision 获取最近一次收到的 etcd 数据版本
+func (ew *etcdWatcher) getRevision() int64 {
+	return atomic.LoadInt64(&ew.revision)
+}
+
+// isConnected 判断 watch 连接是否正常，正常时缓存与 etcd 保持一致
+func (ew *etcdWatcher) isConnected() bool {
+	return atomic.LoadInt32(&ew.connected) == 1
+}
+
+// stopped 判断 watcher 是否已经停止
+func (ew *etcdWatcher) stopped() bool {
+	select {
+	case <-ew.exit:
+		return true
+	default:
+		return false
+	}
+}
+
+// retryBackOff 按配置新建重试的退避策略
+func (c *Config) retryBackOff() backoff.BackOff {
+	interval, maxInterval := c.RetryInterval, c.MaxRetryInterval
+	if interval <= 0 {
+		interval = defaultRetryInterval
+	}
+	if maxInterval < interval {
+		maxInterval = defaultMaxRetryInterval
+		if maxInterval < interval {
+			maxInterval = interval
+		}
+	}
+	return newRetryBackOff(interval, maxInterval)
+}
+
+// newRetryBackOff 新建重试的退避策略，永不放弃重试
+func newRetryBackOff(interval, maxInterval time.Duration) backoff.BackOff {
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = interval
+	b.MaxInterval = maxInterval
+	b.MaxElapsedTime = 0
+	b.Reset()
+	return b
 }
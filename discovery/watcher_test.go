@@ -16,7 +16,9 @@ package discovery
 import (
 	"context"
 	"testing"
+	"time"
 
+	"trpc.group/trpc-go/trpc-naming-etcd/client/fake"
 	"trpc.group/trpc-go/trpc-naming-etcd/model"
 
 	"go.etcd.io/etcd/api/v3/etcdserverpb"
@@ -143,15 +145,172 @@ func Test_etcdWatcher_stop(t *testing.T) {
 func Test_etcdWatcher_watch(t *testing.T) {
 	Convey("测试watcher的isValid函数", t, func() {
 		client := newEtcdClient()
-		w := newEtcdWatcher(client, &Config{})
+		w := newEtcdWatcher(client, &Config{RetryInterval: 10 * time.Millisecond})
 		So(w, ShouldNotBeNil)
 		resultChan := w.watch()
+		// 新建、更新、删除三个事件
+		for i := 0; i < 3; i++ {
+			result := <-resultChan
+			So(result, ShouldNotBeNil)
+		}
+		// watch 被取消后会自动重连，只有 stop 后才会关闭通道
+		w.stop()
 		for range resultChan {
 
 		}
 	})
 }
 
+// resumeWatcher 在内存 etcd 上按顺序模拟 watch 断开、数据压缩后重连，全量同步读取内存 etcd 中的数据
+type resumeWatcher struct {
+	*fake.Etcd
+	revs []int64
+}
+
+// Watch 关注key变化
+func (c *resumeWatcher) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
+	c.revs = append(c.revs, clientv3.OpGet(key, opts...).Rev())
+	etcdCh := make(chan clientv3.WatchResponse, 10)
+	switch len(c.revs) {
+	case 1:
+		// 收到一个事件后连接断开
+		node := &model.Node{
+			Name:    "test",
+			ID:      model.ServiceID("127.0.0.1", "8080", "123"),
+			Address: "127.0.0.1:8080",
+		}
+		value, _ := model.Marshal(node)
+		// 追赶历史数据时响应头的版本是 etcd 当前版本，超过已下发事件的版本
+		etcdCh <- clientv3.WatchResponse{
+			Header: etcdserverpb.ResponseHeader{
+				Revision: 15,
+			},
+			// 同一个事务中的多个变更
+			Events: []*clientv3.Event{
+				{
+					Type: clientv3.EventTypePut,
+					Kv: &mvccpb.KeyValue{
+						Key:            []byte(key),
+						Value:          []byte(value),
+						CreateRevision: 10,
+						ModRevision:    10,
+					},
+				},
+				{
+					Type: clientv3.EventTypeDelete,
+					Kv: &mvccpb.KeyValue{
+						Key:         []byte(key),
+						ModRevision: 10,
+					},
+					PrevKv: &mvccpb.KeyValue{
+						Value: []byte(value),
+					},
+				},
+			},
+		}
+		close(etcdCh)
+	case 2:
+		// 续传的版本已经被压缩
+		etcdCh <- clientv3.WatchResponse{
+			Header: etcdserverpb.ResponseHeader{
+				Revision: 30,
+			},
+			CompactRevision: 20,
+			Canceled:        true,
+		}
+	}
+	return etcdCh
+}
+
+func Test_etcdWatcher_resume(t *testing.T) {
+	Convey("测试watch断开后从断点续传，数据压缩后全量同步", t, func() {
+		rw := &resumeWatcher{Etcd: fake.New()}
+		defer rw.Close()
+		putNode(rw.Etcd, "127.0.0.1:8080")
+		w := newEtcdWatcher(rw, &Config{Prefix: "/fake/", RetryInterval: 10 * time.Millisecond})
+		resultChan := w.watch()
+
+		result := <-resultChan
+		So(result.Resync, ShouldBeFalse)
+		So(result.Version, ShouldEqual, 10)
+		So(len(result.Events), ShouldEqual, 2)
+
+		result = <-resultChan
+		So(result.Resync, ShouldBeTrue)
+		So(len(result.Nodes), ShouldEqual, 1)
+
+		w.stop()
+		for range resultChan {
+
+		}
+		So(len(rw.revs), ShouldEqual, 3)
+		// 首次从最新版本开始
+		So(rw.revs[0], ShouldEqual, 0)
+		// 断开后从最后一个已下发事件的下一个版本续传
+		So(rw.revs[1], ShouldEqual, 11)
+		// 全量同步后从同步的版本续传
+		So(rw.revs[2], ShouldEqual, result.Version+1)
+	})
+}
+
+func Test_resumeRevision(t *testing.T) {
+	Convey("测试只根据已下发的事件推进续传版本", t, func() {
+		header := etcdserverpb.ResponseHeader{Revision: 50}
+		events := []*clientv3.Event{{Kv: &mvccpb.KeyValue{ModRevision: 9}}, {Kv: &mvccpb.KeyValue{ModRevision: 10}}}
+		So(resumeRevision(clientv3.WatchResponse{Header: header, Events: events}, false), ShouldEqual, 10)
+		// 从最新版本开始时，创建通知之前的数据无需续传
+		So(resumeRevision(clientv3.WatchResponse{Header: header, Created: true}, true), ShouldEqual, 50)
+		// 从指定版本续传时，创建通知的版本可能超过还没有下发的事件
+		So(resumeRevision(clientv3.WatchResponse{Header: header, Created: true}, false), ShouldEqual, 0)
+		// 进度通知只在追上最新版本后下发
+		So(resumeRevision(clientv3.WatchResponse{Header: header}, false), ShouldEqual, 50)
+		So(resumeRevision(clientv3.WatchResponse{Header: header, Canceled: true}, false), ShouldEqual, 0)
+	})
+}
+
+// putNode 写入节点
+func putNode(e *fake.Etcd, id string) {
+	value, _ := model.Marshal(&model.Node{Name: "test", ID: id, Address: id})
+	_, err := e.Put(context.Background(), model.NodePath("/fake/", "test", id), value)
+	So(err, ShouldBeNil)
+}
+
+func Test_etcdWatcher_fake(t *testing.T) {
+	Convey("使用内存 etcd 测试 watch 断开续传和压缩后全量同步", t, func() {
+		e := fake.New()
+		defer e.Close()
+		w := newEtcdWatcher(e, &Config{Prefix: "/fake/", RetryInterval: 200 * time.Millisecond})
+		resultChan := w.watch()
+		defer w.stop()
+		for i := 0; i < 100 && !w.isConnected(); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		So(w.isConnected(), ShouldBeTrue)
+
+		putNode(e, "1")
+		result := <-resultChan
+		So(result.Version, ShouldEqual, e.Revision())
+		So(result.Events[0].EventType, ShouldEqual, Create)
+
+		// 断开期间的变更在重连后续传
+		e.DropWatches()
+		putNode(e, "2")
+		result = <-resultChan
+		So(result.Resync, ShouldBeFalse)
+		So(result.Events[0].Node.ID, ShouldEqual, "2")
+
+		// 断开期间数据被压缩时全量同步
+		e.DropWatches()
+		putNode(e, "3")
+		_, err := e.Compact(context.Background(), e.Revision())
+		So(err, ShouldBeNil)
+		result = <-resultChan
+		So(result.Resync, ShouldBeTrue)
+		So(len(result.Nodes), ShouldEqual, 3)
+		So(result.Version, ShouldEqual, e.Revision())
+	})
+}
+
 func Test_newEtcdWatcher(t *testing.T) {
 	Convey("测试新建watcher", t, func() {
 		client := newEtcdClient()
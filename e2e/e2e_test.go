@@ -0,0 +1,150 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2023 Tencent.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+// Package e2e 使用进程内 etcd 的端到端测试，单独作为一个模块，避免库依赖 etcd 服务端
+package e2e
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	tdiscovery "trpc.group/trpc-go/trpc-go/naming/discovery"
+	tregistry "trpc.group/trpc-go/trpc-go/naming/registry"
+	tselector "trpc.group/trpc-go/trpc-go/naming/selector"
+	"trpc.group/trpc-go/trpc-naming-etcd/discovery"
+	"trpc.group/trpc-go/trpc-naming-etcd/e2e/etcdtest"
+	"trpc.group/trpc-go/trpc-naming-etcd/model"
+	"trpc.group/trpc-go/trpc-naming-etcd/registry"
+	"trpc.group/trpc-go/trpc-naming-etcd/selector"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	. "github.com/glycerine/goconvey/convey"
+)
+
+// pollInterval 轮询服务节点的间隔
+const pollInterval = 50 * time.Millisecond
+
+// waitList 轮询服务节点直到满足 match，超时返回 false。订阅会合并中间的变化，只用 List 的结果判断状态
+func waitList(d *discovery.Discovery, serviceName string, timeout time.Duration,
+	match func([]*tregistry.Node) bool) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		// 没有节点时 List 返回错误，按空列表判断
+		nodes, _ := d.List(serviceName)
+		if match(nodes) {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// waitLease 轮询 etcd 直到服务只有一个实例且租约满足 match，超时返回 false
+func waitLease(c *clientv3.Client, key string, timeout time.Duration, match func(clientv3.LeaseID) bool) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		rsp, err := c.Get(context.Background(), key, clientv3.WithPrefix())
+		if err == nil && len(rsp.Kvs) == 1 && match(clientv3.LeaseID(rsp.Kvs[0].Lease)) {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// hasAddress 判断节点中是否有 address
+func hasAddress(nodes []*tregistry.Node, address string) bool {
+	for _, n := range nodes {
+		if n.Address == address {
+			return true
+		}
+	}
+	return false
+}
+
+func TestEndToEnd(t *testing.T) {
+	s := etcdtest.Start(t)
+	c := s.Client(t)
+	Convey("使用进程内 etcd 测试注册、发现、租约过期和订阅更新", t, func() {
+		ctx := context.Background()
+		prefix := "/e2e/services/"
+		tr, err := registry.NewRegistry(c, &registry.Config{Prefix: prefix, TTL: 2, SyncRegister: true})
+		So(err, ShouldBeNil)
+		r := tr.(*registry.Registry)
+		td, err := discovery.NewDiscovery(c, &discovery.Config{Prefix: prefix})
+		So(err, ShouldBeNil)
+		d := td.(*discovery.Discovery)
+		sel := selector.NewSelector(d, &selector.Config{})
+
+		// 注册后可以发现和选择节点
+		So(r.Register("e2e.service", tregistry.WithAddress("127.0.0.1:8000")), ShouldBeNil)
+		nodes, err := d.List("e2e.service", tdiscovery.WithContext(ctx))
+		So(err, ShouldBeNil)
+		So(len(nodes), ShouldEqual, 1)
+		So(nodes[0].Address, ShouldEqual, "127.0.0.1:8000")
+		node, err := sel.Select("e2e.service", tselector.WithContext(ctx))
+		So(err, ShouldBeNil)
+		So(node.Address, ShouldEqual, "127.0.0.1:8000")
+
+		// 保持订阅，缓存随 watch 更新
+		_, cancel, err := d.Watch("e2e.service")
+		So(err, ShouldBeNil)
+		defer cancel()
+		So(waitList(d, "e2e.service", time.Second, func(nodes []*tregistry.Node) bool {
+			return hasAddress(nodes, "127.0.0.1:8000")
+		}), ShouldBeTrue)
+
+		// 没有续约的实例在租约过期后被删除
+		lease, err := c.Grant(ctx, 1)
+		So(err, ShouldBeNil)
+		value, err := model.Marshal(&model.Node{Name: "e2e.service", ID: "crashed", Address: "127.0.0.1:8001",
+			Weight: 1})
+		So(err, ShouldBeNil)
+		_, err = c.Put(ctx, model.NodePath(prefix, "e2e.service", "crashed"), value, clientv3.WithLease(lease.ID))
+		So(err, ShouldBeNil)
+		So(waitList(d, "e2e.service", 5*time.Second, func(nodes []*tregistry.Node) bool {
+			return len(nodes) == 2 && hasAddress(nodes, "127.0.0.1:8001")
+		}), ShouldBeTrue)
+		So(waitList(d, "e2e.service", 10*time.Second, func(nodes []*tregistry.Node) bool {
+			return len(nodes) == 1 && hasAddress(nodes, "127.0.0.1:8000")
+		}), ShouldBeTrue)
+
+		// 注册的租约被撤销后重新注册
+		key := model.NodePath(prefix, "e2e.service", model.ServiceID("127.0.0.1", "8000", ""))
+		rsp, err := c.Get(ctx, model.ServicePath(prefix, "e2e.service"), clientv3.WithPrefix())
+		So(err, ShouldBeNil)
+		So(len(rsp.Kvs), ShouldEqual, 1)
+		So(string(rsp.Kvs[0].Key), ShouldStartWith, key)
+		oldLease := clientv3.LeaseID(rsp.Kvs[0].Lease)
+		_, err = c.Revoke(ctx, oldLease)
+		So(err, ShouldBeNil)
+		So(waitLease(c, model.ServicePath(prefix, "e2e.service"), 10*time.Second, func(lease clientv3.LeaseID) bool {
+			return lease != 0 && lease != oldLease
+		}), ShouldBeTrue)
+		So(waitList(d, "e2e.service", 5*time.Second, func(nodes []*tregistry.Node) bool {
+			return hasAddress(nodes, "127.0.0.1:8000")
+		}), ShouldBeTrue)
+
+		// 注销后节点被删除
+		So(r.Deregister("e2e.service"), ShouldBeNil)
+		So(waitList(d, "e2e.service", 5*time.Second, func(nodes []*tregistry.Node) bool {
+			return len(nodes) == 0
+		}), ShouldBeTrue)
+	})
+}
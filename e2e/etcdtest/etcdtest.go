@@ -0,0 +1,100 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2025 Tencent.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+// Package etcdtest 提供测试使用的进程内 etcd 服务，只监听临时目录中的 unix socket，不依赖外部 etcd
+package etcdtest
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+const (
+	// startTimeout 等待 etcd 启动的超时时间
+	startTimeout = 10 * time.Second
+)
+
+// seq 节点间监听地址的序号
+var seq int64
+
+// Server 进程内的 etcd 服务
+type Server struct {
+	etcd *embed.Etcd
+	once sync.Once
+	// Endpoint 客户端访问地址
+	Endpoint string
+}
+
+// Start 启动进程内的 etcd 服务，数据保存在临时目录，测试结束时自动关闭
+func Start(t testing.TB) *Server {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := embed.NewConfig()
+	cfg.Dir = filepath.Join(dir, "etcd")
+	cfg.LogLevel = "error"
+	// 监听 unix socket，不存在先获取空闲端口再监听之间端口被占用的问题。etcd 要求地址是 host:port 的格式，
+	// 地址直接作为 socket 文件路径；节点间地址会被重新解析，不能包含路径，使用进程内唯一的相对文件名
+	clientSock := filepath.Join(dir, "client.sock:0")
+	clientURL := url.URL{Scheme: "unix", Host: clientSock}
+	peerURL := url.URL{Scheme: "unix", Host: fmt.Sprintf("etcdtest-peer-%d:%d", os.Getpid(), atomic.AddInt64(&seq, 1))}
+	cfg.LCUrls, cfg.ACUrls = []url.URL{clientURL}, []url.URL{clientURL}
+	cfg.LPUrls, cfg.APUrls = []url.URL{peerURL}, []url.URL{peerURL}
+	cfg.InitialCluster = fmt.Sprintf("%s=%s", cfg.Name, peerURL.String())
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatalf("start embedded etcd fail, err: %v", err)
+	}
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(startTimeout):
+		e.Close()
+		t.Fatalf("embedded etcd is not ready after %v", startTimeout)
+	}
+	s := &Server{
+		etcd:     e,
+		Endpoint: "unix://" + clientSock,
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Client 新建访问该服务的 etcd 客户端，测试结束时自动关闭
+func (s *Server) Client(t testing.TB) *clientv3.Client {
+	t.Helper()
+	c, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{s.Endpoint},
+		DialTimeout: startTimeout,
+	})
+	if err != nil {
+		t.Fatalf("new etcd client fail, err: %v", err)
+	}
+	t.Cleanup(func() {
+		c.Close()
+	})
+	return c
+}
+
+// Close 关闭 etcd 服务，可以多次调用
+func (s *Server) Close() {
+	s.once.Do(s.etcd.Close)
+}
@@ -21,4 +21,14 @@ var (
 	ErrServerNotAvailable = errors.New("server can not available")
 	// ErrBalancerNotExist 没有对应的负载均衡策略
 	ErrBalancerNotExist = errors.New("load balancer is not exist")
+	// ErrRegisterTimeout 同步注册超时
+	ErrRegisterTimeout = errors.New("register timeout")
+	// ErrLeaseExpired 租约过期 需要重新注册
+	ErrLeaseExpired = errors.New("lease expired")
+	// ErrServiceNotRegistered 服务没有注册
+	ErrServiceNotRegistered = errors.New("service is not registered")
+	// ErrNoNodeMatched 没有节点匹配路由规则
+	ErrNoNodeMatched = errors.New("no node matched route rules")
+	// ErrInvalidStatus 不支持设置的节点状态
+	ErrInvalidStatus = errors.New("invalid node status")
 )
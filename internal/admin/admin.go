@@ -0,0 +1,79 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2025 Tencent.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+// Package admin 在 trpc-go 的管理端口上注册插件的调试命令，命令路径都以 /cmds/etcd/ 开头
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	tadmin "trpc.group/trpc-go/trpc-go/admin"
+)
+
+// PathPrefix 插件管理命令的路径前缀
+const PathPrefix = "/cmds/etcd/"
+
+const (
+	// errCodeBadRequest 请求参数错误
+	errCodeBadRequest = 1
+	// errCodeServer 执行命令失败
+	errCodeServer = 2
+)
+
+// ErrBadRequest 请求参数错误，命令返回该错误时使用 errCodeBadRequest 错误码
+var ErrBadRequest = errors.New("bad request")
+
+// Handler 管理命令，返回的数据以 data 字段输出
+type Handler func(r *http.Request) (interface{}, error)
+
+// HandleFunc 注册管理命令，需要在 trpc.NewServer 之前调用，path 不包含前缀
+func HandleFunc(path string, handler Handler) {
+	tadmin.HandleFunc(PathPrefix+path, Wrap(handler))
+}
+
+// Wrap 将管理命令转换为 http 处理函数，输出格式与 trpc-go 自带的管理命令一致
+func Wrap(handler Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := r.ParseForm(); err != nil {
+			tadmin.ErrorOutput(w, err.Error(), errCodeBadRequest)
+			return
+		}
+		data, err := handler(r)
+		if err != nil {
+			code := errCodeServer
+			if errors.Is(err, ErrBadRequest) {
+				code = errCodeBadRequest
+			}
+			tadmin.ErrorOutput(w, err.Error(), code)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"errorcode": 0,
+			"message":   "",
+			"data":      data,
+		})
+	}
+}
+
+// RequirePost 修改状态的命令只允许 POST 请求
+func RequirePost(r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return fmt.Errorf("%w: method %s not allowed, use POST", ErrBadRequest, r.Method)
+	}
+	return nil
+}
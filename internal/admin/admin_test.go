@@ -0,0 +1,61 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2023 Tencent.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/glycerine/goconvey/convey"
+)
+
+// serve 执行管理命令并解析输出
+func serve(handler Handler, method, target string) map[string]interface{} {
+	w := httptest.NewRecorder()
+	Wrap(handler).ServeHTTP(w, httptest.NewRequest(method, target, nil))
+	ret := make(map[string]interface{})
+	So(json.Unmarshal(w.Body.Bytes(), &ret), ShouldBeNil)
+	So(w.Header().Get("Content-Type"), ShouldEqual, "application/json; charset=utf-8")
+	return ret
+}
+
+func TestWrap(t *testing.T) {
+	Convey("测试管理命令输出格式", t, func() {
+		ret := serve(func(r *http.Request) (interface{}, error) {
+			return map[string]string{"service": r.Form.Get("service")}, nil
+		}, http.MethodGet, "/cmds/etcd/test?service=greeter")
+		So(ret["errorcode"], ShouldEqual, 0)
+		So(ret["data"], ShouldResemble, map[string]interface{}{"service": "greeter"})
+
+		ret = serve(func(r *http.Request) (interface{}, error) {
+			return nil, RequirePost(r)
+		}, http.MethodGet, "/cmds/etcd/test")
+		So(ret["errorcode"], ShouldEqual, errCodeBadRequest)
+		So(ret["message"], ShouldContainSubstring, "use POST")
+
+		ret = serve(func(r *http.Request) (interface{}, error) {
+			return nil, RequirePost(r)
+		}, http.MethodPost, "/cmds/etcd/test")
+		So(ret["errorcode"], ShouldEqual, 0)
+
+		ret = serve(func(r *http.Request) (interface{}, error) {
+			return nil, errors.New("etcd unavailable")
+		}, http.MethodGet, "/cmds/etcd/test")
+		So(ret["errorcode"], ShouldEqual, errCodeServer)
+		So(ret["message"], ShouldEqual, "etcd unavailable")
+	})
+}
@@ -0,0 +1,129 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2025 Tencent.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+// Package metrics 插件的监控指标，通过 trpc-go metrics 上报到框架中注册的 sink
+package metrics
+
+import (
+	"sync/atomic"
+	"time"
+
+	"trpc.group/trpc-go/trpc-go/metrics"
+)
+
+// prefix 所有指标名的前缀
+const prefix = "trpc.naming.etcd."
+
+// 计数器
+const (
+	// RegisterSuccess 实例注册成功次数
+	RegisterSuccess = prefix + "registry.register.success"
+	// RegisterFail 实例注册失败次数
+	RegisterFail = prefix + "registry.register.fail"
+	// RegisterLeaseExpired 实例的租约失效后重新注册的次数
+	RegisterLeaseExpired = prefix + "registry.lease_expired"
+	// LeaseGrant 新建租约次数
+	LeaseGrant = prefix + "lease.grant"
+	// LeaseReuseFail 复用租约时续约失败、需要新建租约的次数
+	LeaseReuseFail = prefix + "lease.reuse_fail"
+	// LeaseLost 自动续约异常停止、租约失效的次数
+	LeaseLost = prefix + "lease.lost"
+	// DiscoveryCacheHit 服务发现命中缓存次数
+	DiscoveryCacheHit = prefix + "discovery.cache.hit"
+	// DiscoveryCacheMiss 服务发现没有命中缓存、从 etcd 获取的次数
+	DiscoveryCacheMiss = prefix + "discovery.cache.miss"
+	// DiscoveryStale etcd 不可用时使用过期缓存或本地快照的次数
+	DiscoveryStale = prefix + "discovery.stale"
+	// DiscoveryListFail 服务发现失败次数
+	DiscoveryListFail = prefix + "discovery.list.fail"
+	// WatchRestart watch 断开后重连次数
+	WatchRestart = prefix + "discovery.watch.restart"
+	// WatchResync watch 无法续传、全量同步的次数
+	WatchResync = prefix + "discovery.watch.resync"
+	// CacheUpdate 根据 watch 变更更新缓存的次数
+	CacheUpdate = prefix + "discovery.cache.update"
+	// SelectSuccess 选择节点成功次数
+	SelectSuccess = prefix + "selector.select.success"
+	// SelectFail 选择节点失败次数
+	SelectFail = prefix + "selector.select.fail"
+)
+
+// 仪表盘
+const (
+	// Leases 进程内所有租约管理当前持有的租约数
+	Leases = prefix + "lease.count"
+	// Nodes 服务的节点数，维度 plugin 为插件名，service 为服务名
+	Nodes = prefix + "discovery.nodes"
+)
+
+// etcd 请求，指标名为 prefix + "etcd." + 请求 + 后缀
+const (
+	// EtcdGet 读取节点
+	EtcdGet = "get"
+	// EtcdPut 写入节点
+	EtcdPut = "put"
+	// EtcdDelete 删除节点
+	EtcdDelete = "delete"
+	// EtcdGrant 新建租约
+	EtcdGrant = "grant"
+	// EtcdKeepAliveOnce 续约一次
+	EtcdKeepAliveOnce = "keepalive_once"
+	// EtcdRevoke 撤销租约
+	EtcdRevoke = "revoke"
+
+	// latencySuffix etcd 请求耗时直方图的后缀，单位毫秒
+	latencySuffix = ".latency_ms"
+	// failSuffix etcd 请求失败计数器的后缀
+	failSuffix = ".fail"
+	// dimensionPlugin 插件名维度
+	dimensionPlugin = "plugin"
+	// dimensionService 服务名维度
+	dimensionService = "service"
+)
+
+// latencyBounds etcd 请求耗时的分桶，单位毫秒
+var latencyBounds = metrics.NewValueBounds(1, 2, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000)
+
+// leases 进程内所有租约管理持有的租约数，使用原子操作读写
+var leases int64
+
+// Incr 计数器加一
+func Incr(name string) {
+	metrics.IncrCounter(name, 1)
+}
+
+// SetGauge 设置仪表盘的值
+func SetGauge(name string, value int) {
+	metrics.SetGauge(name, float64(value))
+}
+
+// AddLeases 调整进程内持有的租约数并上报，delta 为负数时减少
+func AddLeases(delta int) {
+	SetGauge(Leases, int(atomic.AddInt64(&leases, int64(delta))))
+}
+
+// SetNodes 设置插件 plugin 中服务的节点数
+func SetNodes(plugin, serviceName string, count int) {
+	_ = metrics.ReportMultiDimensionMetricsX(Nodes,
+		[]*metrics.Dimension{{Name: dimensionPlugin, Value: plugin}, {Name: dimensionService, Value: serviceName}},
+		[]*metrics.Metrics{metrics.NewMetrics(Nodes, float64(count), metrics.PolicySET)})
+}
+
+// ObserveEtcd 记录一次 etcd 请求的耗时，失败时增加失败次数
+func ObserveEtcd(op string, start time.Time, err error) {
+	name := prefix + "etcd." + op
+	metrics.AddSample(name+latencySuffix, latencyBounds, float64(time.Since(start))/float64(time.Millisecond))
+	if err != nil {
+		metrics.IncrCounter(name+failSuffix, 1)
+	}
+}
@@ -0,0 +1,108 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2023 Tencent.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package metrics
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"trpc.group/trpc-go/trpc-go/metrics"
+
+	. "github.com/glycerine/goconvey/convey"
+)
+
+// recordSink 记录上报的指标
+type recordSink struct {
+	mu      sync.Mutex
+	records []metrics.Record
+}
+
+// Name 返回 sink 名
+func (s *recordSink) Name() string {
+	return "naming-etcd-test"
+}
+
+// Report 记录一条上报
+func (s *recordSink) Report(rec metrics.Record, opts ...metrics.Option) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = append(s.records, rec)
+	return nil
+}
+
+// find 返回名字为 name 的第一条指标
+func (s *recordSink) find(name string) (metrics.Record, *metrics.Metrics, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, rec := range s.records {
+		for _, m := range rec.GetMetrics() {
+			if m.Name() == name {
+				return rec, m, true
+			}
+		}
+	}
+	return metrics.Record{}, nil, false
+}
+
+func TestMetrics(t *testing.T) {
+	sink := &recordSink{}
+	metrics.RegisterMetricsSink(sink)
+	Convey("测试指标上报", t, func() {
+		Incr(RegisterSuccess)
+		_, m, ok := sink.find(RegisterSuccess)
+		So(ok, ShouldBeTrue)
+		So(m.Value(), ShouldEqual, 1)
+		So(m.Policy(), ShouldEqual, metrics.PolicySUM)
+
+		SetGauge(Leases, 3)
+		_, m, ok = sink.find(Leases)
+		So(ok, ShouldBeTrue)
+		So(m.Value(), ShouldEqual, 3)
+		So(m.Policy(), ShouldEqual, metrics.PolicySET)
+
+		// 多个租约管理的租约数累加
+		AddLeases(2)
+		AddLeases(1)
+		AddLeases(-1)
+		So(atomic.LoadInt64(&leases), ShouldEqual, 2)
+		sink.mu.Lock()
+		rec := sink.records[len(sink.records)-1]
+		sink.mu.Unlock()
+		So(rec.GetMetrics()[0].Name(), ShouldEqual, Leases)
+		So(rec.GetMetrics()[0].Value(), ShouldEqual, 2)
+		AddLeases(-2)
+
+		SetNodes("etcd", "trpc.test.helloworld.Greeter", 2)
+		rec, m, ok = sink.find(Nodes)
+		So(ok, ShouldBeTrue)
+		So(m.Value(), ShouldEqual, 2)
+		So(rec.GetDimensions(), ShouldResemble, []*metrics.Dimension{{Name: dimensionPlugin, Value: "etcd"},
+			{Name: dimensionService, Value: "trpc.test.helloworld.Greeter"}})
+
+		// 成功的请求只记录耗时，失败的请求增加失败次数
+		ObserveEtcd(EtcdGet, time.Now(), nil)
+		_, m, ok = sink.find(prefix + "etcd.get" + latencySuffix)
+		So(ok, ShouldBeTrue)
+		So(m.Policy(), ShouldEqual, metrics.PolicyHistogram)
+		_, _, ok = sink.find(prefix + "etcd.get" + failSuffix)
+		So(ok, ShouldBeFalse)
+		ObserveEtcd(EtcdPut, time.Now(), errors.New("timeout"))
+		_, m, ok = sink.find(prefix + "etcd.put" + failSuffix)
+		So(ok, ShouldBeTrue)
+		So(m.Value(), ShouldEqual, 1)
+	})
+}
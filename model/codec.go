@@ -0,0 +1,174 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2025 Tencent.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+const (
+	// CodecJSON json 编码，默认编码
+	CodecJSON = "json"
+	// CodecProto protobuf 编码
+	CodecProto = "proto"
+
+	// formatMagic 带格式标记的数据的首字节，json 数据以 { 开头，不会与其冲突
+	formatMagic = 0x00
+	// formatHeaderLen 格式标记长度，依次为 formatMagic、编码 id、编码版本
+	formatHeaderLen = 3
+)
+
+var (
+	// ErrUnknownCodec 未知的节点编码
+	ErrUnknownCodec = errors.New("unknown node codec")
+
+	codecMu     sync.RWMutex
+	codecs      = make(map[string]codecEntry)
+	codecsByID  = make(map[byte]codecEntry)
+	defaultJSON = &jsonCodec{}
+)
+
+// Codec 节点编码，写入 etcd 的数据带有格式标记，读取时按标记选择编码，支持迁移期间混合读取
+type Codec interface {
+	// Name 编码名字，用于配置
+	Name() string
+	// Version 编码版本，写入格式标记
+	Version() byte
+	// Marshal 序列化节点，不包含格式标记
+	Marshal(node *Node) ([]byte, error)
+	// Unmarshal 反序列化节点，不包含格式标记
+	Unmarshal(b []byte) (*Node, error)
+}
+
+// codecEntry 注册的编码
+type codecEntry struct {
+	id    byte
+	codec Codec
+}
+
+func init() {
+	RegisterCodec(1, &protoCodec{})
+}
+
+// RegisterCodec 以 id 注册节点编码，id 写入格式标记，必须大于 0 且全局唯一，0 保留给不带标记的 json
+func RegisterCodec(id byte, codec Codec) {
+	if id == 0 {
+		panic("model: codec id 0 is reserved for json")
+	}
+	codecMu.Lock()
+	defer codecMu.Unlock()
+	if old, ok := codecsByID[id]; ok && old.codec.Name() != codec.Name() {
+		panic(fmt.Sprintf("model: codec id %d is already registered by %s", id, old.codec.Name()))
+	}
+	entry := codecEntry{id: id, codec: codec}
+	codecs[codec.Name()] = entry
+	codecsByID[id] = entry
+}
+
+// GetCodec 按名字获取节点编码，名字为空时返回默认的 json 编码
+func GetCodec(name string) (Codec, error) {
+	if name == "" || name == CodecJSON {
+		return defaultJSON, nil
+	}
+	codecMu.RLock()
+	defer codecMu.RUnlock()
+	entry, ok := codecs[name]
+	if !ok {
+		return nil, ErrUnknownCodec
+	}
+	return entry.codec, nil
+}
+
+// MarshalWith 使用 codec 序列化节点并添加格式标记，json 编码不添加标记，与之前写入的数据兼容
+func MarshalWith(codec Codec, node *Node) (string, error) {
+	if codec == nil || codec.Name() == CodecJSON {
+		return Marshal(node)
+	}
+	codecMu.RLock()
+	entry, ok := codecs[codec.Name()]
+	codecMu.RUnlock()
+	if !ok {
+		return "", ErrUnknownCodec
+	}
+	b, err := codec.Marshal(node)
+	if err != nil {
+		return "", err
+	}
+	value := make([]byte, 0, formatHeaderLen+len(b))
+	value = append(value, formatMagic, entry.id, codec.Version())
+	return string(append(value, b...)), nil
+}
+
+// CodecOf 按格式标记获取数据使用的编码，没有标记时返回 json 编码，用于修改节点后按原来的编码写回
+func CodecOf(b []byte) (Codec, error) {
+	if len(b) == 0 || b[0] != formatMagic {
+		return defaultJSON, nil
+	}
+	if len(b) < formatHeaderLen {
+		return nil, ErrUnknownCodec
+	}
+	codecMu.RLock()
+	entry, ok := codecsByID[b[1]]
+	codecMu.RUnlock()
+	if !ok {
+		return nil, ErrUnknownCodec
+	}
+	if b[2] > entry.codec.Version() {
+		return nil, fmt.Errorf("%w: %s version %d is newer than %d", ErrUnknownCodec, entry.codec.Name(),
+			b[2], entry.codec.Version())
+	}
+	return entry.codec, nil
+}
+
+// decode 按格式标记选择编码反序列化节点，没有标记时使用 json
+func decode(b []byte) (*Node, error) {
+	codec, err := CodecOf(b)
+	if err != nil {
+		return nil, err
+	}
+	if codec == defaultJSON {
+		return defaultJSON.Unmarshal(b)
+	}
+	return codec.Unmarshal(b[formatHeaderLen:])
+}
+
+// jsonCodec json 编码
+type jsonCodec struct{}
+
+// Name 编码名字
+func (c *jsonCodec) Name() string {
+	return CodecJSON
+}
+
+// Version 编码版本
+func (c *jsonCodec) Version() byte {
+	return 1
+}
+
+// Marshal 序列化节点
+func (c *jsonCodec) Marshal(node *Node) ([]byte, error) {
+	return json.Marshal(node)
+}
+
+// Unmarshal 反序列化节点
+func (c *jsonCodec) Unmarshal(b []byte) (*Node, error) {
+	var node *Node
+	if err := json.Unmarshal(b, &node); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
@@ -0,0 +1,135 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2023 Tencent.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package model
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func Test_Codec(t *testing.T) {
+	node := &Node{
+		Name:      "service",
+		ID:        "127.0.0.1-8000-1",
+		Address:   "127.0.0.1:8000",
+		Metadata:  map[string]string{"env": "prod", "zone": "gz-1"},
+		Weight:    100,
+		Status:    NodeStatusDraining,
+		Protocol:  "trpc",
+		Network:   "tcp",
+		Version:   "v1.2.0",
+		SetName:   "set.gz.1",
+		Zone:      "gz-1",
+		Tags:      []string{"canary", "gpu"},
+		StartTime: 1700000000,
+	}
+	for _, name := range []string{"", CodecJSON, CodecProto} {
+		t.Run(name, func(t *testing.T) {
+			codec, err := GetCodec(name)
+			if err != nil {
+				t.Fatalf("GetCodec() error = %v", err)
+			}
+			value, err := MarshalWith(codec, node)
+			if err != nil {
+				t.Fatalf("MarshalWith() error = %v", err)
+			}
+			// json 不带格式标记，与之前写入的数据兼容
+			if (value[0] == formatMagic) != (codec.Name() != CodecJSON) {
+				t.Errorf("MarshalWith() format marker of %s = %v", codec.Name(), value[0])
+			}
+			if got, err := CodecOf([]byte(value)); err != nil || got.Name() != codec.Name() {
+				t.Errorf("CodecOf() = %v, %v, want %s", got, err, codec.Name())
+			}
+			got, err := Unmarshal([]byte(value))
+			if err != nil {
+				t.Fatalf("Unmarshal() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, node) {
+				t.Errorf("Unmarshal() = %+v, want %+v", got, node)
+			}
+		})
+	}
+}
+
+func Test_protoWireFormat(t *testing.T) {
+	// 编码格式在 Go 中定义，固定编码结果防止字段编号被意外修改
+	node := &Node{
+		Name:      "a",
+		Metadata:  map[string]string{"k": "v"},
+		Weight:    5,
+		Tags:      []string{"x"},
+		StartTime: 1,
+	}
+	want := []byte{
+		0x0a, 0x01, 'a', // name = 1
+		0x22, 0x06, 0x0a, 0x01, 'k', 0x12, 0x01, 'v', // metadata = 4
+		0x28, 0x05, // weight = 5
+		0x62, 0x01, 'x', // tags = 12
+		0x68, 0x01, // start_time = 13
+	}
+	got, err := (&protoCodec{}).Marshal(node)
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Marshal() = %x, want %x", got, want)
+	}
+}
+
+func Test_decode(t *testing.T) {
+	if _, err := GetCodec("xml"); err != ErrUnknownCodec {
+		t.Errorf("GetCodec() error = %v, want %v", err, ErrUnknownCodec)
+	}
+	// 没有元数据和权重的节点
+	codec, _ := GetCodec(CodecProto)
+	value, _ := MarshalWith(codec, &Node{Name: "service"})
+	if got, err := Unmarshal([]byte(value)); err != nil || !reflect.DeepEqual(got, &Node{Name: "service"}) {
+		t.Errorf("Unmarshal() = %+v, %v", got, err)
+	}
+	tests := []struct {
+		name  string
+		value []byte
+	}{
+		{name: "short header", value: []byte{formatMagic, 1}},
+		{name: "unknown codec", value: []byte{formatMagic, 200, 1}},
+		{name: "newer version", value: []byte{formatMagic, 1, 2}},
+		{name: "invalid proto", value: []byte{formatMagic, 1, 1, 0x0a, 0x10}},
+		{name: "invalid json", value: []byte("{")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Unmarshal(tt.value); err == nil {
+				t.Errorf("Unmarshal() error = nil, want error")
+			}
+		})
+	}
+	if _, err := Unmarshal([]byte{formatMagic, 1, 2}); !errors.Is(err, ErrUnknownCodec) {
+		t.Errorf("Unmarshal() error = %v, want %v", err, ErrUnknownCodec)
+	}
+	// 未知字段被忽略
+	value = string(append([]byte(value), 0x78, 0x01))
+	if got, err := Unmarshal([]byte(value)); err != nil || got.Name != "service" {
+		t.Errorf("Unmarshal() with unknown field = %+v, %v", got, err)
+	}
+}
+
+func Test_RegisterCodec(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("RegisterCodec() with reserved id did not panic")
+		}
+	}()
+	RegisterCodec(0, &jsonCodec{})
+}
@@ -19,17 +19,45 @@ import (
 	"fmt"
 	"path"
 	"strings"
+	"time"
 
 	tregistry "trpc.group/trpc-go/trpc-go/naming/registry"
 )
 
-// Node 服务节点信息
+const (
+	// NodeStatusDraining 节点下线中，不再接收新的请求
+	NodeStatusDraining = "draining"
+	// MetadataKeyStatus 节点状态在 trpc 节点元数据中的 key
+	MetadataKeyStatus = "etcd_node_status"
+	// NodeStatusUnhealthy 节点不健康，不再接收新的请求
+	NodeStatusUnhealthy = "unhealthy"
+	// MetadataKeyID 节点 id 在 trpc 节点元数据中的 key
+	MetadataKeyID = "etcd_node_id"
+	// MetadataKeyVersion 服务版本在 trpc 节点元数据中的 key，注册时元数据中已有该 key 时不覆盖
+	MetadataKeyVersion = "version"
+	// MetadataKeyZone 可用区在 trpc 节点元数据中的 key，注册时元数据中已有该 key 时不覆盖
+	MetadataKeyZone = "zone"
+	// MetadataKeyTags 标签在 trpc 节点元数据中的 key，值为 []string
+	MetadataKeyTags = "etcd_node_tags"
+	// MetadataKeyStartTime 启动时间在 trpc 节点元数据中的 key，值为 time.Time
+	MetadataKeyStartTime = "etcd_node_start_time"
+)
+
+// Node 服务节点信息，新增字段都为可选字段，与之前写入的 json 数据兼容
 type Node struct {
-	Name     string            `json:"name"`     // 服务名
-	ID       string            `json:"id"`       // id
-	Address  string            `json:"address"`  // ip:port
-	Metadata map[string]string `json:"metadata"` // 元数据
-	Weight   int               `json:"weight"`   // 权重
+	Name      string            `json:"name"`                 // 服务名
+	ID        string            `json:"id"`                   // id
+	Address   string            `json:"address"`              // ip:port
+	Metadata  map[string]string `json:"metadata"`             // 元数据
+	Weight    int               `json:"weight"`               // 权重
+	Status    string            `json:"status,omitempty"`     // 节点状态，为空表示正常
+	Protocol  string            `json:"protocol,omitempty"`   // 业务协议 trpc/http
+	Network   string            `json:"network,omitempty"`    // 网络层协议 tcp/udp
+	Version   string            `json:"version,omitempty"`    // 服务版本
+	SetName   string            `json:"set_name,omitempty"`   // set 名
+	Zone      string            `json:"zone,omitempty"`       // 可用区
+	Tags      []string          `json:"tags,omitempty"`       // 标签
+	StartTime int64             `json:"start_time,omitempty"` // 启动时间，unix 秒
 }
 
 // Marshal 序列化节点
@@ -41,13 +69,9 @@ func Marshal(node *Node) (string, error) {
 	return string(b), nil
 }
 
-// Unmarshal 反序列化节点
+// Unmarshal 反序列化节点，按数据中的格式标记选择编码，没有标记时使用 json
 func Unmarshal(b []byte) (*Node, error) {
-	var node *Node
-	if err := json.Unmarshal(b, &node); err != nil {
-		return nil, err
-	}
-	return node, nil
+	return decode(b)
 }
 
 // ConvertNode 将缓存在etcd中的节点转为trpc的节点
@@ -56,14 +80,49 @@ func ConvertNode(node *Node) *tregistry.Node {
 	for k, v := range node.Metadata {
 		meta[k] = v
 	}
+	if node.Status != "" {
+		meta[MetadataKeyStatus] = node.Status
+	}
+	if node.ID != "" {
+		meta[MetadataKeyID] = node.ID
+	}
+	setDefaultMetadata(meta, MetadataKeyVersion, node.Version)
+	setDefaultMetadata(meta, MetadataKeyZone, node.Zone)
+	if len(node.Tags) > 0 {
+		meta[MetadataKeyTags] = node.Tags
+	}
+	if node.StartTime > 0 {
+		meta[MetadataKeyStartTime] = time.Unix(node.StartTime, 0)
+	}
 	return &tregistry.Node{
 		ServiceName: node.Name,
 		Address:     node.Address,
+		Network:     node.Network,
+		Protocol:    node.Protocol,
+		SetName:     node.SetName,
 		Metadata:    meta,
 		Weight:      node.Weight,
 	}
 }
 
+// setDefaultMetadata 元数据中没有 key 且 value 不为空时设置
+func setDefaultMetadata(meta map[string]interface{}, key, value string) {
+	if value == "" {
+		return
+	}
+	if _, ok := meta[key]; !ok {
+		meta[key] = value
+	}
+}
+
+// NodeID 获取 trpc 节点的 id，没有 id 时返回节点地址
+func NodeID(node *tregistry.Node) string {
+	if id, ok := node.Metadata[MetadataKeyID].(string); ok && id != "" {
+		return id
+	}
+	return node.Address
+}
+
 // NodePath 节点路径
 func NodePath(prefix, service, id string) string {
 	service = strings.Replace(service, "/", "-", -1)
@@ -71,12 +130,37 @@ func NodePath(prefix, service, id string) string {
 	return path.Join(prefix, service, id)
 }
 
-// ServicePath 服务路径
+// ServicePath 服务路径，以 / 结尾，保证按前缀查询时不会匹配到名字以该服务名开头的其他服务。
+// 节点路径为 ServicePath + id，与之前注册的节点兼容
 func ServicePath(prefix, service string) string {
-	if service == "" {
-		return prefix
+	p := prefix
+	if service != "" {
+		p = path.Join(prefix, strings.Replace(service, "/", "-", -1))
 	}
-	return path.Join(prefix, strings.Replace(service, "/", "-", -1), "/")
+	if p == "" || strings.HasSuffix(p, "/") {
+		return p
+	}
+	return p + "/"
+}
+
+// IsServiceNode 判断 key 是否为服务路径下的节点，不包括更深层级的路径
+func IsServiceNode(servicePath, key string) bool {
+	if !strings.HasPrefix(key, servicePath) {
+		return false
+	}
+	return !strings.Contains(strings.TrimPrefix(key, servicePath), "/")
+}
+
+// IsDraining 判断 trpc 节点是否处于下线中
+func IsDraining(node *tregistry.Node) bool {
+	status, ok := node.Metadata[MetadataKeyStatus].(string)
+	return ok && status == NodeStatusDraining
+}
+
+// IsUnhealthy 判断 trpc 节点是否不健康
+func IsUnhealthy(node *tregistry.Node) bool {
+	status, ok := node.Metadata[MetadataKeyStatus].(string)
+	return ok && status == NodeStatusUnhealthy
 }
 
 // ServiceID 构造生成service实例名 防止重名
@@ -13,7 +13,12 @@
 
 package model
 
-import "testing"
+import (
+	"testing"
+	"time"
+
+	tregistry "trpc.group/trpc-go/trpc-go/naming/registry"
+)
 
 func Test_NodePath(t *testing.T) {
 	type args struct {
@@ -93,7 +98,35 @@ func Test_ServicePath(t *testing.T) {
 				prefix:  "prefix",
 				service: "service",
 			},
-			want: "prefix/service",
+			want: "prefix/service/",
+		},
+		{
+			name: "prefix with slash",
+			args: args{
+				prefix:  "/prefix/",
+				service: "trpc.app.Greeter",
+			},
+			want: "/prefix/trpc.app.Greeter/",
+		},
+		{
+			name: "service with slash",
+			args: args{
+				prefix:  "prefix",
+				service: "a/b",
+			},
+			want: "prefix/a-b/",
+		},
+		{
+			name: "empty service",
+			args: args{
+				prefix: "prefix",
+			},
+			want: "prefix/",
+		},
+		{
+			name: "empty prefix and service",
+			args: args{},
+			want: "",
 		},
 	}
 	for _, tt := range tests {
@@ -104,3 +137,139 @@ func Test_ServicePath(t *testing.T) {
 		})
 	}
 }
+
+func Test_IsServiceNode(t *testing.T) {
+	servicePath := ServicePath("prefix", "trpc.app.Greeter")
+	tests := []struct {
+		name string
+		key  string
+		want bool
+	}{
+		{
+			name: "node",
+			key:  NodePath("prefix", "trpc.app.Greeter", "id"),
+			want: true,
+		},
+		{
+			name: "other service with same prefix",
+			key:  NodePath("prefix", "trpc.app.Greeter2", "id"),
+			want: false,
+		},
+		{
+			name: "nested path",
+			key:  "prefix/trpc.app.Greeter/sub/id",
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsServiceNode(servicePath, tt.key); got != tt.want {
+				t.Errorf("IsServiceNode() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_ConvertNode(t *testing.T) {
+	tests := []struct {
+		name     string
+		node     *Node
+		draining bool
+	}{
+		{
+			name: "serving",
+			node: &Node{
+				Name:     "service",
+				ID:       "127.0.0.1-8000-1",
+				Address:  "127.0.0.1:8000",
+				Metadata: map[string]string{"key": "value"},
+				Weight:   10,
+			},
+		},
+		{
+			name: "draining",
+			node: &Node{
+				Name:    "service",
+				Address: "127.0.0.1:8000",
+				Status:  NodeStatusDraining,
+			},
+			draining: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ConvertNode(tt.node)
+			if got.ServiceName != tt.node.Name || got.Address != tt.node.Address || got.Weight != tt.node.Weight {
+				t.Errorf("ConvertNode() = %v, want %v", got, tt.node)
+			}
+			for k, v := range tt.node.Metadata {
+				if got.Metadata[k] != v {
+					t.Errorf("ConvertNode() metadata %s = %v, want %v", k, got.Metadata[k], v)
+				}
+			}
+			wantID := tt.node.ID
+			if wantID == "" {
+				wantID = tt.node.Address
+			}
+			if NodeID(got) != wantID {
+				t.Errorf("NodeID() = %v, want %v", NodeID(got), wantID)
+			}
+			if IsDraining(got) != tt.draining {
+				t.Errorf("IsDraining() = %v, want %v", IsDraining(got), tt.draining)
+			}
+		})
+	}
+	if IsDraining(&tregistry.Node{}) {
+		t.Errorf("IsDraining() of empty node = true, want false")
+	}
+}
+
+func Test_NodeCompatible(t *testing.T) {
+	// 之前写入的数据可以正常读取
+	old := `{"name":"service","id":"127.0.0.1-8000-1","address":"127.0.0.1:8000","metadata":null,"weight":1}`
+	node, err := Unmarshal([]byte(old))
+	if err != nil || node.Address != "127.0.0.1:8000" || node.Protocol != "" || node.Tags != nil {
+		t.Errorf("Unmarshal() = %+v, %v", node, err)
+	}
+	// 新增字段为空时不写入
+	value, err := Marshal(node)
+	if err != nil || value != old {
+		t.Errorf("Marshal() = %s, %v, want %s", value, err, old)
+	}
+}
+
+func Test_ConvertNodeFields(t *testing.T) {
+	node := &Node{
+		Name:      "service",
+		Address:   "127.0.0.1:8000",
+		Metadata:  map[string]string{MetadataKeyZone: "gz-2"},
+		Protocol:  "trpc",
+		Network:   "tcp",
+		Version:   "v1.2.0",
+		SetName:   "set.gz.1",
+		Zone:      "gz-1",
+		Tags:      []string{"canary"},
+		StartTime: 1700000000,
+		Status:    NodeStatusUnhealthy,
+	}
+	got := ConvertNode(node)
+	if got.Protocol != "trpc" || got.Network != "tcp" || got.SetName != "set.gz.1" {
+		t.Errorf("ConvertNode() = %+v", got)
+	}
+	if got.Metadata[MetadataKeyVersion] != "v1.2.0" {
+		t.Errorf("ConvertNode() version = %v", got.Metadata[MetadataKeyVersion])
+	}
+	// 注册时元数据中的值优先
+	if got.Metadata[MetadataKeyZone] != "gz-2" {
+		t.Errorf("ConvertNode() zone = %v, want gz-2", got.Metadata[MetadataKeyZone])
+	}
+	if tags, ok := got.Metadata[MetadataKeyTags].([]string); !ok || len(tags) != 1 || tags[0] != "canary" {
+		t.Errorf("ConvertNode() tags = %v", got.Metadata[MetadataKeyTags])
+	}
+	if startTime, ok := got.Metadata[MetadataKeyStartTime].(time.Time); !ok || startTime.Unix() != node.StartTime {
+		t.Errorf("ConvertNode() start time = %v", got.Metadata[MetadataKeyStartTime])
+	}
+	if !IsUnhealthy(got) || IsDraining(got) {
+		t.Errorf("IsUnhealthy() = %v, IsDraining() = %v", IsUnhealthy(got), IsDraining(got))
+	}
+}
@@ -0,0 +1,232 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2025 Tencent.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package model
+
+import (
+	"errors"
+	"sort"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// protobuf 中节点的字段编号。编码格式以此处定义为准，不再维护单独的 .proto 文件，
+// 修改时只能新增字段编号，不能修改或复用已有编号。等价的消息定义如下：
+//
+//	message Node {
+//	  string name = 1;
+//	  string id = 2;
+//	  string address = 3;
+//	  map<string, string> metadata = 4;
+//	  int64 weight = 5;
+//	  string status = 6;
+//	  string protocol = 7;
+//	  string network = 8;
+//	  string version = 9;
+//	  string set_name = 10;
+//	  string zone = 11;
+//	  repeated string tags = 12;
+//	  int64 start_time = 13;
+//	}
+const (
+	protoFieldName      protowire.Number = 1
+	protoFieldID        protowire.Number = 2
+	protoFieldAddress   protowire.Number = 3
+	protoFieldMetadata  protowire.Number = 4
+	protoFieldWeight    protowire.Number = 5
+	protoFieldStatus    protowire.Number = 6
+	protoFieldProtocol  protowire.Number = 7
+	protoFieldNetwork   protowire.Number = 8
+	protoFieldVersion   protowire.Number = 9
+	protoFieldSetName   protowire.Number = 10
+	protoFieldZone      protowire.Number = 11
+	protoFieldTags      protowire.Number = 12
+	protoFieldStartTime protowire.Number = 13
+
+	protoFieldMapKey   protowire.Number = 1
+	protoFieldMapValue protowire.Number = 2
+)
+
+var (
+	errInvalidProto = errors.New("invalid protobuf node")
+)
+
+// protoCodec protobuf 编码，字段编号见 protoField 常量
+type protoCodec struct{}
+
+// Name 编码名字
+func (c *protoCodec) Name() string {
+	return CodecProto
+}
+
+// Version 编码版本
+func (c *protoCodec) Version() byte {
+	return 1
+}
+
+// Marshal 序列化节点
+func (c *protoCodec) Marshal(node *Node) ([]byte, error) {
+	var b []byte
+	b = appendString(b, protoFieldName, node.Name)
+	b = appendString(b, protoFieldID, node.ID)
+	b = appendString(b, protoFieldAddress, node.Address)
+	// 按 key 排序，保证相同节点的编码结果一致
+	keys := make([]string, 0, len(node.Metadata))
+	for k := range node.Metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var entry []byte
+		entry = appendString(entry, protoFieldMapKey, k)
+		entry = appendString(entry, protoFieldMapValue, node.Metadata[k])
+		b = protowire.AppendTag(b, protoFieldMetadata, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	if node.Weight != 0 {
+		b = protowire.AppendTag(b, protoFieldWeight, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(int64(node.Weight)))
+	}
+	b = appendString(b, protoFieldStatus, node.Status)
+	b = appendString(b, protoFieldProtocol, node.Protocol)
+	b = appendString(b, protoFieldNetwork, node.Network)
+	b = appendString(b, protoFieldVersion, node.Version)
+	b = appendString(b, protoFieldSetName, node.SetName)
+	b = appendString(b, protoFieldZone, node.Zone)
+	for _, tag := range node.Tags {
+		b = protowire.AppendTag(b, protoFieldTags, protowire.BytesType)
+		b = protowire.AppendString(b, tag)
+	}
+	if node.StartTime != 0 {
+		b = protowire.AppendTag(b, protoFieldStartTime, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(node.StartTime))
+	}
+	return b, nil
+}
+
+// Unmarshal 反序列化节点，忽略未知字段
+func (c *protoCodec) Unmarshal(b []byte) (*Node, error) {
+	node := &Node{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, errInvalidProto
+		}
+		b = b[n:]
+		switch {
+		case typ == protowire.VarintType && (num == protoFieldWeight || num == protoFieldStartTime):
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return nil, errInvalidProto
+			}
+			if num == protoFieldWeight {
+				node.Weight = int(int64(v))
+			} else {
+				node.StartTime = int64(v)
+			}
+			b = b[n:]
+		case typ == protowire.BytesType && num >= protoFieldName && num <= protoFieldTags && num != protoFieldWeight:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, errInvalidProto
+			}
+			if err := node.setProtoField(num, v); err != nil {
+				return nil, err
+			}
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return nil, errInvalidProto
+			}
+			b = b[n:]
+		}
+	}
+	return node, nil
+}
+
+// setProtoField 设置 protobuf 中长度前缀类型的字段
+func (n *Node) setProtoField(num protowire.Number, v []byte) error {
+	switch num {
+	case protoFieldName:
+		n.Name = string(v)
+	case protoFieldID:
+		n.ID = string(v)
+	case protoFieldAddress:
+		n.Address = string(v)
+	case protoFieldStatus:
+		n.Status = string(v)
+	case protoFieldProtocol:
+		n.Protocol = string(v)
+	case protoFieldNetwork:
+		n.Network = string(v)
+	case protoFieldVersion:
+		n.Version = string(v)
+	case protoFieldSetName:
+		n.SetName = string(v)
+	case protoFieldZone:
+		n.Zone = string(v)
+	case protoFieldTags:
+		n.Tags = append(n.Tags, string(v))
+	case protoFieldMetadata:
+		k, val, err := consumeMapEntry(v)
+		if err != nil {
+			return err
+		}
+		if n.Metadata == nil {
+			n.Metadata = make(map[string]string)
+		}
+		n.Metadata[k] = val
+	}
+	return nil
+}
+
+// consumeMapEntry 解析 map<string, string> 的一个元素
+func consumeMapEntry(b []byte) (string, string, error) {
+	var key, value string
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return "", "", errInvalidProto
+		}
+		b = b[n:]
+		if typ != protowire.BytesType || (num != protoFieldMapKey && num != protoFieldMapValue) {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return "", "", errInvalidProto
+			}
+			b = b[n:]
+			continue
+		}
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return "", "", errInvalidProto
+		}
+		if num == protoFieldMapKey {
+			key = string(v)
+		} else {
+			value = string(v)
+		}
+		b = b[n:]
+	}
+	return key, value, nil
+}
+
+// appendString 添加 string 字段，空字符串不写入
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
@@ -15,6 +15,8 @@
 package naming
 
 import (
+	"time"
+
 	"trpc.group/trpc-go/trpc-naming-etcd/client"
 	"trpc.group/trpc-go/trpc-naming-etcd/discovery"
 
@@ -34,42 +36,119 @@ const (
 	pluginName = "etcd"
 )
 
-// Plugin 插件结构
-type Plugin struct{}
+// Register 以 name 注册 selector 插件，用于同时使用多个 etcd 集群，需要在 trpc.NewServer 之前调用。
+// 插件配置在 plugins.selector.<name> 下，调用方使用 <name>://service 寻址
+func Register(name string) {
+	plugin.Register(name, &Plugin{})
+}
+
+// Plugin 插件结构，每个插件名对应一个实例
+type Plugin struct {
+	discovery *discovery.Discovery
+	// release 释放插件使用的 etcd 客户端
+	release func() error
+}
 
 // Type 插件类型
 func (p *Plugin) Type() string {
 	return pluginType
 }
 
-// Setup 注册
+// FlexDependsOn 配置了共享 etcd 客户端插件时在其之后初始化
+func (p *Plugin) FlexDependsOn() []string {
+	return []string{client.PluginType + "-" + client.PluginName}
+}
+
+// Close 停止服务发现并释放 etcd 客户端，框架退出时调用
+func (p *Plugin) Close() error {
+	if p.discovery != nil {
+		p.discovery.Close()
+	}
+	if p.release == nil {
+		return nil
+	}
+	release := p.release
+	p.release = nil
+	return release()
+}
+
+// Setup 注册，selector 以插件名字注册
 func (p *Plugin) Setup(name string, decoder plugin.Decoder) error {
 	factoryCfg := &FactoryConfig{}
 	if err := decoder.Decode(factoryCfg); err != nil {
 		return err
 	}
-	etcdClient, err := client.GenerateEtcdClient(&client.Config{
-		Address:  factoryCfg.Address,
-		Timeout:  factoryCfg.Timeout,
-		Username: factoryCfg.Username,
-		Password: factoryCfg.Password,
-		Prefix:   factoryCfg.Prefix,
-		CertFile: factoryCfg.TLS.CertFile,
-		KeyFile:  factoryCfg.TLS.KeyFile,
-		CaFile:   factoryCfg.TLS.CaFile,
-	})
+	etcdClient, release, err := client.Resolve(factoryCfg.Client, factoryCfg.clientConfig())
 	if err != nil {
 		return err
 	}
 
 	d, err := discovery.NewDiscovery(etcdClient, &discovery.Config{
-		Prefix: factoryCfg.Prefix,
+		Name:                 name,
+		Prefix:               factoryCfg.Prefix,
+		SnapshotFile:         factoryCfg.Snapshot.File,
+		SnapshotInterval:     time.Duration(factoryCfg.Snapshot.Interval) * time.Second,
+		SnapshotMaxStaleness: time.Duration(factoryCfg.Snapshot.MaxStaleness) * time.Second,
+		CacheExpire:          time.Duration(factoryCfg.CacheExpire) * time.Second,
+		StaleWhileError:      factoryCfg.StaleWhileError,
 	})
 	if err != nil {
+		_ = release()
 		return err
 	}
-	tselector.Register(pluginName, selector.NewSelector(d, &selector.Config{
+	p.discovery = d.(*discovery.Discovery)
+	p.release = release
+	addDiscovery(name, p.discovery)
+	tselector.Register(name, selector.NewSelector(d, &selector.Config{
 		LoadBalancer: factoryCfg.LoadBalance.Name,
+		Outlier: selector.OutlierConfig{
+			Enable:             factoryCfg.Outlier.Enable,
+			ConsecutiveErrors:  factoryCfg.Outlier.ConsecutiveErrors,
+			ErrorRate:          factoryCfg.Outlier.ErrorRate,
+			MinRequests:        factoryCfg.Outlier.MinRequests,
+			Interval:           time.Duration(factoryCfg.Outlier.Interval) * time.Second,
+			BaseEjectionTime:   time.Duration(factoryCfg.Outlier.BaseEjectionTime) * time.Second,
+			MaxEjectionTime:    time.Duration(factoryCfg.Outlier.MaxEjectionTime) * time.Second,
+			MaxEjectionPercent: factoryCfg.Outlier.MaxEjectionPercent,
+		},
+		Rules: routeRules(factoryCfg.RouteRules),
+		Locality: selector.LocalityConfig{
+			Zone:              factoryCfg.Locality.Zone,
+			Region:            factoryCfg.Locality.Region,
+			ZoneKey:           factoryCfg.Locality.ZoneKey,
+			RegionKey:         factoryCfg.Locality.RegionKey,
+			MinHealthyPercent: factoryCfg.Locality.MinHealthyPercent,
+		},
 	}))
 	return nil
 }
+
+// clientConfig 插件自己的 etcd 客户端配置
+func (c *FactoryConfig) clientConfig() *client.Config {
+	return &client.Config{
+		Address:  c.Address,
+		Timeout:  c.Timeout,
+		Username: c.Username,
+		Password: c.Password,
+		Prefix:   c.Prefix,
+		CertFile: c.TLS.CertFile,
+		KeyFile:  c.TLS.KeyFile,
+		CaFile:   c.TLS.CaFile,
+	}
+}
+
+// routeRules 转换元数据路由规则配置
+func routeRules(cfgs []RouteRuleConfig) []selector.RouteRule {
+	rules := make([]selector.RouteRule, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		rule := selector.RouteRule{Service: cfg.Service}
+		for _, route := range cfg.Routes {
+			rule.Routes = append(rule.Routes, selector.Route{
+				Metadata:    route.Metadata,
+				ContextKeys: route.ContextKeys,
+			})
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
@@ -18,6 +18,9 @@ import (
 
 	"trpc.group/trpc-go/trpc-go"
 	_ "trpc.group/trpc-go/trpc-go/http"
+	tselector "trpc.group/trpc-go/trpc-go/naming/selector"
+	"trpc.group/trpc-go/trpc-go/plugin"
+	"trpc.group/trpc-go/trpc-naming-etcd/client"
 
 	. "github.com/glycerine/goconvey/convey"
 )
@@ -28,3 +31,46 @@ func TestPlugin_Setup(t *testing.T) {
 		So(s, ShouldNotBeNil)
 	})
 }
+
+// factoryDecoder 将配置直接写入插件配置
+type factoryDecoder struct {
+	cfg *FactoryConfig
+}
+
+// Decode 解析配置
+func (d *factoryDecoder) Decode(cfg interface{}) error {
+	*(cfg.(*FactoryConfig)) = *d.cfg
+	return nil
+}
+
+func TestRegister(t *testing.T) {
+	Convey("测试多个 etcd 集群的 selector", t, func() {
+		Register("etcd-sh")
+		p := plugin.Get(pluginType, "etcd-sh")
+		So(p, ShouldNotBeNil)
+		So(p.Setup("etcd-sh", &factoryDecoder{cfg: &FactoryConfig{
+			Address: "127.0.0.1:2379",
+			Prefix:  "/sh",
+		}}), ShouldBeNil)
+		s := tselector.Get("etcd-sh")
+		So(s, ShouldNotBeNil)
+		So(s, ShouldNotEqual, tselector.Get(pluginName))
+	})
+}
+
+func TestPlugin_Close(t *testing.T) {
+	Convey("插件关闭时释放共享 etcd 客户端", t, func() {
+		So(client.Register("etcd-close", &client.Config{Address: "127.0.0.1:2379"}), ShouldBeNil)
+		shared, err := client.Get("etcd-close")
+		So(err, ShouldBeNil)
+
+		Register("etcd-close")
+		p := plugin.Get(pluginType, "etcd-close").(*Plugin)
+		So(p.Setup("etcd-close", &factoryDecoder{cfg: &FactoryConfig{Client: "etcd-close"}}), ShouldBeNil)
+		So(client.Release("etcd-close"), ShouldBeNil)
+		So(shared.Ctx().Err(), ShouldBeNil)
+		So(p.Close(), ShouldBeNil)
+		So(shared.Ctx().Err(), ShouldNotBeNil)
+		So(p.Close(), ShouldBeNil)
+	})
+}
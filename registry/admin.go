@@ -0,0 +1,66 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2025 Tencent.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package registry
+
+import (
+	"net/http"
+	"sync"
+
+	"trpc.group/trpc-go/trpc-naming-etcd/internal/admin"
+)
+
+func init() {
+	admin.HandleFunc("registry", handleRegistrations)
+}
+
+var (
+	registriesMu sync.RWMutex
+	// registries 插件创建的注册对象，插件名 -> 服务名 -> 注册对象
+	registries = make(map[string]map[string]*Registry)
+)
+
+// addRegistry 记录插件创建的注册对象，用于管理命令查询
+func addRegistry(pluginName, serviceName string, r *Registry) {
+	registriesMu.Lock()
+	defer registriesMu.Unlock()
+	services, ok := registries[pluginName]
+	if !ok {
+		services = make(map[string]*Registry)
+		registries[pluginName] = services
+	}
+	services[serviceName] = r
+}
+
+// handleRegistrations 查询实例的注册状态，参数 plugin 指定插件名，service 指定服务名，为空时返回全部
+func handleRegistrations(r *http.Request) (interface{}, error) {
+	filter, serviceName := r.Form.Get("plugin"), r.Form.Get("service")
+	registriesMu.RLock()
+	defer registriesMu.RUnlock()
+	states := make(map[string][]*RegistrationState, len(registries))
+	for name, services := range registries {
+		if filter != "" && filter != name {
+			continue
+		}
+		pluginStates := make([]*RegistrationState, 0, len(services))
+		for service, reg := range services {
+			if serviceName != "" && serviceName != service {
+				continue
+			}
+			pluginStates = append(pluginStates, reg.Registrations()...)
+		}
+		sortStates(pluginStates)
+		states[name] = pluginStates
+	}
+	return states, nil
+}
@@ -22,14 +22,49 @@ type TLSConfig struct {
 
 // Service 服务配置
 type Service struct {
-	ServiceName string            `yaml:"name,omitempty"`
-	Weight      int               `yaml:"weight,omitempty"`
-	TTL         int               `yaml:"ttl,omitempty"`
-	Metadata    map[string]string `yaml:"metadata,omitempty"`
+	ServiceName     string            `yaml:"name,omitempty"`
+	Weight          int               `yaml:"weight,omitempty"`
+	TTL             int               `yaml:"ttl,omitempty"`
+	Metadata        map[string]string `yaml:"metadata,omitempty"`
+	SyncRegister    bool              `yaml:"sync_register,omitempty"`
+	RegisterTimeout int               `yaml:"register_timeout,omitempty"`
+	DrainPeriod     int               `yaml:"drain_period,omitempty"`
+	WarmUp          int               `yaml:"warm_up,omitempty"`
+	WarmUpCurve     string            `yaml:"warm_up_curve,omitempty"`
+	Codec           string            `yaml:"codec,omitempty"`
+	Protocol        string            `yaml:"protocol,omitempty"`
+	Network         string            `yaml:"network,omitempty"`
+	Version         string            `yaml:"version,omitempty"`
+	SetName         string            `yaml:"set_name,omitempty"`
+	Zone            string            `yaml:"zone,omitempty"`
+	Tags            []string          `yaml:"tags,omitempty"`
+}
+
+// Config 转为注册前缀为 prefix 的注册配置
+func (s *Service) Config(prefix string) *Config {
+	return &Config{
+		Prefix:          prefix,
+		Weight:          s.Weight,
+		TTL:             s.TTL,
+		Metadata:        s.Metadata,
+		SyncRegister:    s.SyncRegister,
+		RegisterTimeout: s.RegisterTimeout,
+		DrainPeriod:     s.DrainPeriod,
+		WarmUp:          s.WarmUp,
+		WarmUpCurve:     s.WarmUpCurve,
+		Codec:           s.Codec,
+		Protocol:        s.Protocol,
+		Network:         s.Network,
+		Version:         s.Version,
+		SetName:         s.SetName,
+		Zone:            s.Zone,
+		Tags:            s.Tags,
+	}
 }
 
 // FactoryConfig 组件配置
 type FactoryConfig struct {
+	Client   string    `yaml:"client,omitempty"`
 	Address  string    `yaml:"address,omitempty"`
 	Timeout  int       `yaml:"timeout,omitempty"`
 	Username string    `yaml:"username,omitempty"`
@@ -49,4 +84,28 @@ type Config struct {
 	TTL int `yaml:"ttl,omitempty"`
 	// Metadata 元数据
 	Metadata map[string]string `yaml:"metadata,omitempty"`
+	// SyncRegister 为 true 时 Register 阻塞到首次注册成功，超时或失败时返回错误
+	SyncRegister bool `yaml:"sync_register,omitempty"`
+	// RegisterTimeout 同步注册超时时间 单位秒，默认5秒
+	RegisterTimeout int `yaml:"register_timeout,omitempty"`
+	// DrainPeriod 下线等待时间 单位秒，默认10秒，实例标记为下线中后等待该时间再从 etcd 删除
+	DrainPeriod int `yaml:"drain_period,omitempty"`
+	// WarmUp 预热时长 单位秒，为0时不预热，新注册的实例权重从较低值逐步提升到配置的权重
+	WarmUp int `yaml:"warm_up,omitempty"`
+	// WarmUpCurve 预热曲线，linear 线性增长(默认)，quadratic 前期增长慢后期增长快
+	WarmUpCurve string `yaml:"warm_up_curve,omitempty"`
+	// Codec 写入 etcd 的节点编码，json(默认) 或 proto，读取时按数据中的格式标记自动选择编码
+	Codec string `yaml:"codec,omitempty"`
+	// Protocol 业务协议 trpc/http
+	Protocol string `yaml:"protocol,omitempty"`
+	// Network 网络层协议 tcp/udp
+	Network string `yaml:"network,omitempty"`
+	// Version 服务版本
+	Version string `yaml:"version,omitempty"`
+	// SetName set 名
+	SetName string `yaml:"set_name,omitempty"`
+	// Zone 可用区
+	Zone string `yaml:"zone,omitempty"`
+	// Tags 标签
+	Tags []string `yaml:"tags,omitempty"`
 }
@@ -20,31 +20,129 @@ import (
 	"net"
 	"os"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/cenkalti/backoff/v4"
+	"github.com/pkg/errors"
 
 	"trpc.group/trpc-go/trpc-go/log"
 	tregistry "trpc.group/trpc-go/trpc-go/naming/registry"
 	"trpc.group/trpc-go/trpc-naming-etcd/client"
+	etcderror "trpc.group/trpc-go/trpc-naming-etcd/error"
+	"trpc.group/trpc-go/trpc-naming-etcd/internal/metrics"
 	"trpc.group/trpc-go/trpc-naming-etcd/model"
 
 	clientv3 "go.etcd.io/etcd/client/v3"
 )
 
+const (
+	// defaultRegisterTimeout 默认同步注册超时时间 单位秒
+	defaultRegisterTimeout = 5
+	// defaultDrainPeriod 默认下线等待时间 单位秒
+	defaultDrainPeriod = 10
+	// statusChanSize 注册状态通知的缓冲大小
+	statusChanSize = 64
+)
+
 // Registry etcd 注册对象
 type Registry struct {
 	cfg          *Config
 	pid          string
 	leaseManager client.LeaseManager
-	etcdClient   *clientv3.Client
-	ctx          context.Context
-	cancel       context.CancelFunc
-	id           string
+	etcdClient   client.KV
+	// codec 写入 etcd 的节点编码
+	codec model.Codec
+	mu    sync.Mutex
+	// registrations 已注册的实例，服务名 -> 地址 -> 注册信息
+	registrations map[string]map[string]*registration
+	// status 实例注册状态变更通知
+	status chan *Status
+	// statusMu 串行化状态通知，保证通道满时丢弃旧状态后写入的是当前状态
+	statusMu sync.Mutex
+}
+
+// Status 实例注册状态
+type Status struct {
+	// ServiceName 服务名
+	ServiceName string
+	// Address 实例地址
+	Address string
+	// Registered 是否已经注册到 etcd
+	Registered bool
+	// Err 最近一次注册失败的原因，注册成功时为 nil
+	Err error
+}
+
+// registration 单个实例的注册信息，每个实例独立注册和取消注册
+type registration struct {
+	serviceName string
+	address     string
+	// key 实例在 etcd 中的路径
+	key    string
+	ctx    context.Context
+	cancel context.CancelFunc
+	mu     sync.RWMutex
+	// writeMu 串行化写入 etcd，保证最后写入的总是最新的节点信息
+	writeMu sync.Mutex
+	// node 实例当前的节点信息，更新时整体替换，不修改原节点
+	node *model.Node
+	// targetWeight 实例的目标权重，预热期间节点权重从较低值逐步提升到目标权重
+	targetWeight int
+	// start 实例注册时间
+	start time.Time
+	// registered 是否已经注册到 etcd
+	registered bool
+	// lastErr 最近一次注册的错误
+	lastErr error
+	// leaseID 最近一次写入 etcd 时使用的租约
+	leaseID clientv3.LeaseID
+	// ready 首次注册成功后关闭
+	ready     chan struct{}
+	readyOnce sync.Once
+}
+
+// newRegistration 新建实例注册信息
+func newRegistration(prefix string, node *model.Node) *registration {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &registration{
+		serviceName:  node.Name,
+		address:      node.Address,
+		key:          model.NodePath(prefix, node.Name, node.ID),
+		ctx:          ctx,
+		cancel:       cancel,
+		node:         node,
+		targetWeight: node.Weight,
+		start:        time.Now(),
+		ready:        make(chan struct{}),
+	}
+}
+
+// getNode 获取实例当前的节点信息
+func (reg *registration) getNode() *model.Node {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	return reg.node
+}
+
+// updateNode 复制当前节点并修改，然后替换当前节点，update 执行时已经获取锁
+func (reg *registration) updateNode(update func(node *model.Node)) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	node := *reg.node
+	update(&node)
+	reg.node = &node
+}
+
+// status 获取实例注册状态
+func (reg *registration) status() (bool, error) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	return reg.registered, reg.lastErr
 }
 
 // NewRegistry 新建 etcd 注册对象
-func NewRegistry(etcdClient *clientv3.Client, cfg *Config) (tregistry.Registry, error) {
+func NewRegistry(etcdClient client.Etcd, cfg *Config) (tregistry.Registry, error) {
 	if cfg.Prefix == "" {
 		cfg.Prefix = client.DefaultEtcdPrefix
 	}
@@ -54,19 +152,30 @@ func NewRegistry(etcdClient *clientv3.Client, cfg *Config) (tregistry.Registry,
 	if cfg.TTL == 0 {
 		cfg.TTL = client.DefaultTTL
 	}
-	ctx, cancel := context.WithCancel(context.Background())
+	if cfg.RegisterTimeout == 0 {
+		cfg.RegisterTimeout = defaultRegisterTimeout
+	}
+	if cfg.DrainPeriod == 0 {
+		cfg.DrainPeriod = defaultDrainPeriod
+	}
+	codec, err := model.GetCodec(cfg.Codec)
+	if err != nil {
+		return nil, errors.Wrapf(err, "get node codec %s fail", cfg.Codec)
+	}
 	e := &Registry{
-		cfg:          cfg,
-		pid:          strconv.Itoa(os.Getpid()),
-		leaseManager: client.NewLeaseManager(etcdClient),
-		etcdClient:   etcdClient,
-		ctx:          ctx,
-		cancel:       cancel,
+		cfg:           cfg,
+		pid:           strconv.Itoa(os.Getpid()),
+		leaseManager:  client.NewLeaseManager(etcdClient),
+		etcdClient:    etcdClient,
+		codec:         codec,
+		registrations: make(map[string]map[string]*registration),
+		status:        make(chan *Status, statusChanSize),
 	}
 	return e, nil
 }
 
-// Register 注册服务
+// Register 注册服务，同一个服务的不同地址、不同服务之间独立注册，同一个服务同一个地址重复注册时覆盖之前的注册。
+// 开启同步注册时阻塞到首次注册成功，超时后取消注册并返回错误
 func (r *Registry) Register(serviceName string, opts ...tregistry.Option) error {
 	options := &tregistry.Options{}
 	for _, opt := range opts {
@@ -77,69 +186,387 @@ func (r *Registry) Register(serviceName string, opts ...tregistry.Option) error
 	if err != nil {
 		return err
 	}
-	id := model.ServiceID(host, port, r.pid)
-	r.id = id
 	node := &model.Node{
-		Name:     serviceName,
-		ID:       id,
-		Address:  fmt.Sprintf("%s:%s", host, port),
-		Metadata: r.cfg.Metadata,
-		Weight:   r.cfg.Weight,
+		Name:      serviceName,
+		ID:        model.ServiceID(host, port, r.pid),
+		Address:   fmt.Sprintf("%s:%s", host, port),
+		Metadata:  r.cfg.Metadata,
+		Weight:    r.cfg.Weight,
+		Protocol:  r.cfg.Protocol,
+		Network:   r.cfg.Network,
+		Version:   r.cfg.Version,
+		SetName:   r.cfg.SetName,
+		Zone:      r.cfg.Zone,
+		Tags:      r.cfg.Tags,
+		StartTime: time.Now().Unix(),
+	}
+	reg := newRegistration(r.cfg.Prefix, node)
+	node.Weight = r.weightLocked(reg, reg.start)
+
+	r.mu.Lock()
+	instances, ok := r.registrations[serviceName]
+	if !ok {
+		instances = make(map[string]*registration)
+		r.registrations[serviceName] = instances
+	}
+	if old, ok := instances[node.Address]; ok {
+		old.cancel()
 	}
+	instances[node.Address] = reg
+	r.mu.Unlock()
+
 	// 开始注册
-	go r.etcdRegister(node)
-	return nil
+	go r.etcdRegister(reg)
+	if r.cfg.WarmUp > 0 {
+		go r.warmUp(reg)
+	}
+	if !r.cfg.SyncRegister {
+		return nil
+	}
+	return r.waitRegistered(reg)
 }
 
-// etcdRegister 注册到etcd
-func (r *Registry) etcdRegister(node *model.Node) {
-	key := model.NodePath(r.cfg.Prefix, node.Name, node.ID)
-	value, err := model.Marshal(node)
-	if err != nil {
-		log.Errorf("marshal node fail, err: %s\n", err.Error())
+// waitRegistered 等待实例首次注册成功，超时后取消注册
+func (r *Registry) waitRegistered(reg *registration) error {
+	timer := time.NewTimer(time.Duration(r.cfg.RegisterTimeout) * time.Second)
+	defer timer.Stop()
+	select {
+	case <-reg.ready:
+		return nil
+	case <-timer.C:
+	}
+	_, err := reg.status()
+	if err == nil {
+		err = etcderror.ErrRegisterTimeout
+	}
+	r.mu.Lock()
+	if r.registrations[reg.serviceName][reg.address] == reg {
+		r.removeLocked(reg)
+	}
+	r.mu.Unlock()
+	if deregisterErr := r.deregister(reg); deregisterErr != nil {
+		log.Errorf("deregister %s after register timeout fail, err: %v", reg.serviceName, deregisterErr)
+	}
+	return errors.Wrapf(err, "register %s to etcd fail", reg.serviceName)
+}
+
+// setStatus 更新实例注册状态并通知
+func (r *Registry) setStatus(reg *registration, registered bool, err error) {
+	// 已经取消注册的实例不再更新状态
+	if reg.ctx.Err() != nil {
 		return
 	}
+	reg.mu.Lock()
+	reg.registered = registered
+	reg.lastErr = err
+	reg.mu.Unlock()
+	if registered {
+		reg.readyOnce.Do(func() {
+			close(reg.ready)
+		})
+	}
+	r.notify(&Status{
+		ServiceName: reg.serviceName,
+		Address:     reg.address,
+		Registered:  registered,
+		Err:         err,
+	})
+}
+
+// notify 发送状态变更通知，通道满时丢弃最旧的状态，保证最新的状态总能被读取到
+func (r *Registry) notify(status *Status) {
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
 	for {
 		select {
-		case <-r.ctx.Done():
+		case r.status <- status:
+			return
+		default:
+		}
+		// 没有人关注状态时通道会满，丢弃最旧的一个再重试
+		select {
+		case <-r.status:
+		default:
+		}
+	}
+}
+
+// Registered 判断 serviceName 的所有实例是否都已经注册到 etcd
+func (r *Registry) Registered(serviceName string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	instances := r.registrations[serviceName]
+	if len(instances) == 0 {
+		return false
+	}
+	for _, reg := range instances {
+		if registered, _ := reg.status(); !registered {
+			return false
+		}
+	}
+	return true
+}
+
+// LastError 获取 serviceName 的实例最近一次注册失败的错误，都注册成功时返回 nil
+func (r *Registry) LastError(serviceName string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, reg := range r.registrations[serviceName] {
+		if _, err := reg.status(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Status 返回实例注册状态变更的通知，通道满时丢弃最旧的状态
+func (r *Registry) Status() <-chan *Status {
+	return r.status
+}
+
+// etcdRegister 注册到etcd
+func (r *Registry) etcdRegister(reg *registration) {
+	for {
+		select {
+		case <-reg.ctx.Done():
 			return
 		default:
 		}
 		var leaseExpire chan bool
 		operation := func() error {
-			// 获取租约
-			var leaseID clientv3.LeaseID
-			leaseID, leaseExpire, err = r.leaseManager.GetLease(r.ctx, time.Duration(r.cfg.TTL)*time.Second)
-			if err != nil {
-				log.Tracef("get lease fail, serviceName:%s, err:%v", node.Name, err)
+			var err error
+			if leaseExpire, err = r.put(reg); err != nil {
+				metrics.Incr(metrics.RegisterFail)
+				r.setStatus(reg, false, err)
 				return err
 			}
-			// 注册
-			if _, err = r.etcdClient.Put(r.ctx, key, value, clientv3.WithLease(leaseID)); err != nil {
-				log.Tracef("register %s fail, err:%v", node.Name, err)
-				return err
-			}
-			log.Tracef("register %s success", node.Name)
+			metrics.Incr(metrics.RegisterSuccess)
+			log.Tracef("register %s success", reg.serviceName)
+			r.setStatus(reg, true, nil)
 			return nil
 		}
-		if err = backoff.Retry(operation, backoff.NewExponentialBackOff()); err != nil {
+		if err := backoff.Retry(operation, backoff.WithContext(backoff.NewExponentialBackOff(), reg.ctx)); err != nil {
 			continue
 		}
 		select {
 		case <-leaseExpire:
+			metrics.Incr(metrics.RegisterLeaseExpired)
+			r.setStatus(reg, false, etcderror.ErrLeaseExpired)
 			continue
-		case <-r.ctx.Done():
+		case <-reg.ctx.Done():
 			return
 		}
 	}
 }
 
-// Deregister 取消注册
+// put 获取租约并将实例当前的节点信息写入 etcd，返回租约失效的通知。
+// 注册、预热、更新和下线会并发写入，持有写锁读取节点并写入，避免旧的节点信息覆盖新的
+func (r *Registry) put(reg *registration) (chan bool, error) {
+	reg.writeMu.Lock()
+	defer reg.writeMu.Unlock()
+	// 已经取消注册的实例不再写入，避免删除后又被写回
+	if err := reg.ctx.Err(); err != nil {
+		return nil, err
+	}
+	value, err := model.MarshalWith(r.codec, reg.getNode())
+	if err != nil {
+		log.Errorf("marshal node fail, err: %s\n", err.Error())
+		return nil, err
+	}
+	// 获取租约
+	leaseID, leaseExpire, err := r.leaseManager.GetLease(reg.ctx, time.Duration(r.cfg.TTL)*time.Second)
+	if err != nil {
+		log.Tracef("get lease fail, serviceName:%s, err:%v", reg.serviceName, err)
+		return nil, err
+	}
+	// 注册
+	start := time.Now()
+	_, err = r.etcdClient.Put(reg.ctx, reg.key, value, clientv3.WithLease(leaseID))
+	metrics.ObserveEtcd(metrics.EtcdPut, start, err)
+	if err != nil {
+		log.Tracef("register %s fail, err:%v", reg.serviceName, err)
+		return nil, err
+	}
+	reg.mu.Lock()
+	reg.leaseID = leaseID
+	reg.mu.Unlock()
+	return leaseExpire, nil
+}
+
+// Drain 将 serviceName 的所有实例标记为下线中，等待 DrainPeriod 后取消注册。
+// 下线期间选择器不再选中这些实例，已经收到的请求可以继续处理完成。
+// ctx 结束时不再等待，立即取消注册并返回 ctx 的错误
+func (r *Registry) Drain(ctx context.Context, serviceName string) error {
+	instances := r.instances(serviceName)
+	if len(instances) == 0 {
+		return etcderror.ErrServiceNotRegistered
+	}
+	// 租约失效重新注册时也会使用下线中的状态
+	firstErr := r.updateNodes(instances, func(reg *registration, node *model.Node) {
+		node.Status = model.NodeStatusDraining
+	})
+	timer := time.NewTimer(time.Duration(r.cfg.DrainPeriod) * time.Second)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		if firstErr == nil {
+			firstErr = ctx.Err()
+		}
+	}
+	if err := r.Deregister(serviceName); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
+
+// UpdateWeight 更新 serviceName 所有实例的权重，使用原租约立即写入 etcd。
+// 写入失败时返回错误，更新后的权重会在下一次重新注册时生效
+func (r *Registry) UpdateWeight(serviceName string, weight int) error {
+	instances := r.instances(serviceName)
+	if len(instances) == 0 {
+		return etcderror.ErrServiceNotRegistered
+	}
+	now := time.Now()
+	return r.updateNodes(instances, func(reg *registration, node *model.Node) {
+		reg.targetWeight = weight
+		node.Weight = r.weightLocked(reg, now)
+	})
+}
+
+// SetStatus 设置 serviceName 所有实例的状态，使用原租约立即写入 etcd。status 为 model.NodeStatusUnhealthy 时
+// 选择器不再选中这些实例，为空时恢复正常。下线中的实例保持下线中的状态，下线使用 Drain
+func (r *Registry) SetStatus(serviceName string, status string) error {
+	if status != "" && status != model.NodeStatusUnhealthy {
+		return etcderror.ErrInvalidStatus
+	}
+	instances := r.instances(serviceName)
+	if len(instances) == 0 {
+		return etcderror.ErrServiceNotRegistered
+	}
+	return r.updateNodes(instances, func(reg *registration, node *model.Node) {
+		if node.Status != model.NodeStatusDraining {
+			node.Status = status
+		}
+	})
+}
+
+// UpdateMetadata 使用 metadata 替换 serviceName 所有实例的元数据，使用原租约立即写入 etcd。
+// 写入失败时返回错误，更新后的元数据会在下一次重新注册时生效
+func (r *Registry) UpdateMetadata(serviceName string, metadata map[string]string) error {
+	instances := r.instances(serviceName)
+	if len(instances) == 0 {
+		return etcderror.ErrServiceNotRegistered
+	}
+	newMetadata := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		newMetadata[k] = v
+	}
+	return r.updateNodes(instances, func(reg *registration, node *model.Node) {
+		node.Metadata = newMetadata
+	})
+}
+
+// instances 获取 serviceName 已注册的所有实例
+func (r *Registry) instances(serviceName string) []*registration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	instances := make([]*registration, 0, len(r.registrations[serviceName]))
+	for _, reg := range r.registrations[serviceName] {
+		instances = append(instances, reg)
+	}
+	return instances
+}
+
+// updateNodes 更新实例的节点信息并重新写入 etcd，返回第一个写入错误
+func (r *Registry) updateNodes(instances []*registration, update func(reg *registration, node *model.Node)) error {
+	var firstErr error
+	for _, reg := range instances {
+		reg.updateNode(func(node *model.Node) {
+			update(reg, node)
+		})
+		if _, err := r.put(reg); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Deregister 取消注册 serviceName 的所有实例，不影响其他服务
 func (r *Registry) Deregister(serviceName string) error {
-	r.cancel()
+	r.mu.Lock()
+	instances := r.registrations[serviceName]
+	delete(r.registrations, serviceName)
+	r.mu.Unlock()
+
+	var firstErr error
+	for _, reg := range instances {
+		if err := r.deregister(reg); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if err := r.revokeIfIdle(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
+
+// DeregisterAddress 取消注册 serviceName 在 address 上的实例，不影响同一服务的其他实例
+func (r *Registry) DeregisterAddress(serviceName, address string) error {
+	r.mu.Lock()
+	reg, ok := r.registrations[serviceName][address]
+	if ok {
+		r.removeLocked(reg)
+	}
+	r.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	if err := r.deregister(reg); err != nil {
+		return err
+	}
+	return r.revokeIfIdle()
+}
+
+// revokeIfIdle 没有注册的实例时撤销租约并停止续约，节点立即从 etcd 中消失
+func (r *Registry) revokeIfIdle() error {
+	r.mu.Lock()
+	idle := len(r.registrations) == 0
+	r.mu.Unlock()
+	if !idle {
+		return nil
+	}
+	// 租约管理不支持撤销时，租约在过期后由 etcd 删除
+	revoker, ok := r.leaseManager.(client.LeaseRevoker)
+	if !ok {
+		return nil
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), client.DefaultTimeout)
 	defer cancel()
-	if _, err := r.etcdClient.Delete(ctx, model.NodePath(r.cfg.Prefix, serviceName, r.id)); err != nil {
+	return revoker.Revoke(ctx)
+}
+
+// removeLocked 移除实例注册信息，必须要获取锁后操作
+func (r *Registry) removeLocked(reg *registration) {
+	instances := r.registrations[reg.serviceName]
+	delete(instances, reg.address)
+	if len(instances) == 0 {
+		delete(r.registrations, reg.serviceName)
+	}
+}
+
+// deregister 停止实例的注册并删除 etcd 中的节点
+func (r *Registry) deregister(reg *registration) error {
+	reg.cancel()
+	// 等待正在进行的写入完成后再删除
+	reg.writeMu.Lock()
+	defer reg.writeMu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), client.DefaultTimeout)
+	defer cancel()
+	start := time.Now()
+	_, err := r.etcdClient.Delete(ctx, reg.key)
+	metrics.ObserveEtcd(metrics.EtcdDelete, start, err)
+	if err != nil {
 		return err
 	}
 	return nil
@@ -14,7 +14,9 @@
 package registry
 
 import (
-	"trpc.group/trpc-go/trpc-go/naming/registry"
+	"fmt"
+
+	tregistry "trpc.group/trpc-go/trpc-go/naming/registry"
 	tselector "trpc.group/trpc-go/trpc-go/naming/selector"
 	"trpc.group/trpc-go/trpc-go/plugin"
 	"trpc.group/trpc-go/trpc-naming-etcd/client"
@@ -32,45 +34,91 @@ const (
 	pluginName = "etcd"
 )
 
-// Plugin 插件结构
-type Plugin struct{}
+// Register 以 name 注册 registry 插件，用于将服务注册到多个 etcd 集群，需要在 trpc.NewServer 之前调用。
+// 插件配置在 plugins.registry.<name> 下，同一个服务只能配置在一个插件中，重复配置时插件初始化失败
+func Register(name string) {
+	plugin.Register(name, &Plugin{})
+}
+
+// Plugin 插件结构，每个插件名对应一个实例
+type Plugin struct {
+	// release 释放插件使用的 etcd 客户端
+	release func() error
+}
 
 // Type 插件类型
 func (p *Plugin) Type() string {
 	return pluginType
 }
 
+// FlexDependsOn 配置了共享 etcd 客户端插件时在其之后初始化
+func (p *Plugin) FlexDependsOn() []string {
+	return []string{client.PluginType + "-" + client.PluginName}
+}
+
 // Setup 注册
 func (p *Plugin) Setup(name string, decoder plugin.Decoder) error {
 	factoryCfg := &FactoryConfig{}
 	if err := decoder.Decode(factoryCfg); err != nil {
 		return err
 	}
-	etcdClient, err := client.GenerateEtcdClient(&client.Config{
-		Address:  factoryCfg.Address,
-		Timeout:  factoryCfg.Timeout,
-		Username: factoryCfg.Username,
-		Password: factoryCfg.Password,
-		Prefix:   factoryCfg.Prefix,
-		CaFile:   factoryCfg.TLS.CaFile,
-		CertFile: factoryCfg.TLS.CertFile,
-		KeyFile:  factoryCfg.TLS.KeyFile,
-	})
+	if err := checkDuplicate(name, factoryCfg.Services); err != nil {
+		return err
+	}
+	etcdClient, release, err := client.Resolve(factoryCfg.Client, factoryCfg.clientConfig())
 	if err != nil {
 		return err
 	}
+	regs := make([]tregistry.Registry, 0, len(factoryCfg.Services))
 	for _, service := range factoryCfg.Services {
-		cfg := &Config{
-			Prefix:   factoryCfg.Prefix,
-			Weight:   service.Weight,
-			TTL:      service.TTL,
-			Metadata: service.Metadata,
-		}
-		reg, err := NewRegistry(etcdClient, cfg)
+		reg, err := NewRegistry(etcdClient, service.Config(factoryCfg.Prefix))
 		if err != nil {
+			_ = release()
 			return err
 		}
-		registry.Register(service.ServiceName, reg)
+		regs = append(regs, reg)
 	}
+	for i, service := range factoryCfg.Services {
+		tregistry.Register(service.ServiceName, regs[i])
+		addRegistry(name, service.ServiceName, regs[i].(*Registry))
+	}
+	p.release = release
 	return nil
 }
+
+// Close 释放插件使用的 etcd 客户端，框架退出时调用
+func (p *Plugin) Close() error {
+	if p.release == nil {
+		return nil
+	}
+	release := p.release
+	p.release = nil
+	return release()
+}
+
+// checkDuplicate 检查服务是否已经由其他插件注册，trpc-go 按服务名保存注册对象，重复注册会覆盖之前的插件
+func checkDuplicate(name string, services []Service) error {
+	names := make(map[string]bool, len(services))
+	for _, service := range services {
+		if names[service.ServiceName] || tregistry.Get(service.ServiceName) != nil {
+			return fmt.Errorf("registry plugin %s: service %s is already registered by another plugin",
+				name, service.ServiceName)
+		}
+		names[service.ServiceName] = true
+	}
+	return nil
+}
+
+// clientConfig 插件自己的 etcd 客户端配置
+func (c *FactoryConfig) clientConfig() *client.Config {
+	return &client.Config{
+		Address:  c.Address,
+		Timeout:  c.Timeout,
+		Username: c.Username,
+		Password: c.Password,
+		Prefix:   c.Prefix,
+		CaFile:   c.TLS.CaFile,
+		CertFile: c.TLS.CertFile,
+		KeyFile:  c.TLS.KeyFile,
+	}
+}
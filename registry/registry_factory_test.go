@@ -18,6 +18,9 @@ import (
 
 	"trpc.group/trpc-go/trpc-go"
 	_ "trpc.group/trpc-go/trpc-go/http"
+	"trpc.group/trpc-go/trpc-go/naming/registry"
+	"trpc.group/trpc-go/trpc-go/plugin"
+	"trpc.group/trpc-go/trpc-naming-etcd/client"
 
 	. "github.com/glycerine/goconvey/convey"
 )
@@ -28,3 +31,67 @@ func TestPlugin_Setup(t *testing.T) {
 		So(s, ShouldNotBeNil)
 	})
 }
+
+// factoryDecoder 将配置直接写入插件配置
+type factoryDecoder struct {
+	cfg *FactoryConfig
+}
+
+// Decode 解析配置
+func (d *factoryDecoder) Decode(cfg interface{}) error {
+	*(cfg.(*FactoryConfig)) = *d.cfg
+	return nil
+}
+
+func TestPlugin_SetupDuplicate(t *testing.T) {
+	Convey("同一个服务配置在多个插件中时初始化失败", t, func() {
+		Register("etcd-dup-a")
+		Register("etcd-dup-b")
+		cfg := &FactoryConfig{
+			Address:  "127.0.0.1:2379",
+			Services: []Service{{ServiceName: "trpc.test.dup.Greeter"}},
+		}
+		So(plugin.Get(pluginType, "etcd-dup-a").Setup("etcd-dup-a", &factoryDecoder{cfg: cfg}), ShouldBeNil)
+		So(registry.Get("trpc.test.dup.Greeter"), ShouldNotBeNil)
+		err := plugin.Get(pluginType, "etcd-dup-b").Setup("etcd-dup-b", &factoryDecoder{cfg: cfg})
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "already registered")
+
+		// 同一个插件中重复配置
+		err = plugin.Get(pluginType, "etcd-dup-b").Setup("etcd-dup-b", &factoryDecoder{cfg: &FactoryConfig{
+			Address:  "127.0.0.1:2379",
+			Services: []Service{{ServiceName: "trpc.test.dup.Other"}, {ServiceName: "trpc.test.dup.Other"}},
+		}})
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestPlugin_Close(t *testing.T) {
+	Convey("插件关闭时释放共享 etcd 客户端", t, func() {
+		So(client.Register("etcd-close", &client.Config{Address: "127.0.0.1:2379"}), ShouldBeNil)
+		shared, err := client.Get("etcd-close")
+		So(err, ShouldBeNil)
+
+		// 创建注册对象失败时释放客户端
+		Register("etcd-close-fail")
+		err = plugin.Get(pluginType, "etcd-close-fail").Setup("etcd-close-fail", &factoryDecoder{cfg: &FactoryConfig{
+			Client:   "etcd-close",
+			Services: []Service{{ServiceName: "trpc.test.close.Fail", Codec: "notexist"}},
+		}})
+		So(err, ShouldNotBeNil)
+		So(registry.Get("trpc.test.close.Fail"), ShouldBeNil)
+
+		Register("etcd-close")
+		p := plugin.Get(pluginType, "etcd-close").(*Plugin)
+		So(p.Setup("etcd-close", &factoryDecoder{cfg: &FactoryConfig{
+			Client:   "etcd-close",
+			Services: []Service{{ServiceName: "trpc.test.close.Greeter"}},
+		}}), ShouldBeNil)
+		So(client.Release("etcd-close"), ShouldBeNil)
+		So(shared.Ctx().Err(), ShouldBeNil)
+		So(p.Close(), ShouldBeNil)
+		So(shared.Ctx().Err(), ShouldNotBeNil)
+		// 重复关闭不会多次释放
+		So(p.Close(), ShouldBeNil)
+	})
+}
@@ -16,230 +16,567 @@ package registry
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"math/rand"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"trpc.group/trpc-go/trpc-go/naming/registry"
-	tregistry "trpc.group/trpc-go/trpc-go/naming/registry"
+	"trpc.group/trpc-go/trpc-naming-etcd/client"
+	"trpc.group/trpc-go/trpc-naming-etcd/client/fake"
+	etcderror "trpc.group/trpc-go/trpc-naming-etcd/error"
 	"trpc.group/trpc-go/trpc-naming-etcd/model"
 
-	"go.etcd.io/etcd/api/v3/etcdserverpb"
 	"go.etcd.io/etcd/api/v3/mvccpb"
 	clientv3 "go.etcd.io/etcd/client/v3"
 
 	. "github.com/glycerine/goconvey/convey"
 )
 
-// cacheWatcher 实现etcd的Watcher接口
-type cacheWatcher struct {
+// registryEtcd 在内存 etcd 上记录写入的值、删除的 key 和撤销的租约数，并可模拟写入失败
+type registryEtcd struct {
+	*fake.Etcd
+	mu      sync.Mutex
+	putErr  error
+	puts    []string
+	deleted []string
+	revoked int
 }
 
-// Watch 关注key变化
-func (c *cacheWatcher) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
-	return make(chan clientv3.WatchResponse, 1)
+// newRegistryEtcd 新建内存 etcd
+func newRegistryEtcd() *registryEtcd {
+	return &registryEtcd{Etcd: fake.New()}
 }
 
-// RequestProgress 请求处理
-func (c *cacheWatcher) RequestProgress(ctx context.Context) error {
-	return nil
+// setPutErr 设置写入返回的错误，为 nil 时恢复正常
+func (e *registryEtcd) setPutErr(err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.putErr = err
 }
 
-// Close 关闭clientWatcher
-func (c *cacheWatcher) Close() error {
-	return nil
+// putValues 返回成功写入的值
+func (e *registryEtcd) putValues() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]string(nil), e.puts...)
 }
 
-// etcdLease 实现etcd Lease接口
-type etcdLease struct {
+// deletedKeys 返回删除的 key
+func (e *registryEtcd) deletedKeys() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]string(nil), e.deleted...)
 }
 
-// Grant 分配租约
-func (e *etcdLease) Grant(ctx context.Context, ttl int64) (*clientv3.LeaseGrantResponse, error) {
-	return &clientv3.LeaseGrantResponse{
-		ID:  clientv3.LeaseID(rand.Int()),
-		TTL: ttl,
-	}, nil
+// revokeCount 返回撤销租约的次数
+func (e *registryEtcd) revokeCount() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.revoked
 }
 
-// Revoke 移除租约
-func (e *etcdLease) Revoke(ctx context.Context, id clientv3.LeaseID) (*clientv3.LeaseRevokeResponse, error) {
-	return &clientv3.LeaseRevokeResponse{}, nil
+// Put 存储 kv
+func (e *registryEtcd) Put(ctx context.Context, key, val string, opts ...clientv3.OpOption) (*clientv3.PutResponse,
+	error) {
+	e.mu.Lock()
+	if e.putErr != nil {
+		err := e.putErr
+		e.mu.Unlock()
+		return nil, err
+	}
+	e.puts = append(e.puts, val)
+	e.mu.Unlock()
+	return e.Etcd.Put(ctx, key, val, opts...)
 }
 
-// TimeToLive 获取租约
-func (e *etcdLease) TimeToLive(ctx context.Context, id clientv3.LeaseID,
-	opts ...clientv3.LeaseOption) (*clientv3.LeaseTimeToLiveResponse, error) {
-	return &clientv3.LeaseTimeToLiveResponse{}, nil
+// Delete 删除 kv
+func (e *registryEtcd) Delete(ctx context.Context, key string,
+	opts ...clientv3.OpOption) (*clientv3.DeleteResponse, error) {
+	e.mu.Lock()
+	e.deleted = append(e.deleted, key)
+	e.mu.Unlock()
+	return e.Etcd.Delete(ctx, key, opts...)
 }
 
-// Leases 获取所有租约
-func (e *etcdLease) Leases(ctx context.Context) (*clientv3.LeaseLeasesResponse, error) {
-	return &clientv3.LeaseLeasesResponse{}, nil
+// Revoke 撤销租约
+func (e *registryEtcd) Revoke(ctx context.Context, id clientv3.LeaseID) (*clientv3.LeaseRevokeResponse, error) {
+	e.mu.Lock()
+	e.revoked++
+	e.mu.Unlock()
+	return e.Etcd.Revoke(ctx, id)
 }
 
-// KeepAlive 监听keepAlive
-func (e *etcdLease) KeepAlive(ctx context.Context, id clientv3.LeaseID) (<-chan *clientv3.LeaseKeepAliveResponse,
-	error) {
-	ch := make(chan *clientv3.LeaseKeepAliveResponse, 10)
-	ch <- &clientv3.LeaseKeepAliveResponse{
-		ID: id,
-	}
-	return ch, nil
+// newEtcdRegistry 新建使用内存 etcd 的注册客户端
+func newEtcdRegistry() (*Registry, *registryEtcd) {
+	e := newRegistryEtcd()
+	r, _ := NewRegistry(e, &Config{})
+	return r.(*Registry), e
 }
 
-// KeepAliveOnce keepAlive一次
-func (e *etcdLease) KeepAliveOnce(ctx context.Context, id clientv3.LeaseID) (*clientv3.LeaseKeepAliveResponse, error) {
-	return &clientv3.LeaseKeepAliveResponse{
-		ID: id,
-	}, nil
-}
+func TestRegistry_Register(t *testing.T) {
+	Convey("注册", t, func() {
+		r, e := newEtcdRegistry()
+		defer e.Close()
+		fmt.Println(r)
+		So(r, ShouldNotBeNil)
+		err := r.Register("testService", registry.WithAddress("test"))
+		So(err, ShouldNotBeNil)
 
-// Close 关闭
-func (e *etcdLease) Close() error {
-	return nil
-}
+		_ = r.Register("testService", registry.WithAddress("8.8.8.8:1000"))
+		time.Sleep(100 * time.Millisecond)
+		_ = r.Deregister("testService")
 
-// newLease 新建一个Lease，实现etcd的Lease接口
-func newLease() clientv3.Lease {
-	return &etcdLease{}
+		_ = r.Deregister("testService1")
+	})
 }
 
-// registryWatcher 实现etcd的Watcher接口
-type registryWatcher struct {
+func TestRegistry_etcdRegister(t *testing.T) {
+	Convey("测试registry的etcdRegister函数", t, func() {
+		r, e := newEtcdRegistry()
+		defer e.Close()
+		node := &model.Node{
+			Name:     "test",
+			ID:       model.ServiceID("127.0.0.1", "8080", "123"),
+			Address:  "127.0.0.1:8080",
+			Metadata: map[string]string{"key": "value"},
+			Weight:   100,
+		}
+		reg := newRegistration(r.cfg.Prefix, node)
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			reg.cancel()
+		}()
+		r.etcdRegister(reg)
+	})
 }
 
-// Watch 关注key变化
-func (c *registryWatcher) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
-	return make(chan clientv3.WatchResponse, 1)
+func TestRegistry_MultiInstance(t *testing.T) {
+	Convey("测试同一个registry注册多个实例，独立取消注册", t, func() {
+		r, e := newEtcdRegistry()
+		defer e.Close()
+
+		So(r.Register("service1", registry.WithAddress("127.0.0.1:8000")), ShouldBeNil)
+		So(r.Register("service1", registry.WithAddress("127.0.0.1:8001")), ShouldBeNil)
+		So(r.Register("service2", registry.WithAddress("127.0.0.1:9000")), ShouldBeNil)
+		service1 := r.registrations["service1"]
+		So(len(service1), ShouldEqual, 2)
+		first := service1["127.0.0.1:8000"]
+		second := service1["127.0.0.1:8001"]
+		other := r.registrations["service2"]["127.0.0.1:9000"]
+
+		// 取消注册单个地址不影响同一服务的其他实例
+		So(r.DeregisterAddress("service1", "127.0.0.1:8000"), ShouldBeNil)
+		So(first.ctx.Err(), ShouldNotBeNil)
+		So(second.ctx.Err(), ShouldBeNil)
+		So(e.deletedKeys(), ShouldResemble, []string{first.key})
+		// 不存在的实例直接返回
+		So(r.DeregisterAddress("service1", "127.0.0.1:8000"), ShouldBeNil)
+
+		// 取消注册服务不影响其他服务
+		So(r.Deregister("service1"), ShouldBeNil)
+		So(second.ctx.Err(), ShouldNotBeNil)
+		So(other.ctx.Err(), ShouldBeNil)
+		So(e.deletedKeys(), ShouldResemble, []string{first.key, second.key})
+
+		// 同一地址重复注册时覆盖之前的注册
+		So(r.Register("service2", registry.WithAddress("127.0.0.1:9000")), ShouldBeNil)
+		So(other.ctx.Err(), ShouldNotBeNil)
+		So(r.Deregister("service2"), ShouldBeNil)
+		So(len(r.registrations), ShouldEqual, 0)
+	})
 }
 
-// RequestProgress 请求处理
-func (c *registryWatcher) RequestProgress(ctx context.Context) error {
-	return nil
+func TestRegistry_SyncRegister(t *testing.T) {
+	Convey("测试同步注册", t, func() {
+		c := newRegistryEtcd()
+		defer c.Close()
+		tr, err := NewRegistry(c, &Config{SyncRegister: true, RegisterTimeout: 1})
+		So(err, ShouldBeNil)
+		r := tr.(*Registry)
+		So(r.Registered("service"), ShouldBeFalse)
+
+		// 注册成功后返回
+		So(r.Register("service", registry.WithAddress("127.0.0.1:8000")), ShouldBeNil)
+		So(r.Registered("service"), ShouldBeTrue)
+		So(r.LastError("service"), ShouldBeNil)
+		status := <-r.Status()
+		So(status.ServiceName, ShouldEqual, "service")
+		So(status.Address, ShouldEqual, "127.0.0.1:8000")
+		So(status.Registered, ShouldBeTrue)
+		So(status.Err, ShouldBeNil)
+		So(r.Deregister("service"), ShouldBeNil)
+		So(r.Registered("service"), ShouldBeFalse)
+
+		// 注册失败时超时返回错误，并取消注册
+		putErr := errors.New("put fail")
+		c.setPutErr(putErr)
+		err = r.Register("service", registry.WithAddress("127.0.0.1:8000"))
+		So(err, ShouldNotBeNil)
+		So(errors.Is(err, putErr), ShouldBeTrue)
+		So(len(r.registrations), ShouldEqual, 0)
+	})
 }
 
-// Close 关闭clientWatcher
-func (c *registryWatcher) Close() error {
-	return nil
+func TestRegistry_AsyncStatus(t *testing.T) {
+	Convey("测试异步注册的状态", t, func() {
+		c := newRegistryEtcd()
+		defer c.Close()
+		tr, err := NewRegistry(c, &Config{})
+		So(err, ShouldBeNil)
+		r := tr.(*Registry)
+		putErr := errors.New("put fail")
+		c.setPutErr(putErr)
+		So(r.Register("service", registry.WithAddress("127.0.0.1:8000")), ShouldBeNil)
+		status := <-r.Status()
+		So(status.Registered, ShouldBeFalse)
+		So(status.Err, ShouldEqual, putErr)
+		So(r.Registered("service"), ShouldBeFalse)
+		So(r.LastError("service"), ShouldEqual, putErr)
+
+		// 恢复后注册成功
+		c.setPutErr(nil)
+		for status = range r.Status() {
+			if status.Registered {
+				break
+			}
+		}
+		So(r.Registered("service"), ShouldBeTrue)
+		So(r.LastError("service"), ShouldBeNil)
+		So(r.Deregister("service"), ShouldBeNil)
+	})
 }
 
-// registryKv 实现etcd的KV接口
-type registryKv struct {
-}
+func TestRegistry_StatusOverflow(t *testing.T) {
+	Convey("状态通知满时丢弃最旧的状态，最新的状态不丢失", t, func() {
+		c := newRegistryEtcd()
+		defer c.Close()
+		tr, err := NewRegistry(c, &Config{})
+		So(err, ShouldBeNil)
+		r := tr.(*Registry)
+		reg := newRegistration("/fake/", &model.Node{Name: "service", ID: "id", Address: "127.0.0.1:8000"})
+		defer reg.cancel()
+		putErr := errors.New("put fail")
+		for i := 0; i < statusChanSize*2; i++ {
+			r.setStatus(reg, false, putErr)
+		}
+		r.setStatus(reg, true, nil)
 
-// Put 存储kv
-func (r *registryKv) Put(ctx context.Context, key, val string,
-	opts ...clientv3.OpOption) (*clientv3.PutResponse, error) {
-	return &clientv3.PutResponse{}, nil
+		So(len(r.Status()), ShouldEqual, statusChanSize)
+		var last *Status
+		for len(r.Status()) > 0 {
+			last = <-r.Status()
+		}
+		So(last.Registered, ShouldBeTrue)
+		So(last.Err, ShouldBeNil)
+	})
 }
 
-// Get 获取kv
-func (r *registryKv) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
-	node := &model.Node{
-		Name:     "test",
-		ID:       model.ServiceID("127.0.0.1", "8080", "123"),
-		Address:  "127.0.0.1:8080",
-		Metadata: map[string]string{"key": "value"},
-		Weight:   100,
-	}
-	value, _ := model.Marshal(node)
-	return &clientv3.GetResponse{
-		Kvs: []*mvccpb.KeyValue{
-			{
-				Key:            []byte(key),
-				CreateRevision: 100,
-				ModRevision:    100,
-				Value:          []byte(value),
-			},
-		},
-		Header: &etcdserverpb.ResponseHeader{
-			Revision: rand.Int63(),
-		},
-	}, nil
-}
-
-// Delete 删除kv
-func (r *registryKv) Delete(ctx context.Context, key string,
-	opts ...clientv3.OpOption) (*clientv3.DeleteResponse, error) {
-	return &clientv3.DeleteResponse{}, nil
+func TestRegistry_DeregisterRevokeLease(t *testing.T) {
+	Convey("测试所有实例取消注册后撤销租约", t, func() {
+		c := newRegistryEtcd()
+		defer c.Close()
+		tr, err := NewRegistry(c, &Config{SyncRegister: true})
+		So(err, ShouldBeNil)
+		r := tr.(*Registry)
+
+		So(r.Register("service1", registry.WithAddress("127.0.0.1:8000")), ShouldBeNil)
+		So(r.Register("service2", registry.WithAddress("127.0.0.1:9000")), ShouldBeNil)
+		// 还有其他实例时不撤销共享的租约
+		So(r.Deregister("service1"), ShouldBeNil)
+		So(c.revokeCount(), ShouldEqual, 0)
+		So(r.DeregisterAddress("service2", "127.0.0.1:9000"), ShouldBeNil)
+		So(c.revokeCount(), ShouldEqual, 1)
+
+		// 撤销后可以重新注册
+		So(r.Register("service1", registry.WithAddress("127.0.0.1:8000")), ShouldBeNil)
+		So(r.Deregister("service1"), ShouldBeNil)
+		So(c.revokeCount(), ShouldEqual, 2)
+
+		// 租约管理不支持撤销时不撤销租约
+		r.leaseManager = struct{ client.LeaseManager }{r.leaseManager}
+		So(r.Register("service1", registry.WithAddress("127.0.0.1:8000")), ShouldBeNil)
+		So(r.Deregister("service1"), ShouldBeNil)
+		So(c.revokeCount(), ShouldEqual, 2)
+	})
 }
 
-// Compact 压缩kv历史
-func (r *registryKv) Compact(ctx context.Context, rev int64,
-	opts ...clientv3.CompactOption) (*clientv3.CompactResponse, error) {
-	return &clientv3.CompactResponse{}, nil
+func TestRegistry_Drain(t *testing.T) {
+	Convey("测试下线实例", t, func() {
+		c := newRegistryEtcd()
+		defer c.Close()
+		tr, err := NewRegistry(c, &Config{SyncRegister: true, DrainPeriod: 1})
+		So(err, ShouldBeNil)
+		r := tr.(*Registry)
+
+		So(r.Register("service", registry.WithAddress("127.0.0.1:8000")), ShouldBeNil)
+		reg := r.registrations["service"]["127.0.0.1:8000"]
+		start := time.Now()
+		So(r.Drain(context.Background(), "service"), ShouldBeNil)
+		So(time.Since(start), ShouldBeGreaterThanOrEqualTo, time.Second)
+
+		putValues := c.putValues()
+		node, err := model.Unmarshal([]byte(putValues[len(putValues)-1]))
+		So(err, ShouldBeNil)
+		So(node.Status, ShouldEqual, model.NodeStatusDraining)
+		So(c.deletedKeys(), ShouldResemble, []string{reg.key})
+		So(r.Registered("service"), ShouldBeFalse)
+
+		// 没有注册的服务返回错误
+		So(r.Drain(context.Background(), "service"), ShouldEqual, etcderror.ErrServiceNotRegistered)
+
+		// ctx 结束时不再等待，立即取消注册
+		r.cfg.DrainPeriod = 60
+		So(r.Register("service", registry.WithAddress("127.0.0.1:8000")), ShouldBeNil)
+		reg = r.registrations["service"]["127.0.0.1:8000"]
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		start = time.Now()
+		So(errors.Is(r.Drain(ctx, "service"), context.DeadlineExceeded), ShouldBeTrue)
+		So(time.Since(start), ShouldBeLessThan, 10*time.Second)
+		So(c.deletedKeys(), ShouldResemble, []string{reg.key, reg.key})
+		So(r.Registered("service"), ShouldBeFalse)
+	})
 }
 
-// Do 不使用事务执行op
-func (r *registryKv) Do(ctx context.Context, op clientv3.Op) (clientv3.OpResponse, error) {
-	return clientv3.OpResponse{}, nil
+func TestRegistry_UpdateWeightAndMetadata(t *testing.T) {
+	Convey("测试运行时更新权重和元数据", t, func() {
+		c := newRegistryEtcd()
+		defer c.Close()
+		tr, err := NewRegistry(c, &Config{SyncRegister: true, Weight: 100, Metadata: map[string]string{"env": "prod"}})
+		So(err, ShouldBeNil)
+		r := tr.(*Registry)
+
+		// 没有注册的服务返回错误
+		So(r.UpdateWeight("service", 10), ShouldNotBeNil)
+		So(r.UpdateMetadata("service", nil), ShouldNotBeNil)
+
+		So(r.Register("service", registry.WithAddress("127.0.0.1:8000")), ShouldBeNil)
+		lastNode := func() *model.Node {
+			putValues := c.putValues()
+			node, err := model.Unmarshal([]byte(putValues[len(putValues)-1]))
+			So(err, ShouldBeNil)
+			return node
+		}
+		So(lastNode().Weight, ShouldEqual, 100)
+
+		So(r.UpdateWeight("service", 10), ShouldBeNil)
+		node := lastNode()
+		So(node.Weight, ShouldEqual, 10)
+		So(node.Metadata["env"], ShouldEqual, "prod")
+
+		metadata := map[string]string{"env": "canary"}
+		So(r.UpdateMetadata("service", metadata), ShouldBeNil)
+		metadata["env"] = "modified"
+		node = lastNode()
+		So(node.Weight, ShouldEqual, 10)
+		So(node.Metadata["env"], ShouldEqual, "canary")
+		So(len(c.putValues()), ShouldEqual, 3)
+		// 配置中的元数据不会被修改
+		So(r.cfg.Metadata["env"], ShouldEqual, "prod")
+		So(r.Deregister("service"), ShouldBeNil)
+	})
 }
 
-// Txn 事务操作
-func (r *registryKv) Txn(ctx context.Context) clientv3.Txn {
-	return nil
+func TestWarmUpWeight(t *testing.T) {
+	Convey("测试预热权重计算", t, func() {
+		So(warmUpWeight(100, 0, 0, ""), ShouldEqual, 100)
+		So(warmUpWeight(100, 0, 10*time.Second, ""), ShouldEqual, 1)
+		So(warmUpWeight(100, 5*time.Second, 10*time.Second, WarmUpCurveLinear), ShouldEqual, 50)
+		So(warmUpWeight(100, 5*time.Second, 10*time.Second, WarmUpCurveQuadratic), ShouldEqual, 25)
+		So(warmUpWeight(100, 10*time.Second, 10*time.Second, WarmUpCurveLinear), ShouldEqual, 100)
+		So(warmUpWeight(100, 20*time.Second, 10*time.Second, WarmUpCurveQuadratic), ShouldEqual, 100)
+		So(warmUpWeight(3, time.Second, 10*time.Second, WarmUpCurveLinear), ShouldEqual, 1)
+		So(warmUpWeight(0, time.Second, 10*time.Second, WarmUpCurveLinear), ShouldEqual, 0)
+	})
 }
 
-// newRegistryEtcdClient 获取etcd客户端
-func newRegistryEtcdClient() *clientv3.Client {
-	client, _ := clientv3.New(clientv3.Config{
-		Endpoints: []string{"127.0.0.1:2379"},
+func TestRegistry_WarmUp(t *testing.T) {
+	Convey("测试新注册实例权重预热", t, func() {
+		oldInterval := minWarmUpInterval
+		minWarmUpInterval = 10 * time.Millisecond
+		defer func() {
+			minWarmUpInterval = oldInterval
+		}()
+		c := newRegistryEtcd()
+		defer c.Close()
+		tr, err := NewRegistry(c, &Config{SyncRegister: true, Weight: 100, WarmUp: 1})
+		So(err, ShouldBeNil)
+		r := tr.(*Registry)
+
+		So(r.Register("service", registry.WithAddress("127.0.0.1:8000")), ShouldBeNil)
+		// 预热期间更新目标权重
+		So(r.UpdateWeight("service", 50), ShouldBeNil)
+		time.Sleep(1500 * time.Millisecond)
+		var weights []int
+		for _, val := range c.putValues() {
+			node, err := model.Unmarshal([]byte(val))
+			So(err, ShouldBeNil)
+			weights = append(weights, node.Weight)
+		}
+		So(len(weights), ShouldBeGreaterThan, 2)
+		So(weights[0], ShouldBeLessThan, 50)
+		for i := 1; i < len(weights); i++ {
+			So(weights[i], ShouldBeGreaterThanOrEqualTo, weights[i-1])
+		}
+		So(weights[len(weights)-1], ShouldEqual, 50)
+		So(r.Deregister("service"), ShouldBeNil)
 	})
-	client.Watcher = newRegistryWatcher()
-	client.Lease = newLease()
-	client.KV = newRegistryKv()
-	return client
 }
 
-// newRegistryKv 新建一个watcher，实现etcd的KV接口
-func newRegistryKv() clientv3.KV {
-	return &registryKv{}
+// blockingEtcd 开启后阻塞下一次写入，直到 release 被关闭
+type blockingEtcd struct {
+	*fake.Etcd
+	armed   int32
+	started chan struct{}
+	release chan struct{}
 }
 
-// newRegistryWatcher 新建一个watcher，实现etcd的watcher接口
-func newRegistryWatcher() clientv3.Watcher {
-	return &cacheWatcher{}
+// Put 开启阻塞时通知 started 并等待 release 后写入
+func (e *blockingEtcd) Put(ctx context.Context, key, val string, opts ...clientv3.OpOption) (*clientv3.PutResponse,
+	error) {
+	if atomic.CompareAndSwapInt32(&e.armed, 1, 0) {
+		close(e.started)
+		<-e.release
+	}
+	return e.Etcd.Put(ctx, key, val, opts...)
 }
 
-// newEtcdRegistry 新建etcd注册客户端
-func newEtcdRegistry() tregistry.Registry {
-	c := newRegistryEtcdClient()
-	r, _ := NewRegistry(c, &Config{})
-	return r
+func TestRegistry_DrainDuringWarmUp(t *testing.T) {
+	Convey("预热期间下线，预热写入不会覆盖下线状态", t, func() {
+		oldInterval := minWarmUpInterval
+		minWarmUpInterval = 10 * time.Millisecond
+		defer func() {
+			minWarmUpInterval = oldInterval
+		}()
+		e := &blockingEtcd{Etcd: fake.New(), started: make(chan struct{}), release: make(chan struct{})}
+		defer e.Close()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		events := e.Watch(ctx, model.ServicePath("/fake/", "test"), clientv3.WithPrefix())
+		tr, err := NewRegistry(e, &Config{Prefix: "/fake/", TTL: 10, Weight: 100, WarmUp: 1, DrainPeriod: 1,
+			SyncRegister: true})
+		So(err, ShouldBeNil)
+		r := tr.(*Registry)
+		So(r.Register("test", registry.WithAddress("127.0.0.1:8000")), ShouldBeNil)
+
+		// 阻塞一次预热写入，期间下线
+		atomic.StoreInt32(&e.armed, 1)
+		<-e.started
+		done := make(chan error, 1)
+		go func() {
+			done <- r.Drain(context.Background(), "test")
+		}()
+		time.Sleep(100 * time.Millisecond)
+		close(e.release)
+		So(<-done, ShouldBeNil)
+
+		// 写入下线状态后，直到删除前 etcd 中的节点一直是下线中
+		var draining, deleted bool
+		for !deleted {
+			rsp := <-events
+			for _, event := range rsp.Events {
+				if event.Type == mvccpb.DELETE {
+					deleted = true
+					continue
+				}
+				node, err := model.Unmarshal(event.Kv.Value)
+				So(err, ShouldBeNil)
+				if draining {
+					So(node.Status, ShouldEqual, model.NodeStatusDraining)
+				}
+				draining = node.Status == model.NodeStatusDraining
+			}
+		}
+		So(draining, ShouldBeTrue)
+	})
 }
 
-func TestRegistry_Register(t *testing.T) {
-	Convey("注册", t, func() {
-		r := newEtcdRegistry()
-		fmt.Println(r)
-		So(r, ShouldNotBeNil)
-		err := r.Register("testService", registry.WithAddress("test"))
+func TestRegistry_Codec(t *testing.T) {
+	Convey("测试使用配置的编码写入节点", t, func() {
+		c := newRegistryEtcd()
+		defer c.Close()
+		_, err := NewRegistry(c, &Config{Codec: "xml"})
 		So(err, ShouldNotBeNil)
 
-		_ = r.Register("testService", registry.WithAddress("8.8.8.8:1000"))
-		time.Sleep(100 * time.Millisecond)
-		_ = r.Deregister("testService")
+		tr, err := NewRegistry(c, &Config{SyncRegister: true, Codec: model.CodecProto})
+		So(err, ShouldBeNil)
+		r := tr.(*Registry)
+
+		So(r.Register("service", registry.WithAddress("127.0.0.1:8000")), ShouldBeNil)
+		putValues := c.putValues()
+		putValue := putValues[len(putValues)-1]
+		So(putValue[0], ShouldEqual, 0)
+		node, err := model.Unmarshal([]byte(putValue))
+		So(err, ShouldBeNil)
+		So(node.Address, ShouldEqual, "127.0.0.1:8000")
+		So(r.Deregister("service"), ShouldBeNil)
+	})
+}
 
-		_ = r.Deregister("testService1")
+func TestRegistry_Fake(t *testing.T) {
+	Convey("使用内存 etcd 测试租约失效后重新注册和取消注册", t, func() {
+		ctx := context.Background()
+		e := fake.New()
+		defer e.Close()
+		tr, err := NewRegistry(e, &Config{Prefix: "/fake/", TTL: 10, SyncRegister: true})
+		So(err, ShouldBeNil)
+		r := tr.(*Registry)
+		So(r.Register("test", registry.WithAddress("127.0.0.1:8000")), ShouldBeNil)
+		rsp, err := e.Get(ctx, model.ServicePath("/fake/", "test"), clientv3.WithPrefix())
+		So(err, ShouldBeNil)
+		So(len(rsp.Kvs), ShouldEqual, 1)
+		lease := rsp.Kvs[0].Lease
+
+		_, err = e.Revoke(ctx, clientv3.LeaseID(lease))
+		So(err, ShouldBeNil)
+		for i := 0; i < 100; i++ {
+			rsp, err = e.Get(ctx, model.ServicePath("/fake/", "test"), clientv3.WithPrefix())
+			So(err, ShouldBeNil)
+			if len(rsp.Kvs) == 1 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		So(len(rsp.Kvs), ShouldEqual, 1)
+		So(rsp.Kvs[0].Lease, ShouldNotEqual, lease)
+
+		So(r.Deregister("test"), ShouldBeNil)
+		rsp, err = e.Get(ctx, model.ServicePath("/fake/", "test"), clientv3.WithPrefix())
+		So(err, ShouldBeNil)
+		So(len(rsp.Kvs), ShouldEqual, 0)
 	})
 }
 
-func TestRegistry_etcdRegister(t *testing.T) {
-	Convey("测试registry的etcdRegister函数", t, func() {
-		r := newEtcdRegistry().(*Registry)
-		node := &model.Node{
-			Name:     "test",
-			ID:       model.ServiceID("127.0.0.1", "8080", "123"),
-			Address:  "127.0.0.1:8080",
-			Metadata: map[string]string{"key": "value"},
-			Weight:   100,
+func TestRegistry_SetStatus(t *testing.T) {
+	Convey("测试运行时设置实例状态", t, func() {
+		e := fake.New()
+		defer e.Close()
+		tr, err := NewRegistry(e, &Config{Prefix: "/fake/", SyncRegister: true})
+		So(err, ShouldBeNil)
+		r := tr.(*Registry)
+		So(r.SetStatus("service", model.NodeStatusUnhealthy), ShouldEqual, etcderror.ErrServiceNotRegistered)
+		So(r.Register("service", registry.WithAddress("127.0.0.1:8000")), ShouldBeNil)
+		defer r.Deregister("service")
+		status := func() string {
+			rsp, err := e.Get(context.Background(), model.ServicePath("/fake/", "service"), clientv3.WithPrefix())
+			So(err, ShouldBeNil)
+			So(len(rsp.Kvs), ShouldEqual, 1)
+			node, err := model.Unmarshal(rsp.Kvs[0].Value)
+			So(err, ShouldBeNil)
+			return node.Status
 		}
-		go func() {
-			time.Sleep(100 * time.Millisecond)
-			r.cancel()
-		}()
-		r.etcdRegister(node)
+
+		So(r.SetStatus("service", model.NodeStatusUnhealthy), ShouldBeNil)
+		So(status(), ShouldEqual, model.NodeStatusUnhealthy)
+		So(r.Registrations()[0].Status, ShouldEqual, model.NodeStatusUnhealthy)
+		So(r.SetStatus("service", ""), ShouldBeNil)
+		So(status(), ShouldEqual, "")
+
+		// 下线使用 Drain，不能通过设置状态下线
+		So(r.SetStatus("service", model.NodeStatusDraining), ShouldEqual, etcderror.ErrInvalidStatus)
+		So(status(), ShouldEqual, "")
 	})
 }
@@ -0,0 +1,91 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2025 Tencent.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package registry
+
+import (
+	"sort"
+	"time"
+)
+
+// RegistrationState 实例当前的注册状态，用于排查注册问题
+type RegistrationState struct {
+	// ServiceName 服务名
+	ServiceName string `json:"service_name"`
+	// Address 实例地址
+	Address string `json:"address"`
+	// Key 实例在 etcd 中的路径
+	Key string `json:"key"`
+	// Registered 是否已经注册到 etcd
+	Registered bool `json:"registered"`
+	// Error 最近一次注册失败的原因
+	Error string `json:"error,omitempty"`
+	// LeaseID 最近一次写入 etcd 时使用的租约，未写入成功时为 0
+	LeaseID int64 `json:"lease_id"`
+	// TTL 租约时长，单位秒
+	TTL int `json:"ttl"`
+	// Weight 当前写入的权重，预热期间小于目标权重
+	Weight int `json:"weight"`
+	// TargetWeight 目标权重
+	TargetWeight int `json:"target_weight"`
+	// Status 节点状态，为空表示正常提供服务
+	Status string `json:"status,omitempty"`
+	// Start 实例注册时间
+	Start time.Time `json:"start"`
+}
+
+// Registrations 获取所有实例当前的注册状态，按服务名和地址排序
+func (r *Registry) Registrations() []*RegistrationState {
+	r.mu.Lock()
+	states := make([]*RegistrationState, 0, len(r.registrations))
+	for _, instances := range r.registrations {
+		for _, reg := range instances {
+			states = append(states, reg.state(r.cfg.TTL))
+		}
+	}
+	r.mu.Unlock()
+	sortStates(states)
+	return states
+}
+
+// sortStates 按服务名和地址排序
+func sortStates(states []*RegistrationState) {
+	sort.Slice(states, func(i, j int) bool {
+		if states[i].ServiceName != states[j].ServiceName {
+			return states[i].ServiceName < states[j].ServiceName
+		}
+		return states[i].Address < states[j].Address
+	})
+}
+
+// state 获取实例的注册状态
+func (reg *registration) state(ttl int) *RegistrationState {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	s := &RegistrationState{
+		ServiceName:  reg.serviceName,
+		Address:      reg.address,
+		Key:          reg.key,
+		Registered:   reg.registered,
+		LeaseID:      int64(reg.leaseID),
+		TTL:          ttl,
+		Weight:       reg.node.Weight,
+		TargetWeight: reg.targetWeight,
+		Status:       reg.node.Status,
+		Start:        reg.start,
+	}
+	if reg.lastErr != nil {
+		s.Error = reg.lastErr.Error()
+	}
+	return s
+}
@@ -0,0 +1,88 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2023 Tencent.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"trpc.group/trpc-go/trpc-go/naming/registry"
+	"trpc.group/trpc-go/trpc-naming-etcd/client/fake"
+	"trpc.group/trpc-go/trpc-naming-etcd/internal/admin"
+	"trpc.group/trpc-go/trpc-naming-etcd/model"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	. "github.com/glycerine/goconvey/convey"
+)
+
+func TestRegistry_Registrations(t *testing.T) {
+	Convey("测试查询实例的注册状态和租约", t, func() {
+		e := fake.New()
+		defer e.Close()
+		tr, err := NewRegistry(e, &Config{Prefix: "/fake/", TTL: 10, Weight: 50, SyncRegister: true})
+		So(err, ShouldBeNil)
+		r := tr.(*Registry)
+		So(r.Register("test", registry.WithAddress("127.0.0.1:8001")), ShouldBeNil)
+		So(r.Register("test", registry.WithAddress("127.0.0.1:8000")), ShouldBeNil)
+		defer r.Deregister("test")
+		rsp, err := e.Get(context.Background(), model.ServicePath("/fake/", "test"), clientv3.WithPrefix())
+		So(err, ShouldBeNil)
+		So(len(rsp.Kvs), ShouldEqual, 2)
+
+		states := r.Registrations()
+		So(len(states), ShouldEqual, 2)
+		So(states[0].Address, ShouldEqual, "127.0.0.1:8000")
+		So(states[0].Registered, ShouldBeTrue)
+		So(states[0].LeaseID, ShouldEqual, rsp.Kvs[0].Lease)
+		So(states[0].TTL, ShouldEqual, 10)
+		So(states[0].Weight, ShouldEqual, 50)
+		So(states[0].Key, ShouldEqual, string(rsp.Kvs[0].Key))
+
+		// 通过管理命令查询，不同插件注册的同名服务分别返回
+		registriesMu.Lock()
+		saved := registries
+		registries = make(map[string]map[string]*Registry)
+		registriesMu.Unlock()
+		defer func() {
+			registriesMu.Lock()
+			registries = saved
+			registriesMu.Unlock()
+		}()
+		addRegistry("etcd-a", "test", r)
+		addRegistry("etcd-b", "test", r)
+		w := httptest.NewRecorder()
+		admin.Wrap(handleRegistrations).ServeHTTP(w,
+			httptest.NewRequest(http.MethodGet, "/cmds/etcd/registry?service=test", nil))
+		var ret struct {
+			Data map[string][]*RegistrationState `json:"data"`
+		}
+		So(json.Unmarshal(w.Body.Bytes(), &ret), ShouldBeNil)
+		So(len(ret.Data), ShouldEqual, 2)
+		So(len(ret.Data["etcd-b"]), ShouldEqual, 2)
+		So(ret.Data["etcd-a"][1].Address, ShouldEqual, "127.0.0.1:8001")
+		So(ret.Data["etcd-a"][1].LeaseID, ShouldEqual, rsp.Kvs[1].Lease)
+
+		w = httptest.NewRecorder()
+		admin.Wrap(handleRegistrations).ServeHTTP(w,
+			httptest.NewRequest(http.MethodGet, "/cmds/etcd/registry?plugin=etcd-a&service=other", nil))
+		ret.Data = nil
+		So(json.Unmarshal(w.Body.Bytes(), &ret), ShouldBeNil)
+		So(len(ret.Data), ShouldEqual, 1)
+		So(len(ret.Data["etcd-a"]), ShouldEqual, 0)
+	})
+}
@@ -0,0 +1,92 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2025 Tencent.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package registry
+
+import (
+	"math"
+	"time"
+
+	"trpc.group/trpc-go/trpc-go/log"
+	"trpc.group/trpc-go/trpc-naming-etcd/model"
+)
+
+const (
+	// WarmUpCurveLinear 线性预热，权重随时间均匀增长
+	WarmUpCurveLinear = "linear"
+	// WarmUpCurveQuadratic 二次曲线预热，前期增长慢，后期增长快
+	WarmUpCurveQuadratic = "quadratic"
+	// warmUpSteps 预热期间更新权重的次数
+	warmUpSteps = 10
+)
+
+var (
+	// minWarmUpInterval 预热期间更新权重的最小间隔
+	minWarmUpInterval = time.Second
+)
+
+// warmUpWeight 计算实例注册 elapsed 时间后的权重，预热期间最小为1
+func warmUpWeight(target int, elapsed, warmUp time.Duration, curve string) int {
+	if warmUp <= 0 || elapsed >= warmUp || target <= 1 {
+		return target
+	}
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	ratio := float64(elapsed) / float64(warmUp)
+	if curve == WarmUpCurveQuadratic {
+		ratio *= ratio
+	}
+	weight := int(math.Ceil(float64(target) * ratio))
+	if weight < 1 {
+		return 1
+	}
+	return weight
+}
+
+// weightLocked 计算实例在 now 时的权重，必须要获取实例的锁后操作
+func (r *Registry) weightLocked(reg *registration, now time.Time) int {
+	return warmUpWeight(reg.targetWeight, now.Sub(reg.start), time.Duration(r.cfg.WarmUp)*time.Second,
+		r.cfg.WarmUpCurve)
+}
+
+// warmUp 预热期间定时提升实例权重并写入 etcd，达到目标权重或者取消注册后退出
+func (r *Registry) warmUp(reg *registration) {
+	interval := time.Duration(r.cfg.WarmUp) * time.Second / warmUpSteps
+	if interval < minWarmUpInterval {
+		interval = minWarmUpInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-reg.ctx.Done():
+			return
+		}
+		var done bool
+		reg.updateNode(func(node *model.Node) {
+			node.Weight = r.weightLocked(reg, time.Now())
+			done = node.Weight >= reg.targetWeight
+		})
+		// 还没有注册成功时由注册流程写入最新的权重
+		if registered, _ := reg.status(); registered {
+			if _, err := r.put(reg); err != nil {
+				log.Tracef("update %s warm up weight fail, err:%v", reg.serviceName, err)
+			}
+		}
+		if done {
+			return
+		}
+	}
+}
@@ -0,0 +1,117 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2025 Tencent.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package selector
+
+import (
+	"fmt"
+
+	"trpc.group/trpc-go/trpc-go/naming/registry"
+)
+
+const (
+	// defaultZoneKey 默认节点元数据中可用区的键
+	defaultZoneKey = "zone"
+	// defaultRegionKey 默认节点元数据中地域的键
+	defaultRegionKey = "region"
+	// defaultMinHealthyPercent 默认本地健康节点占比低于多少时扩展到其他可用区
+	defaultMinHealthyPercent = 70
+)
+
+// LocalityConfig 就近访问配置，优先选择与调用方同可用区的节点，
+// 同可用区健康节点不足时依次扩展到同地域、所有节点
+type LocalityConfig struct {
+	// Zone 调用方所在可用区，Zone 和 Region 都为空时不开启
+	Zone string
+	// Region 调用方所在地域
+	Region string
+	// ZoneKey 节点元数据中可用区的键，默认 zone
+	ZoneKey string
+	// RegionKey 节点元数据中地域的键，默认 region
+	RegionKey string
+	// MinHealthyPercent 本地健康节点占本地节点的百分比低于该值时扩展到更大范围，默认 70
+	MinHealthyPercent int
+}
+
+// locality 就近访问
+type locality struct {
+	cfg *LocalityConfig
+}
+
+// newLocality 新建就近访问，没有配置调用方位置时返回 nil
+func newLocality(cfg *LocalityConfig) *locality {
+	if cfg.Zone == "" && cfg.Region == "" {
+		return nil
+	}
+	if cfg.ZoneKey == "" {
+		cfg.ZoneKey = defaultZoneKey
+	}
+	if cfg.RegionKey == "" {
+		cfg.RegionKey = defaultRegionKey
+	}
+	if cfg.MinHealthyPercent <= 0 || cfg.MinHealthyPercent > 100 {
+		cfg.MinHealthyPercent = defaultMinHealthyPercent
+	}
+	return &locality{cfg: cfg}
+}
+
+// filter 从健康节点中选择最近的节点，all 为全部节点，healthy 为 all 中健康的节点。
+// 依次尝试同可用区、同地域的节点，健康节点数满足比例时使用该范围内的健康节点，否则使用全部健康节点
+func (l *locality) filter(all, healthy []*registry.Node) []*registry.Node {
+	if l == nil || len(healthy) == 0 {
+		return healthy
+	}
+	isHealthy := make(map[*registry.Node]bool, len(healthy))
+	for _, node := range healthy {
+		isHealthy[node] = true
+	}
+	tiers := []struct {
+		key   string
+		value string
+	}{
+		{key: l.cfg.ZoneKey, value: l.cfg.Zone},
+		{key: l.cfg.RegionKey, value: l.cfg.Region},
+	}
+	for _, tier := range tiers {
+		if tier.value == "" {
+			continue
+		}
+		var total int
+		var local []*registry.Node
+		for _, node := range all {
+			if metadataValue(node, tier.key) != tier.value {
+				continue
+			}
+			total++
+			if isHealthy[node] {
+				local = append(local, node)
+			}
+		}
+		if len(local) > 0 && len(local)*100 >= total*l.cfg.MinHealthyPercent {
+			return local
+		}
+	}
+	return healthy
+}
+
+// metadataValue 获取节点元数据的字符串值
+func metadataValue(node *registry.Node, key string) string {
+	value, ok := node.Metadata[key]
+	if !ok {
+		return ""
+	}
+	if s, ok := value.(string); ok {
+		return s
+	}
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,227 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2025 Tencent.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package selector
+
+import (
+	"sync"
+	"time"
+
+	"trpc.group/trpc-go/trpc-go/naming/registry"
+)
+
+const (
+	// defaultConsecutiveErrors 默认连续失败多少次后摘除节点
+	defaultConsecutiveErrors = 5
+	// defaultErrorRate 默认错误率达到多少后摘除节点
+	defaultErrorRate = 0.5
+	// defaultMinRequests 默认统计周期内请求数达到多少后才按错误率摘除节点
+	defaultMinRequests = 20
+	// defaultInterval 默认错误率统计周期
+	defaultInterval = 10 * time.Second
+	// defaultBaseEjectionTime 默认首次摘除时长
+	defaultBaseEjectionTime = 30 * time.Second
+	// defaultMaxEjectionTime 默认最大摘除时长
+	defaultMaxEjectionTime = 300 * time.Second
+	// defaultMaxEjectionPercent 默认最多摘除节点的百分比
+	defaultMaxEjectionPercent = 50
+)
+
+// OutlierConfig 异常节点摘除配置，根据 Report 上报的调用结果临时摘除异常节点
+type OutlierConfig struct {
+	// Enable 为 true 时摘除异常节点，默认不开启
+	Enable bool
+	// ConsecutiveErrors 连续失败多少次后摘除节点，默认 5 次
+	ConsecutiveErrors int
+	// ErrorRate 统计周期内错误率达到多少后摘除节点，取值 (0, 1]，默认 0.5
+	ErrorRate float64
+	// MinRequests 统计周期内请求数达到多少后才按错误率摘除节点，默认 20
+	MinRequests int
+	// Interval 错误率统计周期，默认 10 秒
+	Interval time.Duration
+	// BaseEjectionTime 首次摘除时长，之后每次连续摘除时长翻倍，默认 30 秒
+	BaseEjectionTime time.Duration
+	// MaxEjectionTime 最大摘除时长，默认 300 秒
+	MaxEjectionTime time.Duration
+	// MaxEjectionPercent 最多摘除服务节点的百分比，默认 50
+	MaxEjectionPercent int
+}
+
+// setDefault 设置默认值
+func (c *OutlierConfig) setDefault() {
+	if c.ConsecutiveErrors <= 0 {
+		c.ConsecutiveErrors = defaultConsecutiveErrors
+	}
+	if c.ErrorRate <= 0 || c.ErrorRate > 1 {
+		c.ErrorRate = defaultErrorRate
+	}
+	if c.MinRequests <= 0 {
+		c.MinRequests = defaultMinRequests
+	}
+	if c.Interval <= 0 {
+		c.Interval = defaultInterval
+	}
+	if c.BaseEjectionTime <= 0 {
+		c.BaseEjectionTime = defaultBaseEjectionTime
+	}
+	if c.MaxEjectionTime < c.BaseEjectionTime {
+		c.MaxEjectionTime = defaultMaxEjectionTime
+		if c.MaxEjectionTime < c.BaseEjectionTime {
+			c.MaxEjectionTime = c.BaseEjectionTime
+		}
+	}
+	if c.MaxEjectionPercent <= 0 || c.MaxEjectionPercent > 100 {
+		c.MaxEjectionPercent = defaultMaxEjectionPercent
+	}
+}
+
+// nodeStat 节点调用统计
+type nodeStat struct {
+	// consecutive 连续失败次数
+	consecutive int
+	// requests 当前统计周期内的请求数
+	requests int
+	// failures 当前统计周期内的失败数
+	failures int
+	// windowStart 当前统计周期开始时间
+	windowStart time.Time
+	// ejectedUntil 摘除结束时间
+	ejectedUntil time.Time
+	// ejections 连续摘除次数，用于计算摘除时长
+	ejections int
+}
+
+// outlierDetector 异常节点检测
+type outlierDetector struct {
+	sync.Mutex
+	cfg *OutlierConfig
+	// stats 服务名 -> 节点地址 -> 调用统计
+	stats map[string]map[string]*nodeStat
+}
+
+// newOutlierDetector 新建异常节点检测
+func newOutlierDetector(cfg *OutlierConfig) *outlierDetector {
+	cfg.setDefault()
+	return &outlierDetector{
+		cfg:   cfg,
+		stats: make(map[string]map[string]*nodeStat),
+	}
+}
+
+// report 记录一次调用结果，达到摘除条件时摘除节点
+func (o *outlierDetector) report(node *registry.Node, err error, now time.Time) {
+	o.Lock()
+	defer o.Unlock()
+	stats, ok := o.stats[node.ServiceName]
+	if !ok {
+		stats = make(map[string]*nodeStat)
+		o.stats[node.ServiceName] = stats
+	}
+	stat, ok := stats[node.Address]
+	if !ok {
+		stat = &nodeStat{windowStart: now}
+		stats[node.Address] = stat
+	}
+	// 摘除期间的调用结果不统计
+	if now.Before(stat.ejectedUntil) {
+		return
+	}
+	if now.Sub(stat.windowStart) >= o.cfg.Interval {
+		// 上个统计周期没有被摘除，逐步恢复摘除时长
+		if stat.ejections > 0 && stat.ejectedUntil.Before(stat.windowStart) {
+			stat.ejections--
+		}
+		stat.requests, stat.failures = 0, 0
+		stat.windowStart = now
+	}
+	stat.requests++
+	if err == nil {
+		stat.consecutive = 0
+		return
+	}
+	stat.failures++
+	stat.consecutive++
+	if stat.consecutive >= o.cfg.ConsecutiveErrors ||
+		(stat.requests >= o.cfg.MinRequests && float64(stat.failures) >= o.cfg.ErrorRate*float64(stat.requests)) {
+		o.eject(stat, now)
+	}
+}
+
+// eject 摘除节点，摘除时长随连续摘除次数指数增长
+func (o *outlierDetector) eject(stat *nodeStat, now time.Time) {
+	d := o.cfg.BaseEjectionTime
+	for i := 0; i < stat.ejections && d < o.cfg.MaxEjectionTime; i++ {
+		d *= 2
+	}
+	if d > o.cfg.MaxEjectionTime {
+		d = o.cfg.MaxEjectionTime
+	}
+	stat.ejectedUntil = now.Add(d)
+	stat.ejections++
+	stat.consecutive = 0
+	stat.requests, stat.failures = 0, 0
+	stat.windowStart = now
+}
+
+// purge 清理已经不在服务节点列表中的节点统计，nodes 必须是服务的全部节点，而不是路由选中的部分节点
+func (o *outlierDetector) purge(serviceName string, nodes []*registry.Node) {
+	o.Lock()
+	defer o.Unlock()
+	stats, ok := o.stats[serviceName]
+	if !ok {
+		return
+	}
+	exists := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		exists[node.Address] = true
+	}
+	for address := range stats {
+		if !exists[address] {
+			delete(stats, address)
+		}
+	}
+	if len(stats) == 0 {
+		delete(o.stats, serviceName)
+	}
+}
+
+// filter 过滤被摘除的节点，摘除的节点数不超过最大百分比
+func (o *outlierDetector) filter(serviceName string, nodes []*registry.Node, now time.Time) []*registry.Node {
+	o.Lock()
+	defer o.Unlock()
+	stats, ok := o.stats[serviceName]
+	if !ok || len(nodes) == 0 {
+		return nodes
+	}
+	maxEjected := len(nodes) * o.cfg.MaxEjectionPercent / 100
+	var ejected int
+	var healthy []*registry.Node
+	for i, node := range nodes {
+		stat, ok := stats[node.Address]
+		if !ok || !now.Before(stat.ejectedUntil) || ejected >= maxEjected {
+			if healthy != nil {
+				healthy = append(healthy, node)
+			}
+			continue
+		}
+		if healthy == nil {
+			healthy = make([]*registry.Node, i, len(nodes))
+			copy(healthy, nodes[:i])
+		}
+		ejected++
+	}
+	if healthy == nil {
+		return nodes
+	}
+	return healthy
+}
@@ -0,0 +1,177 @@
+//
+//
+// Tencent is pleased to support the open source community by making tRPC available.
+//
+// Copyright (C) 2025 Tencent.
+// All rights reserved.
+//
+// If you have downloaded a copy of the tRPC source code from Tencent,
+// please note that tRPC source code is licensed under the Apache 2.0 License,
+// A copy of the Apache 2.0 License is included in this file.
+//
+//
+
+package selector
+
+import (
+	"context"
+	"fmt"
+
+	"trpc.group/trpc-go/trpc-go/codec"
+	"trpc.group/trpc-go/trpc-go/naming/registry"
+	etcderror "trpc.group/trpc-go/trpc-naming-etcd/error"
+)
+
+// RouteRule 元数据路由规则
+type RouteRule struct {
+	// Service 规则生效的服务名，为空时对所有没有单独配置规则的服务生效
+	Service string
+	// Routes 按顺序尝试的路由，前一个路由没有匹配的节点时使用下一个，都没有匹配的节点时返回错误，
+	// 需要兜底使用全部节点时在最后添加一个空路由
+	Routes []Route
+}
+
+// Route 路由匹配条件，所有条件都满足的节点才会被选中
+type Route struct {
+	// Metadata 节点元数据需要等于的值，例如 env=canary
+	Metadata map[string]string
+	// ContextKeys 从请求上下文透传信息中获取值的元数据键，节点元数据需要等于获取的值，
+	// 请求上下文中没有该键时跳过该路由
+	ContextKeys []string
+}
+
+// router 元数据路由
+type router struct {
+	// rules 服务名 -> 路由规则
+	rules map[string]*RouteRule
+	// defaultRule 没有单独配置规则的服务使用的规则
+	defaultRule *RouteRule
+}
+
+// newRouter 新建元数据路由
+func newRouter(rules []RouteRule) *router {
+	r := &router{rules: make(map[string]*RouteRule)}
+	for i := range rules {
+		rule := &rules[i]
+		if rule.Service == "" {
+			r.defaultRule = rule
+			continue
+		}
+		r.rules[rule.Service] = rule
+	}
+	return r
+}
+
+// route 根据调用方指定的元数据和路由规则过滤节点，
+// 调用方指定的元数据最先匹配，没有匹配的节点时依次使用路由规则，没有路由规则时使用全部节点
+func (r *router) route(ctx context.Context, serviceName string, metadata map[string]string,
+	nodes []*registry.Node) ([]*registry.Node, error) {
+	want, err := r.match(ctx, serviceName, metadata, nodes)
+	if err != nil {
+		return nil, err
+	}
+	return filterMetadata(nodes, want), nil
+}
+
+// match 返回 route 选中的节点元数据，不需要过滤时返回 nil
+func (r *router) match(ctx context.Context, serviceName string, metadata map[string]string,
+	nodes []*registry.Node) (map[string]string, error) {
+	if len(metadata) > 0 {
+		if matched := filterMetadata(nodes, metadata); len(matched) > 0 {
+			return metadata, nil
+		}
+	}
+	rule := r.rule(serviceName)
+	if rule == nil || len(rule.Routes) == 0 {
+		return nil, nil
+	}
+	for _, route := range rule.Routes {
+		want, ok := route.metadata(ctx)
+		if !ok {
+			continue
+		}
+		if matched := filterMetadata(nodes, want); len(matched) > 0 {
+			return want, nil
+		}
+	}
+	return nil, etcderror.ErrNoNodeMatched
+}
+
+// rule 获取服务的路由规则
+func (r *router) rule(serviceName string) *RouteRule {
+	if r == nil {
+		return nil
+	}
+	if rule, ok := r.rules[serviceName]; ok {
+		return rule
+	}
+	return r.defaultRule
+}
+
+// metadata 获取路由要求的节点元数据，请求上下文中没有需要的键时返回 false
+func (r *Route) metadata(ctx context.Context) (map[string]string, bool) {
+	if len(r.ContextKeys) == 0 {
+		return r.Metadata, true
+	}
+	want := make(map[string]string, len(r.Metadata)+len(r.ContextKeys))
+	for k, v := range r.Metadata {
+		want[k] = v
+	}
+	for _, key := range r.ContextKeys {
+		v, ok := contextValue(ctx, key)
+		if !ok {
+			return nil, false
+		}
+		want[key] = v
+	}
+	return want, true
+}
+
+// contextValue 从请求上下文的透传信息中获取值，优先使用发往下游的透传信息，其次使用上游传入的透传信息
+func contextValue(ctx context.Context, key string) (string, bool) {
+	if ctx == nil {
+		return "", false
+	}
+	msg := codec.Message(ctx)
+	if v, ok := msg.ClientMetaData()[key]; ok && len(v) > 0 {
+		return string(v), true
+	}
+	if v, ok := msg.ServerMetaData()[key]; ok && len(v) > 0 {
+		return string(v), true
+	}
+	return "", false
+}
+
+// filterMetadata 过滤元数据与 want 全部相等的节点
+func filterMetadata(nodes []*registry.Node, want map[string]string) []*registry.Node {
+	if len(want) == 0 {
+		return nodes
+	}
+	var matched []*registry.Node
+	for _, node := range nodes {
+		if matchMetadata(node, want) {
+			matched = append(matched, node)
+		}
+	}
+	return matched
+}
+
+// matchMetadata 判断节点元数据是否与 want 全部相等
+func matchMetadata(node *registry.Node, want map[string]string) bool {
+	for k, v := range want {
+		value, ok := node.Metadata[k]
+		if !ok {
+			return false
+		}
+		if s, ok := value.(string); ok {
+			if s != v {
+				return false
+			}
+			continue
+		}
+		if fmt.Sprint(value) != v {
+			return false
+		}
+	}
+	return true
+}
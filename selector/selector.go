@@ -23,6 +23,8 @@ import (
 	"trpc.group/trpc-go/trpc-go/naming/selector"
 	tselector "trpc.group/trpc-go/trpc-go/naming/selector"
 	etcderror "trpc.group/trpc-go/trpc-naming-etcd/error"
+	"trpc.group/trpc-go/trpc-naming-etcd/internal/metrics"
+	"trpc.group/trpc-go/trpc-naming-etcd/model"
 )
 
 const (
@@ -34,12 +36,24 @@ const (
 type Config struct {
 	//LoadBalancer 负载均衡策略
 	LoadBalancer string
+	// Outlier 异常节点摘除配置
+	Outlier OutlierConfig
+	// Rules 元数据路由规则
+	Rules []RouteRule
+	// Locality 就近访问配置
+	Locality LocalityConfig
 }
 
 // Selector 路由
 type Selector struct {
 	cfg       *Config
 	discovery tdiscovery.Discovery
+	// outlier 异常节点检测，未开启时为 nil
+	outlier *outlierDetector
+	// router 元数据路由
+	router *router
+	// locality 就近访问，未开启时为 nil
+	locality *locality
 }
 
 // NewSelector 新建路由
@@ -47,14 +61,31 @@ func NewSelector(d tdiscovery.Discovery, cfg *Config) tselector.Selector {
 	if cfg.LoadBalancer == "" {
 		cfg.LoadBalancer = defaultLoadBalancer
 	}
-	return &Selector{
+	s := &Selector{
 		cfg:       cfg,
 		discovery: d,
+		router:    newRouter(cfg.Rules),
+		locality:  newLocality(&cfg.Locality),
 	}
+	if cfg.Outlier.Enable {
+		s.outlier = newOutlierDetector(&cfg.Outlier)
+	}
+	return s
 }
 
 // Select 选择节点
 func (s *Selector) Select(serviceName string, opts ...selector.Option) (*registry.Node, error) {
+	node, err := s.selectNode(serviceName, opts...)
+	if err != nil {
+		metrics.Incr(metrics.SelectFail)
+		return nil, err
+	}
+	metrics.Incr(metrics.SelectSuccess)
+	return node, nil
+}
+
+// selectNode 依次过滤不可用节点、按元数据路由、摘除异常节点、就近访问，再按负载均衡选择节点
+func (s *Selector) selectNode(serviceName string, opts ...selector.Option) (*registry.Node, error) {
 	o := &selector.Options{}
 	for _, opt := range opts {
 		opt(o)
@@ -63,6 +94,24 @@ func (s *Selector) Select(serviceName string, opts ...selector.Option) (*registr
 	if err != nil {
 		return nil, err
 	}
+	// 路由只选中部分节点，需要在路由之前按全部节点清理统计，避免其他路由节点的摘除状态被清除
+	if s.outlier != nil {
+		s.outlier.purge(serviceName, nodes)
+	}
+	available := filterUnavailable(nodes)
+	if len(available) == 0 {
+		return nil, etcderror.ErrServerNotAvailable
+	}
+	want, err := s.router.match(o.Ctx, serviceName, o.DestinationMetadata, available)
+	if err != nil {
+		return nil, err
+	}
+	healthy := filterMetadata(available, want)
+	if s.outlier != nil {
+		healthy = s.outlier.filter(serviceName, healthy, time.Now())
+	}
+	// 就近访问按路由选中的全部节点统计本地节点数，下线中、不健康和被摘除的节点都算作不健康
+	nodes = s.locality.filter(filterMetadata(nodes, want), healthy)
 	load := loadbalance.Get(s.cfg.LoadBalancer)
 	if load == nil {
 		return nil, etcderror.ErrBalancerNotExist
@@ -77,7 +126,36 @@ func (s *Selector) Select(serviceName string, opts ...selector.Option) (*registr
 	return load.Select(serviceName, nodes, loadBalanceOpts...)
 }
 
-// Report 上报调用结果
+// filterUnavailable 过滤下线中和不健康的节点，所有节点都不可用时返回空列表
+func filterUnavailable(nodes []*registry.Node) []*registry.Node {
+	var unavailable int
+	for _, node := range nodes {
+		if isUnavailable(node) {
+			unavailable++
+		}
+	}
+	if unavailable == 0 {
+		return nodes
+	}
+	serving := make([]*registry.Node, 0, len(nodes)-unavailable)
+	for _, node := range nodes {
+		if !isUnavailable(node) {
+			serving = append(serving, node)
+		}
+	}
+	return serving
+}
+
+// isUnavailable 判断节点是否下线中或者不健康
+func isUnavailable(node *registry.Node) bool {
+	return model.IsDraining(node) || model.IsUnhealthy(node)
+}
+
+// Report 上报调用结果，用于摘除异常节点
 func (s *Selector) Report(node *registry.Node, cost time.Duration, err error) error {
+	if s.outlier == nil || node == nil {
+		return nil
+	}
+	s.outlier.report(node, err, time.Now())
 	return nil
 }
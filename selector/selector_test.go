@@ -20,11 +20,14 @@ import (
 	"testing"
 	"time"
 
+	"trpc.group/trpc-go/trpc-go/codec"
 	tdiscovery "trpc.group/trpc-go/trpc-go/naming/discovery"
 	"trpc.group/trpc-go/trpc-go/naming/loadbalance"
 	tregistry "trpc.group/trpc-go/trpc-go/naming/registry"
 	tselector "trpc.group/trpc-go/trpc-go/naming/selector"
 	"trpc.group/trpc-go/trpc-naming-etcd/discovery"
+	etcderror "trpc.group/trpc-go/trpc-naming-etcd/error"
+	"trpc.group/trpc-go/trpc-naming-etcd/model"
 
 	"github.com/golang/mock/gomock"
 	clientv3 "go.etcd.io/etcd/client/v3"
@@ -84,3 +87,289 @@ func TestSelector_Select(t *testing.T) {
 		patch.Reset()
 	})
 }
+
+func Test_filterUnavailable(t *testing.T) {
+	Convey("过滤下线中和不健康的节点", t, func() {
+		serving := &tregistry.Node{Address: "127.0.0.1:8000"}
+		draining := &tregistry.Node{
+			Address:  "127.0.0.1:8001",
+			Metadata: map[string]interface{}{model.MetadataKeyStatus: model.NodeStatusDraining},
+		}
+		So(filterUnavailable([]*tregistry.Node{serving, draining}), ShouldResemble, []*tregistry.Node{serving})
+		So(filterUnavailable([]*tregistry.Node{serving}), ShouldResemble, []*tregistry.Node{serving})
+		// 所有节点都在下线中时不再选中任何节点
+		So(len(filterUnavailable([]*tregistry.Node{draining})), ShouldEqual, 0)
+		So(len(filterUnavailable(nil)), ShouldEqual, 0)
+		unhealthy := &tregistry.Node{
+			Address:  "127.0.0.1:8002",
+			Metadata: map[string]interface{}{model.MetadataKeyStatus: model.NodeStatusUnhealthy},
+		}
+		So(filterUnavailable([]*tregistry.Node{serving, unhealthy, draining}), ShouldResemble,
+			[]*tregistry.Node{serving})
+	})
+}
+
+func Test_outlierDetector(t *testing.T) {
+	Convey("测试异常节点摘除", t, func() {
+		o := newOutlierDetector(&OutlierConfig{ConsecutiveErrors: 3, MinRequests: 4, ErrorRate: 0.5,
+			Interval: time.Minute, BaseEjectionTime: time.Second, MaxEjectionTime: 3 * time.Second})
+		nodes := []*tregistry.Node{
+			{ServiceName: "test", Address: "127.0.0.1:8000"},
+			{ServiceName: "test", Address: "127.0.0.1:8001"},
+			{ServiceName: "test", Address: "127.0.0.1:8002"},
+			{ServiceName: "test", Address: "127.0.0.1:8003"},
+		}
+		now := time.Now()
+		fail := errors.New("fail")
+
+		// 连续失败达到阈值后摘除
+		o.report(nodes[0], fail, now)
+		o.report(nodes[0], fail, now)
+		So(len(o.filter("test", nodes, now)), ShouldEqual, 4)
+		o.report(nodes[0], fail, now)
+		filtered := o.filter("test", nodes, now)
+		So(len(filtered), ShouldEqual, 3)
+		So(filtered[0].Address, ShouldEqual, "127.0.0.1:8001")
+		// 摘除时间结束后恢复
+		So(len(o.filter("test", nodes, now.Add(time.Second))), ShouldEqual, 4)
+
+		// 再次摘除时长翻倍，且不超过最大摘除时长
+		now = now.Add(time.Second)
+		for i := 0; i < 3; i++ {
+			o.report(nodes[0], fail, now)
+		}
+		So(len(o.filter("test", nodes, now.Add(1500*time.Millisecond))), ShouldEqual, 3)
+		So(len(o.filter("test", nodes, now.Add(2*time.Second))), ShouldEqual, 4)
+		now = now.Add(2 * time.Second)
+		for j := 0; j < 2; j++ {
+			for i := 0; i < 3; i++ {
+				o.report(nodes[0], fail, now)
+			}
+			now = now.Add(3 * time.Second)
+		}
+		So(o.stats["test"]["127.0.0.1:8000"].ejectedUntil.Equal(now), ShouldBeTrue)
+
+		// 错误率达到阈值后摘除
+		o.report(nodes[1], nil, now)
+		o.report(nodes[1], fail, now)
+		o.report(nodes[1], nil, now)
+		So(len(o.filter("test", nodes, now)), ShouldEqual, 4)
+		o.report(nodes[1], fail, now)
+		So(len(o.filter("test", nodes, now)), ShouldEqual, 3)
+
+		// 摘除节点数不超过最大百分比
+		for i := 0; i < 3; i++ {
+			o.report(nodes[2], fail, now)
+			o.report(nodes[3], fail, now)
+		}
+		filtered = o.filter("test", nodes, now)
+		So(len(filtered), ShouldEqual, 2)
+
+		// 只按部分节点过滤时不清理其他节点的统计
+		So(len(o.filter("test", nodes[:1], now)), ShouldEqual, 1)
+		So(len(o.stats["test"]), ShouldEqual, 4)
+		// 不存在的节点统计被清理
+		o.purge("test", nodes[:1])
+		So(len(o.stats["test"]), ShouldEqual, 1)
+		o.purge("test", nil)
+		So(o.stats["test"], ShouldBeNil)
+	})
+}
+
+// staticDiscovery 返回固定节点的服务发现
+type staticDiscovery struct {
+	nodes []*tregistry.Node
+}
+
+// List 返回固定节点
+func (d *staticDiscovery) List(serviceName string, opts ...tdiscovery.Option) ([]*tregistry.Node, error) {
+	return d.nodes, nil
+}
+
+func TestSelector_OutlierAcrossRoutes(t *testing.T) {
+	Convey("切换路由后其他路由节点的摘除状态保持不变", t, func() {
+		nodes := []*tregistry.Node{
+			{ServiceName: "test", Address: "127.0.0.1:8000", Metadata: map[string]interface{}{"env": "stable"}},
+			{ServiceName: "test", Address: "127.0.0.1:8001", Metadata: map[string]interface{}{"env": "stable"}},
+			{ServiceName: "test", Address: "127.0.0.1:8002", Metadata: map[string]interface{}{"env": "canary"}},
+			{ServiceName: "test", Address: "127.0.0.1:8003", Metadata: map[string]interface{}{"env": "canary"}},
+		}
+		s := NewSelector(&staticDiscovery{nodes: nodes},
+			&Config{Outlier: OutlierConfig{Enable: true, ConsecutiveErrors: 1}})
+		So(s.Report(nodes[2], time.Second, errors.New("fail")), ShouldBeNil)
+		for i := 0; i < 10; i++ {
+			node, err := s.Select("test", tselector.WithDestinationMetadata("env", "stable"))
+			So(err, ShouldBeNil)
+			So(node.Metadata["env"], ShouldEqual, "stable")
+		}
+		for i := 0; i < 10; i++ {
+			node, err := s.Select("test", tselector.WithDestinationMetadata("env", "canary"))
+			So(err, ShouldBeNil)
+			So(node.Address, ShouldEqual, "127.0.0.1:8003")
+		}
+
+		// 节点下线后统计被清理
+		s.(*Selector).discovery = &staticDiscovery{nodes: nodes[:2]}
+		_, err := s.Select("test", tselector.WithDestinationMetadata("env", "stable"))
+		So(err, ShouldBeNil)
+		So(s.(*Selector).outlier.stats["test"], ShouldBeNil)
+	})
+}
+
+func TestSelector_AllDraining(t *testing.T) {
+	Convey("所有节点都在下线中时返回服务不可用", t, func() {
+		s := NewSelector(&staticDiscovery{nodes: []*tregistry.Node{{
+			ServiceName: "test",
+			Address:     "127.0.0.1:8000",
+			Metadata:    map[string]interface{}{model.MetadataKeyStatus: model.NodeStatusDraining},
+		}}}, &Config{})
+		_, err := s.Select("test")
+		So(err, ShouldEqual, etcderror.ErrServerNotAvailable)
+	})
+}
+
+func TestSelector_LocalityDraining(t *testing.T) {
+	Convey("本地节点大部分下线中时扩展到其他可用区", t, func() {
+		local := func(address string, status string) *tregistry.Node {
+			return &tregistry.Node{ServiceName: "test", Address: address,
+				Metadata: map[string]interface{}{"zone": "gz-1", model.MetadataKeyStatus: status}}
+		}
+		nodes := []*tregistry.Node{
+			local("127.0.0.1:8000", ""),
+			local("127.0.0.1:8001", model.NodeStatusDraining),
+			local("127.0.0.1:8002", model.NodeStatusDraining),
+			local("127.0.0.1:8003", model.NodeStatusUnhealthy),
+			{ServiceName: "test", Address: "127.0.0.1:9000", Metadata: map[string]interface{}{"zone": "gz-2"}},
+			{ServiceName: "test", Address: "127.0.0.1:9001", Metadata: map[string]interface{}{"zone": "gz-2"}},
+		}
+		s := NewSelector(&staticDiscovery{nodes: nodes}, &Config{Locality: LocalityConfig{Zone: "gz-1"}})
+		selected := make(map[string]bool)
+		for i := 0; i < 100; i++ {
+			node, err := s.Select("test")
+			So(err, ShouldBeNil)
+			So(isUnavailable(node), ShouldBeFalse)
+			selected[node.Address] = true
+		}
+		So(selected["127.0.0.1:9000"] || selected["127.0.0.1:9001"], ShouldBeTrue)
+
+		// 本地节点都可用时只选择本地节点
+		s = NewSelector(&staticDiscovery{nodes: []*tregistry.Node{nodes[0], nodes[4], nodes[5]}},
+			&Config{Locality: LocalityConfig{Zone: "gz-1"}})
+		for i := 0; i < 10; i++ {
+			node, err := s.Select("test")
+			So(err, ShouldBeNil)
+			So(node.Address, ShouldEqual, "127.0.0.1:8000")
+		}
+	})
+}
+
+func TestSelector_Report(t *testing.T) {
+	Convey("测试上报调用结果", t, func() {
+		s := NewSelector(nil, &Config{Outlier: OutlierConfig{Enable: true, ConsecutiveErrors: 1}}).(*Selector)
+		So(s.Report(nil, time.Second, errors.New("fail")), ShouldBeNil)
+		node := &tregistry.Node{ServiceName: "test", Address: "127.0.0.1:8000"}
+		So(s.Report(node, time.Second, errors.New("fail")), ShouldBeNil)
+		So(s.outlier.stats["test"]["127.0.0.1:8000"].ejections, ShouldEqual, 1)
+
+		// 默认不开启异常节点摘除
+		s = NewSelector(nil, &Config{}).(*Selector)
+		So(s.outlier, ShouldBeNil)
+		So(s.Report(node, time.Second, errors.New("fail")), ShouldBeNil)
+		So((&Selector{}).Report(node, time.Second, nil), ShouldBeNil)
+	})
+}
+
+func Test_router(t *testing.T) {
+	Convey("测试元数据路由", t, func() {
+		nodes := []*tregistry.Node{
+			{Address: "127.0.0.1:8000", Metadata: map[string]interface{}{"env": "prod", "version": "v1"}},
+			{Address: "127.0.0.1:8001", Metadata: map[string]interface{}{"env": "canary", "version": "v2"}},
+			{Address: "127.0.0.1:8002", Metadata: map[string]interface{}{"env": "prod", "weight": 10}},
+		}
+		// 没有路由规则时，调用方指定的元数据没有匹配的节点则使用全部节点
+		r := newRouter(nil)
+		matched, err := r.route(context.Background(), "test", map[string]string{"env": "canary"}, nodes)
+		So(err, ShouldBeNil)
+		So(len(matched), ShouldEqual, 1)
+		So(matched[0].Address, ShouldEqual, "127.0.0.1:8001")
+		matched, err = r.route(context.Background(), "test", map[string]string{"env": "test"}, nodes)
+		So(err, ShouldBeNil)
+		So(len(matched), ShouldEqual, 3)
+		matched, err = r.route(context.Background(), "test", map[string]string{"weight": "10"}, nodes)
+		So(err, ShouldBeNil)
+		So(len(matched), ShouldEqual, 1)
+
+		r = newRouter([]RouteRule{
+			{Service: "test", Routes: []Route{
+				{ContextKeys: []string{"env"}},
+				{Metadata: map[string]string{"version": "v1"}},
+			}},
+			{Routes: []Route{{Metadata: map[string]string{"env": "prod"}}, {}}},
+		})
+		// 请求上下文中没有透传信息时跳过该路由
+		matched, err = r.route(context.Background(), "test", nil, nodes)
+		So(err, ShouldBeNil)
+		So(len(matched), ShouldEqual, 1)
+		So(matched[0].Address, ShouldEqual, "127.0.0.1:8000")
+
+		// 使用请求上下文透传信息中的值匹配
+		ctx, msg := codec.WithNewMessage(context.Background())
+		msg.WithServerMetaData(codec.MetaData{"env": []byte("canary")})
+		matched, err = r.route(ctx, "test", nil, nodes)
+		So(err, ShouldBeNil)
+		So(len(matched), ShouldEqual, 1)
+		So(matched[0].Address, ShouldEqual, "127.0.0.1:8001")
+		// 发往下游的透传信息优先
+		msg.WithClientMetaData(codec.MetaData{"env": []byte("prod")})
+		matched, err = r.route(ctx, "test", nil, nodes)
+		So(err, ShouldBeNil)
+		So(len(matched), ShouldEqual, 2)
+
+		// 所有路由都没有匹配的节点时返回错误
+		_, err = r.route(context.Background(), "test", nil, nodes[1:])
+		So(err, ShouldEqual, etcderror.ErrNoNodeMatched)
+
+		// 默认规则，最后的空路由兜底使用全部节点
+		matched, err = r.route(context.Background(), "other", nil, nodes)
+		So(err, ShouldBeNil)
+		So(len(matched), ShouldEqual, 2)
+		matched, err = r.route(context.Background(), "other", nil, nodes[1:2])
+		So(err, ShouldBeNil)
+		So(len(matched), ShouldEqual, 1)
+	})
+}
+
+func Test_locality(t *testing.T) {
+	Convey("测试就近访问", t, func() {
+		So(newLocality(&LocalityConfig{}), ShouldBeNil)
+		nodes := []*tregistry.Node{
+			{Address: "127.0.0.1:8000", Metadata: map[string]interface{}{"zone": "gz-1", "region": "gz"}},
+			{Address: "127.0.0.1:8001", Metadata: map[string]interface{}{"zone": "gz-1", "region": "gz"}},
+			{Address: "127.0.0.1:8002", Metadata: map[string]interface{}{"zone": "gz-2", "region": "gz"}},
+			{Address: "127.0.0.1:8003", Metadata: map[string]interface{}{"zone": "sh-1", "region": "sh"}},
+			{Address: "127.0.0.1:8004"},
+		}
+		l := newLocality(&LocalityConfig{Zone: "gz-1", Region: "gz", MinHealthyPercent: 60})
+		// 同可用区节点健康时只使用同可用区节点
+		selected := l.filter(nodes, nodes)
+		So(len(selected), ShouldEqual, 2)
+		So(selected[0].Address, ShouldEqual, "127.0.0.1:8000")
+
+		// 同可用区健康节点不足时扩展到同地域
+		healthy := []*tregistry.Node{nodes[0], nodes[2], nodes[3], nodes[4]}
+		selected = l.filter(nodes, healthy)
+		So(len(selected), ShouldEqual, 2)
+		So(selected[1].Address, ShouldEqual, "127.0.0.1:8002")
+
+		// 同地域健康节点不足时使用全部健康节点
+		healthy = []*tregistry.Node{nodes[3], nodes[4]}
+		So(len(l.filter(nodes, healthy)), ShouldEqual, 2)
+		So(len(l.filter(nodes, nil)), ShouldEqual, 0)
+
+		// 没有同可用区的节点时使用同地域节点
+		l = newLocality(&LocalityConfig{Zone: "gz-3", Region: "gz"})
+		So(len(l.filter(nodes, nodes)), ShouldEqual, 3)
+		var nilLocality *locality
+		So(len(nilLocality.filter(nodes, nodes)), ShouldEqual, 5)
+	})
+}